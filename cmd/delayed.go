@@ -0,0 +1,116 @@
+/*
+Copyright © 2023 thin-edge thinedge@thin-edge.io
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/service"
+	"github.com/spf13/cobra"
+)
+
+// delayedCmd represents the delayed command
+var delayedCmd = &cobra.Command{
+	Use:   "delayed",
+	Short: "Delayed messages",
+	Long: `Manage the delayed messages which are waiting to be sent.
+
+Delayed messages are persisted in the state directory so they are still sent
+if the service is restarted before the delay has elapsed.`,
+}
+
+func openDelayQueue(cmd *cobra.Command) (*service.DelayQueue, error) {
+	stateDir, _ := cmd.Root().PersistentFlags().GetString("state-dir")
+	return service.NewDelayQueue(filepath.Join(stateDir, "delayed"), nil)
+}
+
+var delayedListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List pending delayed messages",
+	Long: `List the delayed messages which are waiting to be sent (ordered by when they are due).
+
+Examples:
+
+	tedge-mapper-template delayed list
+	# List the pending delayed messages
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		queue, err := openDelayQueue(cmd)
+		if err != nil {
+			return err
+		}
+		messages, err := queue.List()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tDUE\tROUTE\tTYPE\tTARGET")
+		for _, m := range messages {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.ID, m.Due.Format(time.RFC3339), m.Route, m.Type, m.Target())
+		}
+		return w.Flush()
+	},
+}
+
+var delayedCancelCmd = &cobra.Command{
+	Use:   "cancel [ID]...",
+	Short: "Cancel pending delayed messages",
+	Long: `Cancel delayed messages so that they are not sent.
+
+Examples:
+
+	tedge-mapper-template delayed cancel 8xHc2Ka9R
+	# Cancel a single delayed message
+
+	tedge-mapper-template delayed cancel --all
+	# Cancel all pending delayed messages
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+		if !all && len(args) == 0 {
+			return fmt.Errorf("no ids were given. Use --all to cancel all delayed messages")
+		}
+
+		queue, err := openDelayQueue(cmd)
+		if err != nil {
+			return err
+		}
+
+		ids := args
+		if all {
+			messages, err := queue.List()
+			if err != nil {
+				return err
+			}
+			ids = make([]string, 0, len(messages))
+			for _, m := range messages {
+				ids = append(ids, m.ID)
+			}
+		}
+
+		errList := make([]error, 0)
+		for _, id := range ids {
+			if err := queue.Cancel(id); err != nil {
+				errList = append(errList, err)
+				continue
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), id)
+		}
+		cmd.SilenceUsage = true
+		return errors.Join(errList...)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(delayedCmd)
+	delayedCmd.AddCommand(delayedListCmd)
+	delayedCmd.AddCommand(delayedCancelCmd)
+
+	delayedCancelCmd.Flags().Bool("all", false, "Cancel all delayed messages")
+}
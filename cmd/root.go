@@ -12,6 +12,7 @@ import (
 
 	"github.com/lmittmann/tint"
 	"github.com/mattn/go-colorable"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/config"
 	"github.com/spf13/cobra"
 )
 
@@ -57,6 +58,32 @@ files which control the transformation of messages from one topic to another.
 	},
 }
 
+// Load the configuration file set by the --config flag
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
+	path, _ := cmd.Root().PersistentFlags().GetString("config")
+	return config.Load(path)
+}
+
+// MQTT settings from the config file, overridden by any mqtt flags of the command
+func mqttConfig(cmd *cobra.Command, cfg *config.Config) config.MQTT {
+	settings := cfg.MQTT
+	flags := map[string]*string{
+		"mqtt-ca-file":     &settings.CAFile,
+		"mqtt-ca-dir":      &settings.CADir,
+		"mqtt-cert-file":   &settings.CertFile,
+		"mqtt-key-file":    &settings.KeyFile,
+		"mqtt-username":    &settings.Username,
+		"mqtt-password":    &settings.Password,
+		"mqtt-server-name": &settings.ServerName,
+	}
+	for name, value := range flags {
+		if cmd.Flags().Changed(name) {
+			*value, _ = cmd.Flags().GetString(name)
+		}
+	}
+	return settings
+}
+
 func GetLogLevel(s string) slog.Level {
 	switch strings.ToLower(s) {
 	case "info", "information":
@@ -90,7 +117,10 @@ func init() {
 	rootCmd.PersistentFlags().StringSlice("dir", []string{"routes"}, "Route directory (more than 1 can be provided)")
 	rootCmd.PersistentFlags().StringSlice("libdir", []string{"lib"}, "Library directory (only used by jsonnet)")
 	rootCmd.PersistentFlags().Int("maxdepth", 10, "Maximum recursion depth")
-	rootCmd.PersistentFlags().Duration("delay", 2*time.Second, "Delay to wait after publishing a message (by the same route) (to prevent spamming)")
+	rootCmd.PersistentFlags().Duration("delay", 2*time.Second, "Minimum interval between the outputs (messages, updates and api requests) of the same route, applied as a rate_limit with the queue action. Only applies to routes without a rate_limit. Set to 0 to disable")
+	rootCmd.PersistentFlags().MarkDeprecated("delay", "use the rate_limit setting of the route instead")
+	rootCmd.PersistentFlags().String("state-dir", "/var/lib/tedge-mapper-template", "Directory used to persist state, e.g. delayed messages")
+	rootCmd.PersistentFlags().String("config", "", "Configuration file, e.g. to define named http endpoints")
 	rootCmd.PersistentFlags().Bool("dry", false, "Dry run mode. Don't send any requests")
 	rootCmd.PersistentFlags().String("device-id", "", "Default device.id to use if the tedge configuration is not provided")
 }
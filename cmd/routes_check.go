@@ -9,11 +9,12 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/mattn/go-isatty"
-	"github.com/reubenmiller/tedge-mapper-template/pkg/jsonnet"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/service"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/streamer"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
 	"github.com/spf13/cobra"
 )
 
@@ -35,6 +36,9 @@ Examples:
 	tedge-mapper-template routes check -t 'c8y/s/ds' -m ./operation.json
 	# Check handling of routes and read the message from file
 
+	tedge-mapper-template routes check --broker plant -t 'factory/line1/status' -m '{"running":true}'
+	# Check handling of routes for a message received from a named broker (from the config file)
+
 	`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		debug, _ := cmd.Root().PersistentFlags().GetBool("debug")
@@ -44,12 +48,9 @@ Examples:
 		message, _ := cmd.Flags().GetString("message")
 		compact, _ := cmd.Flags().GetBool("compact")
 		maxDepth, _ := cmd.Root().PersistentFlags().GetInt("maxdepth")
-		delay, _ := cmd.Root().PersistentFlags().GetDuration("delay")
 		deviceID, _ := cmd.Root().PersistentFlags().GetString("device-id")
 		entityFile, _ := cmd.Flags().GetString("entityfile")
-		// dryRun, _ := cmd.Root().PersistentFlags().GetBool("dry")
-		// Force dry run
-		dryRun := true
+		broker, _ := cmd.Flags().GetString("broker")
 
 		useColor := true
 		if !isatty.IsTerminal(os.Stdout.Fd()) && !isatty.IsCygwinTerminal(os.Stdout.Fd()) {
@@ -71,19 +72,26 @@ Examples:
 			message = string(b)
 		}
 
+		cfg, err := loadConfig(cmd)
+		if err != nil {
+			return err
+		}
+
 		serviceOptions := &service.DefaultServiceOptions{
 			Broker:                     ArgBroker,
 			ClientID:                   ArgClientID,
 			CleanSession:               ArgCleanSession,
 			RouteDirs:                  routeDirs,
 			MaxRouteDepth:              maxDepth,
-			PostMessageDelay:           delay,
 			Debug:                      debug,
 			DryRun:                     true,
 			LibraryPaths:               libPaths,
 			UseColor:                   useColor,
 			EntityFile:                 entityFile,
 			EnableRegistrationListener: false,
+			Endpoints:                  cfg.Endpoints,
+			Brokers:                    cfg.Brokers,
+			MQTT:                       service.MQTTOptions{MQTT: cfg.MQTT},
 			MetaOptions: []service.MetaOption{
 				service.WithMetaDefaultDeviceID(deviceID),
 			},
@@ -94,26 +102,22 @@ Examples:
 			return err
 		}
 
-		// TODO: Provide the meta data as part of the service
-		// and access via app.GetMeta()
-		meta := service.NewMetaData(
-			service.WithMetaDefaultDeviceID(deviceID),
-		)
-
 		slog.Debug("Total routes.", "count", len(app.Routes))
 
 		queue := list.New()
-		addMessage := func(topic string, message string) {
+		addMessage := func(broker string, topic string, message string, props *template.Properties) {
 			queue.PushBack(
 				streamer.OutputMessage{
-					Topic:   topic,
-					Message: message,
+					Broker:     broker,
+					Topic:      topic,
+					Message:    message,
+					Properties: props,
 				},
 			)
 		}
 
 		// Seed first message
-		addMessage(topic, message)
+		addMessage(broker, topic, message, nil)
 
 		iteration := 0
 
@@ -130,46 +134,40 @@ Examples:
 
 			slog.Info("Checking for matching routes.", "iteration", iteration)
 			foundRoute := false
-			for _, route := range app.Routes {
-				if !route.Skip {
-					if !route.Match(msg.Topic) {
-						slog.Debug("Route did not match topic.", "route", route.Name, "root_topic", route.DisplayTopics(), "topic", topic)
-						continue
-					}
-
-					foundRoute = true
-					// cmd.Printf("Route:\t%s\n", route.Name)
-					handler := service.NewStreamFactory(nil, nil, route, app.GetVariables, maxDepth, 0,
-						jsonnet.WithMetaData(meta),
-						jsonnet.WithDebug(debug),
-						jsonnet.WithDryRun(dryRun),
-						jsonnet.WithLibraryPaths(libPaths...),
-						jsonnet.WithColorStackTrace(useColor),
-					)
-
-					if msg.MessageString() == "" {
-						slog.Info("Ignoring empty message", "topic", msg.Topic)
-						continue
-					}
-
-					output, err := handler(msg.Topic, msg.MessageString())
-					if err != nil {
-						slog.Error("handler returned an error.", "err", err)
-
-						// Return errors immediately (but don't trigger the command's help text)
-						cmd.SilenceUsage = true
-						return err
-					}
-
-					stop := service.DisplayMessage(fmt.Sprintf("%s (%s)", route.Name, route.DisplayTopics()), &msg, output, cmd.OutOrStdout(), compact, useColor)
-					if stop {
-						continue
-					}
-
-					// Queue new message
-					slog.Info("Queuing new message")
-					addMessage(output.Topic, output.MessageString())
+			// Use the same route selection (and order) as the serve command
+			for _, rh := range app.MatchingBrokerRoutes(msg.Broker, msg.Topic) {
+				route := rh.Route
+				foundRoute = true
+
+				if msg.MessageString() == "" {
+					slog.Info("Ignoring empty message", "topic", msg.Topic)
+					continue
 				}
+
+				output, err := rh.Handler(msg.Topic, msg.MessageString(), template.Metadata{
+					Properties: msg.Properties,
+					Envelope: &template.Envelope{
+						QoS:          msg.GetQoS(),
+						ReceivedTime: time.Now(),
+						Broker:       msg.Broker,
+					},
+				})
+				if err != nil {
+					slog.Error("handler returned an error.", "err", err)
+
+					// Return errors immediately (but don't trigger the command's help text)
+					cmd.SilenceUsage = true
+					return err
+				}
+
+				stop := service.DisplayMessage(fmt.Sprintf("%s (%s)", route.Name, route.DisplayTopics()), &msg, output, cmd.OutOrStdout(), compact, useColor)
+				if stop {
+					continue
+				}
+
+				// Queue new message
+				slog.Info("Queuing new message")
+				addMessage(output.Broker, output.Topic, output.MessageString(), output.Properties)
 			}
 			if !foundRoute {
 				slog.Info("No matching routes found")
@@ -190,4 +188,5 @@ func init() {
 	executeCmd.Flags().StringP("file", "f", "", "Template file")
 	executeCmd.Flags().Bool("compact", false, "Print output message in compact format (not pretty printed)")
 	executeCmd.Flags().String("entityfile", "", "Load initial entity definitions from a json file")
+	executeCmd.Flags().String("broker", "", "Name of the broker (from the config file) the message is received from. Defaults to the main broker")
 }
@@ -4,12 +4,18 @@ Copyright © 2023 thin-edge thinedge@thin-edge.io
 package cmd
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/mattn/go-isatty"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/pipeline"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/ratelimit"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/service"
 	"github.com/spf13/cobra"
 )
@@ -36,6 +42,10 @@ Examples:
 
 	tedge-mapper-template serve --host 'otherhost:1883'
 	# Start the mapper using a custom MQTT broker endpoint
+
+	tedge-mapper-template serve --watch=false
+	# Start the mapper without watching the route directories for changes.
+	# Routes can still be reloaded by sending a SIGHUP signal to the process
 	`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		slog.Info("Starting listener")
@@ -45,8 +55,58 @@ Examples:
 		maxDepth, _ := cmd.Root().PersistentFlags().GetInt("maxdepth")
 		delay, _ := cmd.Root().PersistentFlags().GetDuration("delay")
 		dryRun, _ := cmd.Root().PersistentFlags().GetBool("dry")
+		stateDir, _ := cmd.Root().PersistentFlags().GetString("state-dir")
 		deviceID, _ := cmd.Root().PersistentFlags().GetString("device-id")
 		entityFile, _ := cmd.Flags().GetString("entityfile")
+		watch, _ := cmd.Flags().GetBool("watch")
+		workers, _ := cmd.Flags().GetInt("workers")
+		queueSize, _ := cmd.Flags().GetInt("queue-size")
+		queuePolicyValue, _ := cmd.Flags().GetString("queue-policy")
+		orderingKey, _ := cmd.Flags().GetString("ordering-key")
+		vmPoolSize, _ := cmd.Flags().GetInt("vm-pool-size")
+		deadLetterTopic, _ := cmd.Flags().GetString("dead-letter-topic")
+		outboxSize, _ := cmd.Flags().GetInt("outbox-size")
+		outboxMaxAge, _ := cmd.Flags().GetDuration("outbox-max-age")
+		bridgeHealthTopic, _ := cmd.Flags().GetString("bridge-health-topic")
+		publishErrors, _ := cmd.Flags().GetBool("publish-errors")
+		errorTopic, _ := cmd.Flags().GetString("error-topic")
+		errorRate, _ := cmd.Flags().GetFloat64("error-rate")
+		metricsAddr, _ := cmd.Flags().GetString("metrics-addr")
+		statsInterval, _ := cmd.Flags().GetDuration("stats-interval")
+		healthInterval, _ := cmd.Flags().GetDuration("health-interval")
+		gracePeriod, _ := cmd.Flags().GetDuration("shutdown-grace-period")
+		maxReconnectInterval, _ := cmd.Flags().GetDuration("reconnect-max-interval")
+		keepAlive, _ := cmd.Flags().GetDuration("keepalive")
+		mqttVersion, _ := cmd.Flags().GetInt("mqtt-version")
+
+		queuePolicy, err := pipeline.ParsePolicy(queuePolicyValue)
+		if err != nil {
+			return err
+		}
+
+		cfg, err := loadConfig(cmd)
+		if err != nil {
+			return err
+		}
+
+		if !publishErrors {
+			errorTopic = ""
+		} else if errorTopic == "" {
+			errorTopic = service.DefaultRouteErrorTopic(ArgClientID)
+		}
+
+		// Deprecated: --delay is converted to a rate limit for routes without their own rate limit
+		var defaultRateLimit *routes.RateLimit
+		if delay > 0 {
+			defaultRateLimit = &routes.RateLimit{
+				Rate:   1 / delay.Seconds(),
+				Burst:  1,
+				Action: string(ratelimit.ActionQueue),
+			}
+		}
+
+		// Metrics are also used to publish the route statistics
+		appMetrics := metrics.New()
 
 		useColor := true
 		if !isatty.IsTerminal(os.Stdout.Fd()) && !isatty.IsCygwinTerminal(os.Stdout.Fd()) {
@@ -61,13 +121,34 @@ Examples:
 				HTTPEndpoint:               ArgHTTPEndpoint,
 				RouteDirs:                  routeDirs,
 				MaxRouteDepth:              maxDepth,
-				PostMessageDelay:           delay,
+				DefaultRateLimit:           defaultRateLimit,
+				StateDir:                   stateDir,
+				DeadLetterTopic:            deadLetterTopic,
+				Endpoints:                  cfg.Endpoints,
+				Brokers:                    cfg.Brokers,
+				OutboxSize:                 outboxSize,
+				OutboxMaxAge:               outboxMaxAge,
+				BridgeHealthTopic:          bridgeHealthTopic,
+				ErrorTopic:                 errorTopic,
+				ErrorRate:                  errorRate,
+				Metrics:                    appMetrics,
 				Debug:                      debug,
 				DryRun:                     dryRun,
 				LibraryPaths:               libPaths,
 				UseColor:                   useColor,
 				EntityFile:                 entityFile,
 				EnableRegistrationListener: true,
+				MQTT: service.MQTTOptions{
+					ProtocolVersion:      mqttVersion,
+					MaxReconnectInterval: maxReconnectInterval,
+					KeepAlive:            keepAlive,
+					MQTT:                 mqttConfig(cmd, cfg),
+				},
+				Workers:     workers,
+				QueueSize:   queueSize,
+				QueuePolicy: queuePolicy,
+				OrderingKey: orderingKey,
+				VMPoolSize:  vmPoolSize,
 				MetaOptions: []service.MetaOption{
 					service.WithMetaDefaultDeviceID(deviceID),
 				},
@@ -81,13 +162,52 @@ Examples:
 			return err
 		}
 
-		// Wait for termination signal
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go app.ReportStats(ctx, statsInterval)
+		go app.ReportHealth(ctx, healthInterval)
+
+		if metricsAddr != "" {
+			go func() {
+				if err := appMetrics.ListenAndServe(ctx, metricsAddr); err != nil {
+					slog.Warn("Could not serve metrics.", "address", metricsAddr, "error", err)
+				}
+			}()
+		}
+
+		if watch {
+			go func() {
+				if err := app.WatchRoutes(ctx, routeDirs, 500*time.Millisecond); err != nil {
+					slog.Warn("Could not watch route directories.", "error", err)
+				}
+			}()
+		}
+
+		// Wait for termination signal, and reload routes on SIGHUP
 		stop := make(chan os.Signal, 1)
 		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-		<-stop
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
 
-		slog.Info("Shutting down...")
-		return nil
+		for {
+			select {
+			case <-reload:
+				slog.Info("Received SIGHUP. Reloading routes.")
+				if err := app.ReloadRoutes(routeDirs); err != nil {
+					slog.Warn("Failed to reload routes.", "error", err)
+				}
+			case <-stop:
+				slog.Info("Shutting down...", "grace_period", gracePeriod)
+				cancel()
+				shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), gracePeriod)
+				defer cancelShutdown()
+				if err := app.Shutdown(shutdownCtx); err != nil {
+					slog.Warn("Service did not stop cleanly.", "error", err)
+				}
+				return nil
+			}
+		}
 	},
 }
 
@@ -97,5 +217,32 @@ func init() {
 	serveCmd.Flags().BoolVar(&ArgCleanSession, "clean", true, "Clean session")
 	serveCmd.Flags().StringVarP(&ArgClientID, "clientid", "i", "tedge-mapper-template", "MQTT client id")
 	serveCmd.Flags().StringVar(&ArgHTTPEndpoint, "api-host", "http://127.0.0.1:8001/c8y", "HTTP endpoint that api requests should be sent to")
+	serveCmd.Flags().Int("mqtt-version", service.MQTTVersion3, "MQTT protocol version used to receive and publish messages: 3 or 5. Version 5 is required to use message properties")
+	serveCmd.Flags().Duration("reconnect-max-interval", service.DefaultMaxReconnectInterval, "Maximum time between attempts to reconnect to the broker")
+	serveCmd.Flags().Duration("keepalive", service.DefaultKeepAlive, "Keep alive interval of the MQTT connection")
+	serveCmd.Flags().String("mqtt-ca-file", "", "CA certificate used to verify the broker's certificate (see tedge mqtt.client.auth.ca_file). Enables TLS")
+	serveCmd.Flags().String("mqtt-ca-dir", "", "Directory of CA certificates used to verify the broker's certificate (see tedge mqtt.client.auth.ca_dir). Enables TLS")
+	serveCmd.Flags().String("mqtt-cert-file", "", "Client certificate used to connect to the broker (see tedge mqtt.client.auth.cert_file). Enables TLS")
+	serveCmd.Flags().String("mqtt-key-file", "", "Private key of the client certificate (see tedge mqtt.client.auth.key_file)")
+	serveCmd.Flags().String("mqtt-username", "", "Username used to connect to the broker")
+	serveCmd.Flags().String("mqtt-password", "", "Password used to connect to the broker. Prefer the config file, which can reference environment variables")
+	serveCmd.Flags().String("mqtt-server-name", "", "Server name used to verify the broker's certificate, if it differs from the broker host. Enables TLS")
 	serveCmd.Flags().String("entityfile", "", "Load initial entity definitions from a json file")
+	serveCmd.Flags().Bool("watch", true, "Watch the route directories and reload routes when they change")
+	serveCmd.Flags().Int("workers", 4, "Number of workers used to process messages concurrently")
+	serveCmd.Flags().Int("queue-size", 1000, "Maximum number of messages waiting to be processed")
+	serveCmd.Flags().String("queue-policy", string(pipeline.PolicyBlock), "Behavior when the queue is full: block, drop-oldest, reject")
+	serveCmd.Flags().String("ordering-key", "topic", "Messages with the same key are processed in order: topic, device")
+	serveCmd.Flags().String("dead-letter-topic", "tedge-mapper-template/deadletter", "Topic used to publish api requests which have failed permanently (unless set by the route)")
+	serveCmd.Flags().Int("outbox-size", 10000, "Maximum number of api requests which are buffered whilst the cloud is unreachable. Set to 0 to disable buffering")
+	serveCmd.Flags().Duration("outbox-max-age", 24*time.Hour, "Maximum age of buffered api requests. Older requests are dropped")
+	serveCmd.Flags().String("bridge-health-topic", service.DefaultBridgeHealthTopic, "Topic used to detect if the cloud bridge is up or down")
+	serveCmd.Flags().Bool("publish-errors", true, "Publish route processing errors to the error topic")
+	serveCmd.Flags().String("error-topic", "", "Topic used to publish route processing errors. Defaults to te/device/main/service/<clientid>/e/route_error")
+	serveCmd.Flags().Float64("error-rate", service.DefaultRouteErrorRate, "Maximum number of route errors published per second")
+	serveCmd.Flags().String("metrics-addr", "", "Address used to serve prometheus metrics on /metrics, e.g. 127.0.0.1:9464. Metrics are not served if empty")
+	serveCmd.Flags().Duration("stats-interval", service.DefaultStatsInterval, "Interval used to publish the route statistics to the service's twin topic. Set to 0 to disable")
+	serveCmd.Flags().Duration("health-interval", service.DefaultHealthInterval, "Interval used to publish the health status of the service. Set to 0 to disable")
+	serveCmd.Flags().Duration("shutdown-grace-period", service.DefaultShutdownGracePeriod, "Maximum time to wait for in-flight messages to be processed when shutting down")
+	serveCmd.Flags().Int("vm-pool-size", 0, "Number of jsonnet vms per route which can process messages concurrently. Defaults to the number of workers")
 }
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+	AuthHMAC   = "hmac"
+)
+
+// Default header used to send the hmac signature of the request body
+const DefaultSignatureHeader = "X-Signature"
+
+// Config is the service configuration which is not provided by the command line flags
+type Config struct {
+	// Named http endpoints which routes can send api requests to
+	Endpoints map[string]Endpoint `yaml:"endpoints"`
+	// Connection settings of the mqtt clients
+	MQTT MQTT `yaml:"mqtt"`
+	// Named broker connections which routes can receive messages from and publish messages to
+	Brokers map[string]Broker `yaml:"brokers"`
+}
+
+// MQTT are the TLS and authentication settings used to connect to the broker. The file
+// settings match thin-edge.io's mqtt.client.auth.* settings. Values can reference
+// environment variables, e.g. ${MQTT_PASSWORD}
+type MQTT struct {
+	// CA certificate (PEM) used to verify the broker's certificate
+	CAFile string `yaml:"ca_file,omitempty"`
+	// Directory of CA certificates (PEM) used to verify the broker's certificate
+	CADir string `yaml:"ca_dir,omitempty"`
+	// Client certificate and private key (PEM)
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// Name used to verify the broker's certificate, if it differs from the broker host
+	ServerName string `yaml:"server_name,omitempty"`
+}
+
+// Broker is an additional mqtt broker connection, e.g. a plant floor broker
+type Broker struct {
+	// Broker address, e.g. plant.local:1883 or ssl://plant.local:8883
+	Host string `yaml:"host"`
+	// Client id. Defaults to the service's client id with the broker name as suffix
+	ClientID string `yaml:"client_id,omitempty"`
+	// MQTT protocol version (3 or 5). Defaults to the version of the main connection
+	Version int `yaml:"version,omitempty"`
+	// TLS and authentication settings
+	MQTT `yaml:",inline"`
+}
+
+// Endpoint is a http service which api requests can be sent to
+type Endpoint struct {
+	// Base url, e.g. http://127.0.0.1:8080/api
+	URL  string `yaml:"url"`
+	Auth *Auth  `yaml:"auth,omitempty"`
+	// CA certificate (PEM) used to verify the server's certificate
+	CAFile             string `yaml:"ca_file,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+	// Timeout of each request (including reading the response)
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Headers which are added to every request
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// Auth is the authentication used by an endpoint. Values can reference
+// environment variables, e.g. ${WEBHOOK_TOKEN}
+type Auth struct {
+	// Authentication type: basic, bearer or hmac
+	Type     string `yaml:"type"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Token    string `yaml:"token,omitempty"`
+	// Secret used to sign the request body (hmac)
+	Secret string `yaml:"secret,omitempty"`
+	// Header used to send the signature (hmac)
+	Header string `yaml:"header,omitempty"`
+}
+
+// Load the configuration from a yaml file. An empty configuration is returned if the path is empty
+func Load(path string) (*Config, error) {
+	config := &Config{}
+	if path == "" {
+		return config, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file. %w", err)
+	}
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("invalid config file. file=%s, %w", path, err)
+	}
+	config.expandEnv()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file. file=%s, %w", path, err)
+	}
+	return config, nil
+}
+
+func (c *Config) expandEnv() {
+	c.MQTT.Username = os.ExpandEnv(c.MQTT.Username)
+	c.MQTT.Password = os.ExpandEnv(c.MQTT.Password)
+	for name, endpoint := range c.Endpoints {
+		endpoint.URL = os.ExpandEnv(endpoint.URL)
+		if endpoint.Auth != nil {
+			auth := *endpoint.Auth
+			auth.Username = os.ExpandEnv(auth.Username)
+			auth.Password = os.ExpandEnv(auth.Password)
+			auth.Token = os.ExpandEnv(auth.Token)
+			auth.Secret = os.ExpandEnv(auth.Secret)
+			endpoint.Auth = &auth
+		}
+		for key, value := range endpoint.Headers {
+			endpoint.Headers[key] = os.ExpandEnv(value)
+		}
+		c.Endpoints[name] = endpoint
+	}
+	for name, broker := range c.Brokers {
+		broker.Host = os.ExpandEnv(broker.Host)
+		broker.Username = os.ExpandEnv(broker.Username)
+		broker.Password = os.ExpandEnv(broker.Password)
+		c.Brokers[name] = broker
+	}
+}
+
+// EndpointNames returns the names of the endpoints (sorted)
+func (c *Config) EndpointNames() []string {
+	names := make([]string, 0, len(c.Endpoints))
+	for name := range c.Endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BrokerNames returns the names of the brokers (sorted)
+func (c *Config) BrokerNames() []string {
+	names := make([]string, 0, len(c.Brokers))
+	for name := range c.Brokers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Config) Validate() error {
+	if err := c.MQTT.Validate(); err != nil {
+		return fmt.Errorf("mqtt. %w", err)
+	}
+	for _, name := range c.EndpointNames() {
+		if err := c.Endpoints[name].Validate(); err != nil {
+			return fmt.Errorf("endpoint=%s. %w", name, err)
+		}
+	}
+	for _, name := range c.BrokerNames() {
+		if name == "" {
+			return fmt.Errorf("broker name can not be empty")
+		}
+		if err := c.Brokers[name].Validate(); err != nil {
+			return fmt.Errorf("broker=%s. %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (m MQTT) Validate() error {
+	if (m.CertFile == "") != (m.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+func (b Broker) Validate() error {
+	if b.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if b.Version != 0 && b.Version != 3 && b.Version != 5 {
+		return fmt.Errorf("unsupported version. expected 3 or 5. got=%d", b.Version)
+	}
+	return b.MQTT.Validate()
+}
+
+// TLS returns true if any of the TLS settings are set
+func (m MQTT) TLS() bool {
+	return m.CAFile != "" || m.CADir != "" || m.CertFile != "" || m.ServerName != ""
+}
+
+func (e Endpoint) Validate() error {
+	if e.URL == "" {
+		return fmt.Errorf("url is empty")
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url. %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url must start with http:// or https://. got=%s", e.URL)
+	}
+	if e.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative. got=%s", e.Timeout)
+	}
+	if e.Auth != nil {
+		return e.Auth.Validate()
+	}
+	return nil
+}
+
+func (a Auth) Validate() error {
+	switch a.Type {
+	case AuthBasic:
+		if a.Username == "" {
+			return fmt.Errorf("basic auth requires a username")
+		}
+	case AuthBearer:
+		if a.Token == "" {
+			return fmt.Errorf("bearer auth requires a token")
+		}
+	case AuthHMAC:
+		if a.Secret == "" {
+			return fmt.Errorf("hmac auth requires a secret")
+		}
+	default:
+		return fmt.Errorf("invalid auth type. expected one of [%s %s %s]. got=%s", AuthBasic, AuthBearer, AuthHMAC, a.Type)
+	}
+	return nil
+}
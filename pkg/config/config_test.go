@@ -0,0 +1,142 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadEndpoints(t *testing.T) {
+	t.Setenv("WEBHOOK_TOKEN", "secret-token")
+	path := writeConfig(t, heredoc.Doc(`
+		endpoints:
+		  local:
+		    url: http://127.0.0.1:8080/api
+		    timeout: 5s
+		    auth:
+		      type: basic
+		      username: admin
+		      password: pass
+		  webhook:
+		    url: https://example.com/hooks
+		    ca_file: /etc/ssl/certs/ca.pem
+		    headers:
+		      X-Source: tedge
+		    auth:
+		      type: bearer
+		      token: ${WEBHOOK_TOKEN}
+	`))
+
+	config, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"local", "webhook"}, config.EndpointNames())
+	assert.Equal(t, Endpoint{
+		URL:     "http://127.0.0.1:8080/api",
+		Timeout: 5 * time.Second,
+		Auth:    &Auth{Type: AuthBasic, Username: "admin", Password: "pass"},
+	}, config.Endpoints["local"])
+	assert.Equal(t, "secret-token", config.Endpoints["webhook"].Auth.Token)
+	assert.Equal(t, "/etc/ssl/certs/ca.pem", config.Endpoints["webhook"].CAFile)
+	assert.Equal(t, map[string]string{"X-Source": "tedge"}, config.Endpoints["webhook"].Headers)
+}
+
+func TestLoadWithoutPath(t *testing.T) {
+	config, err := Load("")
+	assert.NoError(t, err)
+	assert.Empty(t, config.Endpoints)
+}
+
+func TestInvalidEndpoints(t *testing.T) {
+	testcases := map[string]Endpoint{
+		"missing url":       {},
+		"invalid scheme":    {URL: "ftp://example.com"},
+		"negative timeout":  {URL: "http://example.com", Timeout: -time.Second},
+		"unknown auth type": {URL: "http://example.com", Auth: &Auth{Type: "digest"}},
+		"missing username":  {URL: "http://example.com", Auth: &Auth{Type: AuthBasic}},
+		"missing token":     {URL: "http://example.com", Auth: &Auth{Type: AuthBearer}},
+		"missing secret":    {URL: "http://example.com", Auth: &Auth{Type: AuthHMAC}},
+	}
+	for name, endpoint := range testcases {
+		endpoint := endpoint
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, endpoint.Validate())
+		})
+	}
+}
+
+func TestLoadMQTT(t *testing.T) {
+	t.Setenv("MQTT_PASSWORD", "secret")
+	path := writeConfig(t, heredoc.Doc(`
+		mqtt:
+		  ca_file: /etc/tedge/device-certs/ca.crt
+		  cert_file: /etc/tedge/device-certs/client.crt
+		  key_file: /etc/tedge/device-certs/client.key
+		  username: mapper
+		  password: ${MQTT_PASSWORD}
+		  server_name: broker.local
+	`))
+
+	config, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, MQTT{
+		CAFile:     "/etc/tedge/device-certs/ca.crt",
+		CertFile:   "/etc/tedge/device-certs/client.crt",
+		KeyFile:    "/etc/tedge/device-certs/client.key",
+		Username:   "mapper",
+		Password:   "secret",
+		ServerName: "broker.local",
+	}, config.MQTT)
+	assert.True(t, config.MQTT.TLS())
+	assert.False(t, MQTT{Username: "mapper"}.TLS())
+
+	_, err = Load(writeConfig(t, "mqtt:\n  cert_file: client.crt\n"))
+	assert.ErrorContains(t, err, "cert_file and key_file must be set together")
+}
+
+func TestLoadBrokers(t *testing.T) {
+	t.Setenv("PLANT_PASSWORD", "secret")
+	path := writeConfig(t, heredoc.Doc(`
+		brokers:
+		  plant:
+		    host: ssl://plant.local:8883
+		    version: 5
+		    ca_file: /etc/ssl/certs/plant-ca.pem
+		    username: mapper
+		    password: ${PLANT_PASSWORD}
+		  test:
+		    host: 127.0.0.1:1884
+		    client_id: mapper-test
+	`))
+
+	config, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"plant", "test"}, config.BrokerNames())
+	assert.Equal(t, Broker{
+		Host:    "ssl://plant.local:8883",
+		Version: 5,
+		MQTT: MQTT{
+			CAFile:   "/etc/ssl/certs/plant-ca.pem",
+			Username: "mapper",
+			Password: "secret",
+		},
+	}, config.Brokers["plant"])
+	assert.Equal(t, Broker{Host: "127.0.0.1:1884", ClientID: "mapper-test"}, config.Brokers["test"])
+
+	_, err = Load(writeConfig(t, "brokers:\n  plant:\n    version: 5\n"))
+	assert.ErrorContains(t, err, "broker=plant. host is required")
+
+	_, err = Load(writeConfig(t, "brokers:\n  plant:\n    host: plant.local\n    version: 4\n"))
+	assert.ErrorContains(t, err, "unsupported version")
+}
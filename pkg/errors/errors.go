@@ -5,3 +5,5 @@ import "fmt"
 var ErrRecursiveLevelExceeded = fmt.Errorf("recursive message level exceeded")
 
 var ErrTemplateException = fmt.Errorf("template error")
+
+var ErrInvalidOutput = fmt.Errorf("invalid output message")
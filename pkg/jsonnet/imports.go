@@ -0,0 +1,52 @@
+package jsonnet
+
+import (
+	_jsonnet "github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+	"github.com/google/go-jsonnet/toolutils"
+)
+
+// Imports returns the contents of the files imported by the template, including the files
+// imported by those files, by the path they were found at. Relative imports are resolved
+// from the directory of the given filename, followed by the library paths.
+// Imports which can not be resolved are ignored, as they are reported when the template is evaluated
+func Imports(filename string, tmpl string, libraryPaths ...string) (map[string]string, error) {
+	if filename == "" {
+		filename = "file"
+	}
+	node, err := _jsonnet.SnippetToAST(filename, removeHeader(tmpl))
+	if err != nil {
+		return nil, err
+	}
+
+	vm := NewJsonnetVM(false, libraryPaths...)
+	imports := map[string]string{}
+	var walk func(importedFrom string, node ast.Node)
+	walk = func(importedFrom string, node ast.Node) {
+		var file *ast.LiteralString
+		switch n := node.(type) {
+		case *ast.Import:
+			file = n.File
+		case *ast.ImportStr:
+			file = n.File
+		case *ast.ImportBin:
+			file = n.File
+		}
+		if file != nil {
+			contents, foundAt, err := vm.ImportData(importedFrom, file.Value)
+			if _, seen := imports[foundAt]; err == nil && !seen {
+				imports[foundAt] = contents
+				if _, ok := node.(*ast.Import); ok {
+					if imported, _, err := vm.ImportAST(importedFrom, file.Value); err == nil {
+						walk(foundAt, imported)
+					}
+				}
+			}
+		}
+		for _, child := range toolutils.Children(node) {
+			walk(importedFrom, child)
+		}
+	}
+	walk(filename, node)
+	return imports, nil
+}
@@ -2,15 +2,18 @@ package jsonnet
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
 	_jsonnet "github.com/google/go-jsonnet"
 	"github.com/google/go-jsonnet/ast"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
 	"github.com/teris-io/shortid"
 	"github.com/tidwall/gjson"
 )
@@ -18,9 +21,16 @@ import (
 var HeaderMarker = "\n###\n"
 
 type JsonnetEngine struct {
-	vm       *_jsonnet.VM
+	// A vm can not be used concurrently, so a pool of identically configured vms is used
+	vms      chan *_jsonnet.VM
 	template string
 	Options  EngineOptions
+
+	mu      sync.Mutex
+	program ast.Node
+	// Parsed variables are cached as they rarely change between messages
+	variables     string
+	variablesNode ast.Node
 }
 
 type EngineOptions struct {
@@ -29,6 +39,10 @@ type EngineOptions struct {
 	UseColor     bool
 	LibraryPaths []string
 	Meta         any
+	Filename     string
+	VMPoolSize   int
+	// The routing context is carried by the message properties instead of the payload
+	PropertiesContext bool
 }
 
 type TemplateOption func(*EngineOptions) *EngineOptions
@@ -68,6 +82,30 @@ func WithLibraryPaths(paths ...string) TemplateOption {
 	}
 }
 
+// Set the filename of the template. Relative imports are resolved from the template's directory
+func WithFilename(v string) TemplateOption {
+	return func(opt *EngineOptions) *EngineOptions {
+		opt.Filename = v
+		return opt
+	}
+}
+
+// Set the number of vms which can evaluate the template concurrently
+func WithVMPoolSize(v int) TemplateOption {
+	return func(opt *EngineOptions) *EngineOptions {
+		opt.VMPoolSize = v
+		return opt
+	}
+}
+
+// Carry the routing context in the message properties, so the context is not added to the payload
+func WithPropertiesContext(v bool) TemplateOption {
+	return func(opt *EngineOptions) *EngineOptions {
+		opt.PropertiesContext = v
+		return opt
+	}
+}
+
 type vmConfig struct {
 	evalJpath []string
 }
@@ -88,7 +126,7 @@ func NewJsonnetVM(useColor bool, paths ...string) *_jsonnet.VM {
 
 	vmConfig := makeVMConfig()
 	for i := len(paths) - 1; i >= 0; i-- {
-		slog.Info("Adding jsonnet path.", "path", paths[i])
+		slog.Debug("Adding jsonnet path.", "path", paths[i])
 		vmConfig.evalJpath = append(vmConfig.evalJpath, paths[i])
 	}
 
@@ -106,8 +144,6 @@ func NewEngine(tmpl string, opts ...TemplateOption) *JsonnetEngine {
 		opt(config)
 	}
 
-	engine.vm = NewJsonnetVM(config.UseColor, config.LibraryPaths...)
-
 	sb := strings.Builder{}
 	metaD, err := json.Marshal(config.Meta)
 	if err == nil {
@@ -124,10 +160,16 @@ func NewEngine(tmpl string, opts ...TemplateOption) *JsonnetEngine {
 	sb.WriteString("local _ = {Now: function() std.native('Now')(), Get: function(o, key, defaultValue=null) std.native('Get')(o, key, defaultValue), ReplacePattern: function(s, from, to='') std.native('ReplacePattern')(s, from, to),ID: function() std.native('ID')(),};\n")
 
 	sb.WriteString(removeHeader(tmpl))
-	engine.template = sb.String()
+	engine.template = wrapTemplate(sb.String(), !config.PropertiesContext)
 	engine.Options = *config
 
-	engine.addFunctions()
+	poolSize := max(config.VMPoolSize, 1)
+	engine.vms = make(chan *_jsonnet.VM, poolSize)
+	for i := 0; i < poolSize; i++ {
+		vm := NewJsonnetVM(config.UseColor, config.LibraryPaths...)
+		addFunctions(vm)
+		engine.vms <- vm
+	}
 	return engine
 
 }
@@ -154,22 +196,29 @@ func (e *JsonnetEngine) DryRun() bool {
 	return e.Options.DryRun
 }
 
-func (e *JsonnetEngine) addFunctions() {
-	e.vm.NativeFunction(&_jsonnet.NativeFunction{
+func (e *JsonnetEngine) filename() string {
+	if e.Options.Filename != "" {
+		return e.Options.Filename
+	}
+	return "file"
+}
+
+func addFunctions(vm *_jsonnet.VM) {
+	vm.NativeFunction(&_jsonnet.NativeFunction{
 		Name: "Now",
 		Func: func(parameters []interface{}) (interface{}, error) {
 			return time.Now().Format(time.RFC3339Nano), nil
 		},
 	})
 
-	e.vm.NativeFunction(&_jsonnet.NativeFunction{
+	vm.NativeFunction(&_jsonnet.NativeFunction{
 		Name: "NowNano",
 		Func: func(parameters []interface{}) (interface{}, error) {
 			return time.Now().Format(time.RFC3339Nano), nil
 		},
 	})
 
-	e.vm.NativeFunction(&_jsonnet.NativeFunction{
+	vm.NativeFunction(&_jsonnet.NativeFunction{
 		Name:   "ReplacePattern",
 		Params: ast.Identifiers{"value", "from", "to"},
 		Func: func(parameters []interface{}) (interface{}, error) {
@@ -184,7 +233,7 @@ func (e *JsonnetEngine) addFunctions() {
 			return pattern.ReplaceAllString(value, to), nil
 		},
 	})
-	e.vm.NativeFunction(&_jsonnet.NativeFunction{
+	vm.NativeFunction(&_jsonnet.NativeFunction{
 		Name: "ID",
 		Func: func(parameters []interface{}) (interface{}, error) {
 			v, err := shortid.Generate()
@@ -195,7 +244,7 @@ func (e *JsonnetEngine) addFunctions() {
 		},
 	})
 
-	e.vm.NativeFunction(&_jsonnet.NativeFunction{
+	vm.NativeFunction(&_jsonnet.NativeFunction{
 		Name:   "Get",
 		Params: ast.Identifiers{"obj", "prop", "default"},
 		Func: func(parameters []interface{}) (interface{}, error) {
@@ -225,37 +274,133 @@ func removeHeader(tmpl string) string {
 	return tmpl
 }
 
-func (e *JsonnetEngine) Execute(topic, input string, variables string) (string, error) {
-	e.vm.ExtVar("message", "do something")
-	sb := strings.Builder{}
-	sb.WriteString(fmt.Sprintf("local topic = '%s';\n", topic))
+// Compile parses and checks the template. The compiled template is shared by
+// all of the vms so that the template is only parsed once
+func (e *JsonnetEngine) Compile() error {
+	_, err := e.compiled()
+	return err
+}
 
-	inputIsObject := json.Valid([]byte(input))
+func (e *JsonnetEngine) compiled() (ast.Node, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.program != nil {
+		return e.program, nil
+	}
+	node, err := _jsonnet.SnippetToAST(e.filename(), e.template)
+	if err != nil {
+		return nil, e.formatError(err)
+	}
+	e.program = node
+	return node, nil
+}
 
-	if inputIsObject {
-		sb.WriteString(fmt.Sprintf("local _input = %s;\n", input))
-	} else {
-		sb.WriteString(fmt.Sprintf("local _input = '%s';\n", input))
+func (e *JsonnetEngine) formatError(err error) error {
+	vm := <-e.vms
+	defer func() { e.vms <- vm }()
+	return errors.New(vm.ErrorFormatter.Format(err))
+}
+
+// Parse the variables, reusing the previous result if the variables have not changed
+func (e *JsonnetEngine) variablesAST(variables string) ast.Node {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.variablesNode != nil && variables == e.variables {
+		return e.variablesNode
+	}
+	node, err := _jsonnet.SnippetToAST("variables", variables)
+	if err != nil || !json.Valid([]byte(variables)) {
+		slog.Warn("Ignoring invalid variables. Variables must be valid json.")
+		node, _ = _jsonnet.SnippetToAST("variables", "{}")
+	}
+	e.variables = variables
+	e.variablesNode = node
+	return node
+}
+
+// Execute the template. The topic, message, variables and message properties are passed to the template as
+// top-level arguments rather than being interpolated into the template source, so
+// any payload (e.g. CSV or free text containing quotes or newlines) can be used safely.
+// Execute is safe for concurrent use. If all of the vms are in use, then it blocks until
+// one becomes available.
+func (e *JsonnetEngine) Execute(topic, input string, variables string, metadata template.Metadata) (string, error) {
+	program, err := e.compiled()
+	if err != nil {
+		return "", err
 	}
 
-	slog.Info("json template.", "variables", variables)
+	slog.Debug("json template.", "variables", variables)
 	if variables == "" {
 		variables = "{}"
 	}
-	sb.WriteString(fmt.Sprintf("local variables = %s;\n", variables))
+	variablesNode := e.variablesAST(variables)
 
-	sb.WriteString("local message = if std.isObject(_input) then _input + {_ctx:: null} else _input;\n")
-	if inputIsObject {
-		sb.WriteString("local ctx = {lvl:0} + if std.isObject(_input) then std.get(_input, '_ctx', {}) else {};\n")
+	props, err := metadataCode(metadata.Properties)
+	if err != nil {
+		return "", err
+	}
+	envelope, err := metadataCode(metadata.Envelope)
+	if err != nil {
+		return "", err
+	}
+	routeContext, err := metadataCode(metadata.Context)
+	if err != nil {
+		return "", err
+	}
+
+	vm := <-e.vms
+	defer func() { e.vms <- vm }()
+
+	vm.TLAReset()
+	vm.TLAVar("topic", topic)
+
+	// Only json values are passed as code, everything else is treated as a string
+	if json.Valid([]byte(input)) {
+		vm.TLACode("_input", input)
 	} else {
-		sb.WriteString("local ctx = {lvl:0};\n")
+		vm.TLAVar("_input", input)
 	}
-	sb.WriteString(e.template)
-	sb.WriteString(" + {message+: {_ctx+: ctx + {lvl: std.get(ctx, 'lvl', 0) + 1}}}")
-	output, err := e.vm.EvaluateAnonymousSnippet("file", sb.String())
+	vm.TLANode("variables", variablesNode)
+	vm.TLACode("_props", props)
+	vm.TLACode("_mqtt", envelope)
+	vm.TLACode("_context", routeContext)
+
+	output, err := vm.Evaluate(program)
 
 	if e.Debug() {
-		fmt.Printf("Template: \n\n%s\n\n", sb.String())
+		fmt.Printf("Template: \n\n%s\n\nArguments:\n  topic: %s\n  message: %s\n  variables: %s\n  props: %s\n  mqtt: %s\n  context: %s\n\n", e.template, topic, input, variables, props, envelope, routeContext)
+	}
+	if err != nil {
+		return "", errors.New(vm.ErrorFormatter.Format(err))
+	}
+	return output, nil
+}
+
+// Metadata passed to the template as json. Missing values are passed as an empty object
+func metadataCode[T any](v *T) (string, error) {
+	if v == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Wrap the template in a function so that the per message values can be
+// provided as top-level arguments. If payloadContext is set, the routing context
+// is added to the output message
+func wrapTemplate(tmpl string, payloadContext bool) string {
+	sb := strings.Builder{}
+	sb.WriteString("function(topic='', _input={}, variables={}, _props={}, _mqtt={}, _context={})\n")
+	sb.WriteString("local props = {user_properties: {}} + _props;\n")
+	sb.WriteString("local mqtt = {retain: false, qos: 0, duplicate: false, received_time: '', broker: ''} + _mqtt;\n")
+	sb.WriteString("local message = if std.isObject(_input) then _input + {_ctx:: null} else _input;\n")
+	sb.WriteString("local ctx = {lvl:0} + (if std.isObject(_input) then std.get(_input, '_ctx', {}) else {}) + _context;\n")
+	sb.WriteString(tmpl)
+	if payloadContext {
+		sb.WriteString(" + {message+: {_ctx+: ctx + {lvl: std.get(ctx, 'lvl', 0) + 1}}}")
 	}
-	return output, err
+	return sb.String()
 }
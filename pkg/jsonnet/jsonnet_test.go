@@ -0,0 +1,280 @@
+package jsonnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ExecuteWithUnsafeInput(t *testing.T) {
+	tmpl := `{topic: topic, message: {value: message}, context: false}`
+
+	testcases := []struct {
+		Name    string
+		Topic   string
+		Message string
+	}{
+		{
+			Name:    "single quote",
+			Topic:   "c8y/s/ds",
+			Message: `511,device,echo 'hello world'`,
+		},
+		{
+			Name:    "double quote",
+			Topic:   "c8y/s/ds",
+			Message: `511,device,"echo ""hello"""`,
+		},
+		{
+			Name:    "backslash",
+			Topic:   "c8y/s/ds",
+			Message: `C:\temp\file.log\`,
+		},
+		{
+			Name:    "newlines",
+			Topic:   "c8y/s/ds",
+			Message: "line 1\nline 2\r\nline 3\n",
+		},
+		{
+			Name:    "jsonnet code injection",
+			Topic:   "c8y/s/ds",
+			Message: `'; error 'injected'; local x = '`,
+		},
+		{
+			Name:    "text block injection",
+			Topic:   "c8y/s/ds",
+			Message: "|||\n  injected\n|||",
+		},
+		{
+			Name:    "control characters",
+			Topic:   "c8y/s/ds",
+			Message: "value\x00\x01\x02\ttab",
+		},
+		{
+			Name:    "topic with quotes",
+			Topic:   `te/device/it's/'quoted'/\`,
+			Message: `text`,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.Name, func(t *testing.T) {
+			engine := NewEngine(tmpl)
+			output, err := engine.Execute(c.Topic, c.Message, "", template.Metadata{})
+			assert.NoError(t, err)
+
+			result := struct {
+				Topic   string `json:"topic"`
+				Message struct {
+					Value string `json:"value"`
+				} `json:"message"`
+			}{}
+			assert.NoError(t, json.Unmarshal([]byte(output), &result))
+			assert.Equal(t, c.Topic, result.Topic)
+			assert.Equal(t, c.Message, result.Message.Value)
+		})
+	}
+}
+
+func Test_ExecuteWithJSONInput(t *testing.T) {
+	engine := NewEngine(`{message: {value: message.value, lvl: ctx.lvl, name: variables.name}}`)
+	output, err := engine.Execute("in", `{"value": "it's \"quoted\"\n", "_ctx": {"lvl": 2}}`, `{"name": "o'brien"}`, template.Metadata{})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"message": {"value": "it's \"quoted\"\n", "lvl": 2, "name": "o'brien", "_ctx": {"lvl": 3}}}`, output)
+}
+
+func Test_ExecuteWithInvalidVariables(t *testing.T) {
+	engine := NewEngine(`{message: {vars: variables}}`)
+	output, err := engine.Execute("in", `{}`, `{"name": `, template.Metadata{})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"message": {"vars": {}, "_ctx": {"lvl": 1}}}`, output)
+}
+
+func Test_ExecuteWithProperties(t *testing.T) {
+	engine := NewEngine(`{message: {type: props.user_properties.type, content_type: std.get(props, 'content_type', '')}}`)
+	output, err := engine.Execute("in", `{}`, "", template.Metadata{
+		Properties: &template.Properties{
+			ContentType:    "application/json",
+			UserProperties: map[string]string{"type": "c8y_Temperature"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"message": {"type": "c8y_Temperature", "content_type": "application/json", "_ctx": {"lvl": 1}}}`, output)
+
+	// Messages without properties
+	engine = NewEngine(`{message: {props: props}}`)
+	output, err = engine.Execute("in", `{}`, "", template.Metadata{})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"message": {"props": {"user_properties": {}}, "_ctx": {"lvl": 1}}}`, output)
+}
+
+func Test_ExecuteWithEnvelope(t *testing.T) {
+	engine := NewEngine(`{message: {retain: mqtt.retain, qos: mqtt.qos, duplicate: mqtt.duplicate, time: mqtt.received_time, broker: mqtt.broker}}`)
+	output, err := engine.Execute("in", `{}`, "", template.Metadata{
+		Envelope: &template.Envelope{
+			Retain:       true,
+			QoS:          1,
+			ReceivedTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Broker:       "plant",
+		},
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"message": {"retain": true, "qos": 1, "duplicate": false, "time": "2024-01-02T03:04:05Z", "broker": "plant", "_ctx": {"lvl": 1}}}`, output)
+
+	// Defaults are used if the envelope is not set
+	output, err = engine.Execute("in", `{}`, "", template.Metadata{})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"message": {"retain": false, "qos": 0, "duplicate": false, "time": "", "broker": "", "_ctx": {"lvl": 1}}}`, output)
+}
+
+func Test_ExecuteWithPropertiesContext(t *testing.T) {
+	engine := NewEngine(`{message: {lvl: ctx.lvl, trace: ctx.trace}}`, WithPropertiesContext(true))
+	output, err := engine.Execute("in", `{}`, "", template.Metadata{
+		Context: &template.Context{Level: 2, Trace: []string{"a", "b"}},
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"message": {"lvl": 2, "trace": ["a", "b"]}}`, output)
+}
+
+func Test_Compile(t *testing.T) {
+	assert.NoError(t, NewEngine(`{topic: topic, message: message}`).Compile())
+	assert.Error(t, NewEngine(`{topic: `).Compile())
+	assert.Error(t, NewEngine(`{topic: unknownVariable}`).Compile())
+}
+
+var benchmarkTemplate = `
+local tedge = import 'tedge.libsonnet';
+local source = tedge.v1.getExternalDeviceSource(topic, meta);
+local type = tedge.v1.getType(topic);
+{
+	topic: 'c8y/measurement/measurements/create',
+	message: source + {
+		type: type,
+		time: std.get(message, 'time', _.Now()),
+	} + {
+		[k]: {
+			[k]: {
+				value: message[k],
+			},
+		}
+		for k in std.objectFields(message)
+		if std.isNumber(message[k])
+	},
+	context: false,
+}
+`
+
+func benchmarkVariables() string {
+	entities := map[string]any{}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("device/child%d//", i)
+		entities[key] = map[string]any{
+			"@id":     fmt.Sprintf("child%d", i),
+			"@type":   "child-device",
+			"@parent": "device/main//",
+		}
+	}
+	b, _ := json.Marshal(entities)
+	return string(b)
+}
+
+func newBenchmarkEngine(b *testing.B) *JsonnetEngine {
+	engine := NewEngine(
+		benchmarkTemplate,
+		WithLibraryPaths("../../lib"),
+		WithMetaData(map[string]any{"device_id": "main"}),
+	)
+	if err := engine.Compile(); err != nil {
+		b.Fatal(err)
+	}
+	return engine
+}
+
+// Template is compiled once, and only the message is bound per evaluation
+func BenchmarkExecute(b *testing.B) {
+	engine := newBenchmarkEngine(b)
+	variables := benchmarkVariables()
+	message := `{"temperature": 23.1, "humidity": 90.2, "time": "2023-01-01T00:00:00Z"}`
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := engine.Execute("te/device/child1///m/environment", message, variables, template.Metadata{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Template and variables are parsed on each evaluation (for comparison)
+func BenchmarkExecuteWithoutPrecompile(b *testing.B) {
+	engine := newBenchmarkEngine(b)
+	variables := benchmarkVariables()
+	message := `{"temperature": 23.1, "humidity": 90.2, "time": "2023-01-01T00:00:00Z"}`
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.program = nil
+		engine.variablesNode = nil
+		if _, err := engine.Execute("te/device/child1///m/environment", message, variables, template.Metadata{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_ExecuteConcurrently(t *testing.T) {
+	engine := NewEngine(
+		`{topic: topic, message: {value: message.value, name: variables.name, id: _.ID()}}`,
+		WithVMPoolSize(4),
+	)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				topic := fmt.Sprintf("in/%d/%d", i, j)
+				variables := fmt.Sprintf(`{"name": "vars%d"}`, j%3)
+				output, err := engine.Execute(topic, fmt.Sprintf(`{"value": %d}`, j), variables, template.Metadata{})
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				result := struct {
+					Topic   string `json:"topic"`
+					Message struct {
+						Value int    `json:"value"`
+						Name  string `json:"name"`
+					} `json:"message"`
+				}{}
+				assert.NoError(t, json.Unmarshal([]byte(output), &result))
+				assert.Equal(t, topic, result.Topic)
+				assert.Equal(t, j, result.Message.Value)
+				assert.Equal(t, fmt.Sprintf("vars%d", j%3), result.Message.Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func Test_Imports(t *testing.T) {
+	dir := t.TempDir()
+	libDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "utils.libsonnet"), []byte("local lib = import 'lib.libsonnet';\n{value: lib.value}"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "data.txt"), []byte("text"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(libDir, "lib.libsonnet"), []byte("{value: 1}"), 0o644))
+
+	tmpl := "header\n###\nlocal utils = import 'utils.libsonnet';\nlocal missing = import 'missing.libsonnet';\n{message: utils.value, text: importstr 'data.txt'}"
+	imports, err := Imports(filepath.Join(dir, "template.jsonnet"), tmpl, libDir)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		filepath.Join(dir, "utils.libsonnet"):  "local lib = import 'lib.libsonnet';\n{value: lib.value}",
+		filepath.Join(dir, "data.txt"):         "text",
+		filepath.Join(libDir, "lib.libsonnet"): "{value: 1}",
+	}, imports)
+}
@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tedge_mapper_template"
+
+// Outcomes of an api request
+const (
+	APISuccess  = "success"
+	APIRetry    = "retry"
+	APIFailed   = "failed"
+	APIBuffered = "buffered"
+)
+
+// Reasons for skipping an output
+const (
+	SkipTemplate    = "template"
+	SkipRateLimited = "rate_limited"
+)
+
+// Metrics collects the prometheus metrics of the service. All methods can be
+// called on a nil Metrics, in which case nothing is recorded
+type Metrics struct {
+	registry *prometheus.Registry
+
+	matched   *prometheus.CounterVec
+	published *prometheus.CounterVec
+	skipped   *prometheus.CounterVec
+	errored   *prometheus.CounterVec
+	template  *prometheus.HistogramVec
+	requests  *prometheus.CounterVec
+	limited   *prometheus.CounterVec
+	lastError *prometheus.GaugeVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		matched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_matched_total",
+			Help:      "Number of messages which matched a route.",
+		}, []string{"route"}),
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_published_total",
+			Help:      "Number of messages published (or api requests sent) by a route.",
+		}, []string{"route", "type"}),
+		skipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_skipped_total",
+			Help:      "Number of outputs which were skipped by a route, by reason: template or rate_limited.",
+		}, []string{"route", "reason"}),
+		errored: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_errored_total",
+			Help:      "Number of messages which a route failed to process.",
+		}, []string{"route", "stage"}),
+		template: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "template_duration_seconds",
+			Help:      "Time taken to evaluate the template of a route.",
+			Buckets:   []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+		}, []string{"route"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_requests_total",
+			Help:      "Number of api request attempts by outcome: success, retry, failed or buffered.",
+		}, []string{"route", "outcome"}),
+		limited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_total",
+			Help:      "Number of rate limit decisions of a route, by decision: allowed, queued, dropped, coalesced or overflowed.",
+		}, []string{"route", "decision"}),
+		lastError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_error_timestamp_seconds",
+			Help:      "Time of the last error of a route (unix timestamp).",
+		}, []string{"route"}),
+	}
+	m.registry.MustRegister(
+		m.matched,
+		m.published,
+		m.skipped,
+		m.errored,
+		m.template,
+		m.requests,
+		m.limited,
+		m.lastError,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) Matched(route string) {
+	if m != nil {
+		m.matched.WithLabelValues(route).Inc()
+	}
+}
+
+// Published counts an output of the given type (mqtt, update or api)
+func (m *Metrics) Published(route, outputType string) {
+	if m != nil {
+		m.published.WithLabelValues(route, outputType).Inc()
+	}
+}
+
+// Skipped counts an output which was not sent, e.g. skipped by the template or dropped by the rate limit
+func (m *Metrics) Skipped(route, reason string) {
+	if m != nil {
+		m.skipped.WithLabelValues(route, reason).Inc()
+	}
+}
+
+func (m *Metrics) Errored(route, stage string) {
+	if m != nil {
+		m.errored.WithLabelValues(route, stage).Inc()
+		m.lastError.WithLabelValues(route).SetToCurrentTime()
+	}
+}
+
+func (m *Metrics) ObserveTemplate(route string, d time.Duration) {
+	if m != nil {
+		m.template.WithLabelValues(route).Observe(d.Seconds())
+	}
+}
+
+func (m *Metrics) APIRequest(route, outcome string) {
+	if m != nil {
+		m.requests.WithLabelValues(route, outcome).Inc()
+	}
+}
+
+// RateLimited counts a decision of the rate limit of a route
+func (m *Metrics) RateLimited(route, decision string) {
+	if m != nil {
+		m.limited.WithLabelValues(route, decision).Inc()
+	}
+}
+
+// Gauge registers a gauge whose value is read when the metrics are collected, e.g. a queue depth
+func (m *Metrics) Gauge(name, help string, f func() float64) {
+	if m != nil {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, f))
+	}
+}
+
+// Counter registers a counter whose value is read when the metrics are collected
+func (m *Metrics) Counter(name, help string, f func() float64) {
+	if m != nil {
+		m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, f))
+	}
+}
+
+// RouteStats are the counters of a route
+type RouteStats struct {
+	Matched       uint64     `json:"matched"`
+	Published     uint64     `json:"published"`
+	Skipped       uint64     `json:"skipped"`
+	Errors        uint64     `json:"errors"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// RouteStats returns the counters of each route
+func (m *Metrics) RouteStats() (map[string]RouteStats, error) {
+	stats := map[string]RouteStats{}
+	if m == nil {
+		return stats, nil
+	}
+	families, err := m.registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			route := ""
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "route" {
+					route = label.GetValue()
+				}
+			}
+			if route == "" {
+				continue
+			}
+			s := stats[route]
+			count := uint64(metric.GetCounter().GetValue())
+			switch family.GetName() {
+			case namespace + "_messages_matched_total":
+				s.Matched += count
+			case namespace + "_messages_published_total":
+				s.Published += count
+			case namespace + "_messages_skipped_total":
+				s.Skipped += count
+			case namespace + "_messages_errored_total":
+				s.Errors += count
+			case namespace + "_last_error_timestamp_seconds":
+				seconds := metric.GetGauge().GetValue()
+				t := time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+				s.LastErrorTime = &t
+			default:
+				continue
+			}
+			stats[route] = s
+		}
+	}
+	return stats, nil
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ListenAndServe serves the metrics on /metrics until the context is cancelled
+func (m *Metrics) ListenAndServe(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving metrics.", "address", addr, "path", "/metrics")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
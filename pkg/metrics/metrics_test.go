@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	b, err := io.ReadAll(w.Result().Body)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func Test_Metrics(t *testing.T) {
+	m := New()
+	m.Matched("route1")
+	m.Matched("route1")
+	m.Published("route1", "mqtt")
+	m.Skipped("route1", SkipTemplate)
+	m.Errored("route1", "template")
+	m.ObserveTemplate("route1", 2*time.Millisecond)
+	m.APIRequest("route1", APISuccess)
+	m.RateLimited("route1", "dropped")
+	m.Gauge("queue_depth", "Queue depth.", func() float64 { return 3 })
+	m.Counter("queue_dropped_total", "Dropped messages.", func() float64 { return 4 })
+
+	output := scrape(t, m)
+	assert.Contains(t, output, `tedge_mapper_template_messages_matched_total{route="route1"} 2`)
+	assert.Contains(t, output, `tedge_mapper_template_messages_published_total{route="route1",type="mqtt"} 1`)
+	assert.Contains(t, output, `tedge_mapper_template_messages_skipped_total{reason="template",route="route1"} 1`)
+	assert.Contains(t, output, `tedge_mapper_template_messages_errored_total{route="route1",stage="template"} 1`)
+	assert.Contains(t, output, `tedge_mapper_template_template_duration_seconds_count{route="route1"} 1`)
+	assert.Contains(t, output, `tedge_mapper_template_api_requests_total{outcome="success",route="route1"} 1`)
+	assert.Contains(t, output, `tedge_mapper_template_rate_limited_total{decision="dropped",route="route1"} 1`)
+	assert.Contains(t, output, `tedge_mapper_template_queue_depth 3`)
+	assert.Contains(t, output, `tedge_mapper_template_queue_dropped_total 4`)
+}
+
+func Test_RouteStats(t *testing.T) {
+	m := New()
+	m.Matched("route1")
+	m.Published("route1", "mqtt")
+	m.Published("route1", "api")
+	m.Skipped("route2", SkipRateLimited)
+	m.Errored("route2", "template")
+	m.Errored("route2", "api")
+
+	stats, err := m.RouteStats()
+	assert.NoError(t, err)
+	assert.Equal(t, RouteStats{Matched: 1, Published: 2}, stats["route1"])
+	assert.Equal(t, uint64(1), stats["route2"].Skipped)
+	assert.Equal(t, uint64(2), stats["route2"].Errors)
+	if assert.NotNil(t, stats["route2"].LastErrorTime) {
+		assert.WithinDuration(t, time.Now(), *stats["route2"].LastErrorTime, time.Minute)
+	}
+}
+
+func Test_NilMetrics(t *testing.T) {
+	var m *Metrics
+	assert.NotPanics(t, func() {
+		m.Matched("route1")
+		m.Published("route1", "mqtt")
+		m.Skipped("route1", SkipTemplate)
+		m.Errored("route1", "template")
+		m.ObserveTemplate("route1", time.Millisecond)
+		m.APIRequest("route1", APIFailed)
+		m.RateLimited("route1", "allowed")
+		m.Gauge("queue_depth", "Queue depth.", func() float64 { return 0 })
+		m.Counter("queue_dropped_total", "Dropped messages.", func() float64 { return 0 })
+	})
+}
@@ -0,0 +1,214 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrQueueFull = errors.New("queue is full")
+
+var ErrClosed = errors.New("pipeline is closed")
+
+// Policy controls what happens when a job is submitted to a full queue
+type Policy string
+
+const (
+	// Wait until there is space in the queue
+	PolicyBlock Policy = "block"
+	// Drop the oldest job in the queue to make space for the new job
+	PolicyDropOldest Policy = "drop-oldest"
+	// Reject the new job
+	PolicyReject Policy = "reject"
+)
+
+func ParsePolicy(v string) (Policy, error) {
+	switch Policy(strings.ToLower(v)) {
+	case PolicyBlock, "":
+		return PolicyBlock, nil
+	case PolicyDropOldest:
+		return PolicyDropOldest, nil
+	case PolicyReject:
+		return PolicyReject, nil
+	default:
+		return "", fmt.Errorf("invalid queue policy. expected one of [block, drop-oldest, reject]. got=%s", v)
+	}
+}
+
+// KeyFunc returns the key used to order jobs. Jobs with the same key are processed in the order
+// that they were submitted
+type KeyFunc func(topic string) string
+
+// Order by the full topic
+func TopicKey(topic string) string {
+	return topic
+}
+
+// Order by the thin-edge.io entity (e.g. te/device/child01//), so that all messages
+// related to the same entity are processed in order. Non thin-edge.io topics use the full topic
+func DeviceKey(topic string) string {
+	parts := strings.SplitN(topic, "/", 6)
+	if len(parts) < 5 || parts[0] != "te" {
+		return topic
+	}
+	return strings.Join(parts[0:5], "/")
+}
+
+func ParseKeyFunc(v string) (KeyFunc, error) {
+	switch strings.ToLower(v) {
+	case "topic", "":
+		return TopicKey, nil
+	case "device":
+		return DeviceKey, nil
+	default:
+		return nil, fmt.Errorf("invalid ordering key. expected one of [topic, device]. got=%s", v)
+	}
+}
+
+// Pipeline processes jobs using a fixed number of workers. Each key is always assigned to
+// the same worker so that the ordering of jobs with the same key is preserved, whilst jobs
+// with different keys can be processed concurrently.
+type Pipeline struct {
+	mu     sync.RWMutex
+	closed bool
+	queues []chan func()
+	policy Policy
+	wg     sync.WaitGroup
+
+	dropped  atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// Create and start a new pipeline. The queue size is the total number of jobs
+// which can be queued, and it is shared equally between the workers
+func New(workers int, queueSize int, policy Policy) *Pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	size := queueSize / workers
+	if size < 1 {
+		size = 1
+	}
+
+	p := &Pipeline{
+		queues: make([]chan func(), workers),
+		policy: policy,
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), size)
+		p.wg.Add(1)
+		go p.worker(p.queues[i])
+	}
+	slog.Info("Started processing pipeline.", "workers", workers, "queue_size", size*workers, "policy", policy)
+	return p
+}
+
+func (p *Pipeline) worker(queue chan func()) {
+	defer p.wg.Done()
+	for job := range queue {
+		p.run(job)
+	}
+}
+
+func (p *Pipeline) run(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Recovered from panic whilst processing job.", "error", r)
+		}
+	}()
+	job()
+}
+
+func (p *Pipeline) queue(key string) chan func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// Submit a job to be processed. The queue policy controls what happens if the queue is full
+func (p *Pipeline) Submit(key string, job func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+
+	queue := p.queue(key)
+	switch p.policy {
+	case PolicyReject:
+		select {
+		case queue <- job:
+			return nil
+		default:
+			p.rejected.Add(1)
+			return ErrQueueFull
+		}
+	case PolicyDropOldest:
+		for {
+			select {
+			case queue <- job:
+				return nil
+			default:
+			}
+			select {
+			case <-queue:
+				p.dropped.Add(1)
+				slog.Warn("Queue is full. Dropped the oldest job.", "key", key)
+			default:
+			}
+		}
+	default:
+		queue <- job
+		return nil
+	}
+}
+
+// Len returns the number of queued jobs
+func (p *Pipeline) Len() int {
+	total := 0
+	for _, queue := range p.queues {
+		total += len(queue)
+	}
+	return total
+}
+
+// Dropped returns the number of jobs which were dropped due to a full queue
+func (p *Pipeline) Dropped() uint64 {
+	return p.dropped.Load()
+}
+
+// Rejected returns the number of jobs which were rejected due to a full queue
+func (p *Pipeline) Rejected() uint64 {
+	return p.rejected.Load()
+}
+
+// Close stops accepting new jobs and waits for the queued jobs to be processed
+// or until the context is done
+func (p *Pipeline) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OrderIsPreservedPerKey(t *testing.T) {
+	p := New(4, 100, PolicyBlock)
+
+	mu := sync.Mutex{}
+	results := map[string][]int{}
+	for i := 0; i < 50; i++ {
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			key, i := key, i
+			assert.NoError(t, p.Submit(key, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				results[key] = append(results[key], i)
+			}))
+		}
+	}
+	assert.NoError(t, p.Close(context.Background()))
+
+	for key, values := range results {
+		assert.Len(t, values, 50, key)
+		for i, v := range values {
+			assert.Equal(t, i, v, key)
+		}
+	}
+}
+
+func Test_QueuePolicies(t *testing.T) {
+	testcases := []struct {
+		Policy           Policy
+		ExpectedErr      error
+		ExpectedDropped  uint64
+		ExpectedRejected uint64
+		ExpectedValues   []int
+	}{
+		{
+			Policy:           PolicyReject,
+			ExpectedErr:      ErrQueueFull,
+			ExpectedRejected: 1,
+			ExpectedValues:   []int{0, 1, 2},
+		},
+		{
+			Policy:          PolicyDropOldest,
+			ExpectedDropped: 1,
+			ExpectedValues:  []int{0, 2, 3},
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(string(c.Policy), func(t *testing.T) {
+			p := New(1, 2, c.Policy)
+
+			// Block the worker so that the queue fills up
+			started := make(chan struct{})
+			release := make(chan struct{})
+			values := []int{}
+			assert.NoError(t, p.Submit("key", func() {
+				close(started)
+				<-release
+				values = append(values, 0)
+			}))
+			<-started
+
+			var err error
+			for i := 1; i <= 3; i++ {
+				i := i
+				if submitErr := p.Submit("key", func() { values = append(values, i) }); submitErr != nil {
+					err = submitErr
+				}
+			}
+			assert.ErrorIs(t, err, c.ExpectedErr)
+			close(release)
+			assert.NoError(t, p.Close(context.Background()))
+
+			assert.Equal(t, c.ExpectedValues, values)
+			assert.Equal(t, c.ExpectedDropped, p.Dropped())
+			assert.Equal(t, c.ExpectedRejected, p.Rejected())
+		})
+	}
+}
+
+func Test_CloseRejectsNewJobs(t *testing.T) {
+	p := New(2, 10, PolicyBlock)
+	assert.NoError(t, p.Close(context.Background()))
+	assert.ErrorIs(t, p.Submit("key", func() {}), ErrClosed)
+}
+
+func Test_CloseTimeout(t *testing.T) {
+	p := New(1, 10, PolicyBlock)
+	release := make(chan struct{})
+	defer close(release)
+	assert.NoError(t, p.Submit("key", func() { <-release }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.Close(ctx), context.DeadlineExceeded)
+}
+
+func Test_DeviceKey(t *testing.T) {
+	testcases := map[string]string{
+		"te/device/main///m/env":          "te/device/main//",
+		"te/device/child01//":             "te/device/child01//",
+		"te/device/child01/service/app/e": "te/device/child01/service/app",
+		"c8y/s/ds":                        "c8y/s/ds",
+	}
+	for topic, expected := range testcases {
+		assert.Equal(t, expected, DeviceKey(topic), fmt.Sprintf("topic=%s", topic))
+	}
+}
@@ -0,0 +1,354 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Action controls what happens to a message when the rate limit is exceeded
+type Action string
+
+const (
+	// Drop the message
+	ActionDrop Action = "drop"
+	// Delay the message until the rate limit allows it to be sent
+	ActionQueue Action = "queue"
+	// Only keep the latest message of each key (e.g. output topic), and send it when the
+	// rate limit allows it. Any previously waiting message with the same key is replaced
+	ActionCoalesceLatest Action = "coalesce-latest"
+)
+
+func ParseAction(v string) (Action, error) {
+	switch Action(strings.ToLower(v)) {
+	case ActionDrop, "":
+		return ActionDrop, nil
+	case ActionQueue:
+		return ActionQueue, nil
+	case ActionCoalesceLatest:
+		return ActionCoalesceLatest, nil
+	default:
+		return "", fmt.Errorf("invalid rate limit action. expected one of [drop, queue, coalesce-latest]. got=%s", v)
+	}
+}
+
+// Decision is the result of applying the rate limit to a message
+type Decision string
+
+const (
+	// Message was sent immediately
+	Allowed Decision = "allowed"
+	// Message will be sent later
+	Queued Decision = "queued"
+	// Message was dropped
+	Dropped Decision = "dropped"
+	// Message replaced a message which was waiting to be sent
+	Coalesced Decision = "coalesced"
+	// Message was dropped as the queue of waiting messages is full
+	Overflowed Decision = "overflowed"
+)
+
+// Limiter is a token bucket which is refilled at a fixed rate (tokens per second)
+// up to the burst size
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+func (l *Limiter) refill() time.Time {
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	return now
+}
+
+func (l *Limiter) wait() time.Duration {
+	if l.tokens >= 1 {
+		return 0
+	}
+	if l.rate <= 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// Allow takes a token if one is available
+func (l *Limiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.tokens >= 1 {
+		l.tokens--
+		return true
+	}
+	return false
+}
+
+// Full returns true if all tokens are available, so the limiter behaves like a new one
+func (l *Limiter) Full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	return l.tokens >= l.burst
+}
+
+// Delay returns how long until the next token is available
+func (l *Limiter) Delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	return l.wait()
+}
+
+// Default maximum number of functions waiting to be run by a throttle
+const DefaultQueueSize = 1000
+
+// Throttle applies a rate limit to functions (e.g. publishing a message). Functions which
+// have to wait are kept in a bounded queue, and are run in order by a single drainer
+type Throttle struct {
+	limiter   *Limiter
+	action    Action
+	queueSize int
+	afterFunc func(time.Duration, func())
+
+	mu        sync.Mutex
+	queue     []*waiting
+	scheduled bool
+
+	allowed    atomic.Uint64
+	queued     atomic.Uint64
+	dropped    atomic.Uint64
+	coalesced  atomic.Uint64
+	overflowed atomic.Uint64
+}
+
+type waiting struct {
+	key string
+	f   func()
+}
+
+type ThrottleOption func(*Throttle)
+
+// Maximum number of functions waiting to be run. Functions are rejected once the queue is full
+func WithQueueSize(n int) ThrottleOption {
+	return func(t *Throttle) {
+		if n > 0 {
+			t.queueSize = n
+		}
+	}
+}
+
+// Function used to schedule the drainer of the queue. If the drainer is run before it
+// is due (e.g. the scheduled functions are flushed on shutdown), then all of the waiting
+// functions are run immediately
+func WithAfterFunc(afterFunc func(time.Duration, func())) ThrottleOption {
+	return func(t *Throttle) {
+		if afterFunc != nil {
+			t.afterFunc = afterFunc
+		}
+	}
+}
+
+func NewThrottle(rate float64, burst int, action Action, opts ...ThrottleOption) *Throttle {
+	t := &Throttle{
+		limiter:   NewLimiter(rate, burst),
+		action:    action,
+		queueSize: DefaultQueueSize,
+		afterFunc: func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Do runs the function if the rate limit allows it, otherwise the action of the throttle
+// decides if the function is run later or not at all. When using coalesce-latest, a waiting
+// function is replaced by the latest function with the same key (e.g. the output topic)
+func (t *Throttle) Do(key string, f func()) Decision {
+	if t.action != ActionQueue && t.action != ActionCoalesceLatest {
+		if !t.limiter.Allow() {
+			t.dropped.Add(1)
+			return Dropped
+		}
+		t.allowed.Add(1)
+		f()
+		return Allowed
+	}
+
+	t.mu.Lock()
+	// Functions must not overtake the waiting functions
+	if len(t.queue) == 0 && !t.scheduled && t.limiter.Allow() {
+		t.mu.Unlock()
+		t.allowed.Add(1)
+		f()
+		return Allowed
+	}
+	if t.action == ActionCoalesceLatest {
+		for _, w := range t.queue {
+			if w.key == key {
+				w.f = f
+				t.mu.Unlock()
+				t.coalesced.Add(1)
+				return Coalesced
+			}
+		}
+	}
+	if len(t.queue) >= t.queueSize {
+		t.mu.Unlock()
+		t.overflowed.Add(1)
+		return Overflowed
+	}
+	t.queue = append(t.queue, &waiting{key: key, f: f})
+	delay, schedule := t.nextDrain()
+	t.mu.Unlock()
+
+	t.queued.Add(1)
+	if schedule {
+		t.afterFunc(delay, t.drainer(delay))
+	}
+	return Queued
+}
+
+// Try takes a token if a function could run now, without running or queuing the function. This is used
+// when the caller keeps the function itself (e.g. a persisted message). Throttles using the drop action
+// return Dropped if the rate limit is exceeded, otherwise Queued is returned along with the time to wait
+// before trying again
+func (t *Throttle) Try() (Decision, time.Duration) {
+	if t.action != ActionQueue && t.action != ActionCoalesceLatest {
+		if !t.limiter.Allow() {
+			t.dropped.Add(1)
+			return Dropped, 0
+		}
+		t.allowed.Add(1)
+		return Allowed, 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) == 0 && !t.scheduled && t.limiter.Allow() {
+		t.allowed.Add(1)
+		return Allowed, 0
+	}
+	t.queued.Add(1)
+	return Queued, t.wait()
+}
+
+// Wait returns how long until a function could run without exceeding the rate limit, including the
+// time needed to run the waiting functions first. Throttles using the drop action never wait
+func (t *Throttle) Wait() time.Duration {
+	if t.action != ActionQueue && t.action != ActionCoalesceLatest {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) == 0 && !t.scheduled {
+		return t.limiter.Delay()
+	}
+	return t.wait()
+}
+
+// Time to wait whilst there are waiting functions. The lock must be held
+func (t *Throttle) wait() time.Duration {
+	if t.limiter.rate <= 0 {
+		return t.limiter.Delay()
+	}
+	interval := time.Duration(float64(time.Second) / t.limiter.rate)
+	return max(t.limiter.Delay()+time.Duration(len(t.queue))*interval, interval)
+}
+
+// Pending returns the number of functions waiting to be run
+func (t *Throttle) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.queue)
+}
+
+// Idle returns true if there are no waiting functions and all tokens are available
+func (t *Throttle) Idle() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.queue) == 0 && !t.scheduled && t.limiter.Full()
+}
+
+// Schedule the drainer if there are waiting functions and it is not already scheduled.
+// The lock must be held
+func (t *Throttle) nextDrain() (time.Duration, bool) {
+	if t.scheduled || len(t.queue) == 0 {
+		return 0, false
+	}
+	t.scheduled = true
+	return t.limiter.Delay(), true
+}
+
+func (t *Throttle) drainer(delay time.Duration) func() {
+	due := time.Now().Add(delay)
+	return func() {
+		t.drain(time.Now().Before(due))
+	}
+}
+
+// Run the waiting functions (in order) which are allowed by the rate limit,
+// or all of them if flushing
+func (t *Throttle) drain(flush bool) {
+	t.mu.Lock()
+	ready := make([]func(), 0)
+	for len(t.queue) > 0 && (flush || t.limiter.Allow()) {
+		ready = append(ready, t.queue[0].f)
+		t.queue[0] = nil
+		t.queue = t.queue[1:]
+	}
+	t.mu.Unlock()
+
+	for _, f := range ready {
+		f()
+	}
+
+	t.mu.Lock()
+	t.scheduled = false
+	delay, schedule := t.nextDrain()
+	t.mu.Unlock()
+	if schedule {
+		t.afterFunc(delay, t.drainer(delay))
+	}
+}
+
+// Stats contains the number of decisions made by a throttle
+type Stats struct {
+	Allowed   uint64
+	Queued    uint64
+	Dropped   uint64
+	Coalesced uint64
+	// Messages which were dropped as the queue was full
+	Overflowed uint64
+}
+
+func (t *Throttle) Stats() Stats {
+	return Stats{
+		Allowed:    t.allowed.Load(),
+		Queued:     t.queued.Load(),
+		Dropped:    t.dropped.Load(),
+		Coalesced:  t.coalesced.Load(),
+		Overflowed: t.overflowed.Load(),
+	}
+}
@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLimiter(rate float64, burst int) (*Limiter, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(rate, burst)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func Test_LimiterAllow(t *testing.T) {
+	limiter, now := newTestLimiter(2, 3)
+
+	// Burst is available immediately
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow())
+	}
+	assert.False(t, limiter.Allow())
+	assert.Equal(t, 500*time.Millisecond, limiter.Delay())
+
+	*now = now.Add(500 * time.Millisecond)
+	assert.True(t, limiter.Allow())
+	assert.False(t, limiter.Allow())
+
+	// Tokens are never refilled beyond the burst size
+	*now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, limiter.Allow())
+	}
+	assert.False(t, limiter.Allow())
+}
+
+func Test_LimiterFull(t *testing.T) {
+	limiter, now := newTestLimiter(10, 2)
+	assert.True(t, limiter.Full())
+	assert.True(t, limiter.Allow())
+	assert.False(t, limiter.Full())
+
+	*now = now.Add(100 * time.Millisecond)
+	assert.True(t, limiter.Full())
+}
+
+func Test_ThrottleDrop(t *testing.T) {
+	throttle := NewThrottle(1, 2, ActionDrop)
+	count := 0
+	decisions := []Decision{}
+	for i := 0; i < 4; i++ {
+		decisions = append(decisions, throttle.Do("", func() { count++ }))
+	}
+	assert.Equal(t, []Decision{Allowed, Allowed, Dropped, Dropped}, decisions)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, Stats{Allowed: 2, Dropped: 2}, throttle.Stats())
+}
+
+func Test_ThrottleQueue(t *testing.T) {
+	throttle := NewThrottle(50, 1, ActionQueue)
+
+	mu := sync.Mutex{}
+	values := []int{}
+	wg := sync.WaitGroup{}
+	decisions := []Decision{}
+	for i := 0; i < 3; i++ {
+		i := i
+		wg.Add(1)
+		decisions = append(decisions, throttle.Do("", func() {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			values = append(values, i)
+		}))
+	}
+	wg.Wait()
+	assert.Equal(t, []Decision{Allowed, Queued, Queued}, decisions)
+	assert.Equal(t, []int{0, 1, 2}, values)
+	assert.Equal(t, Stats{Allowed: 1, Queued: 2}, throttle.Stats())
+}
+
+func Test_ThrottleCoalesceLatest(t *testing.T) {
+	throttle := NewThrottle(50, 1, ActionCoalesceLatest)
+
+	values := make(chan int, 10)
+	decisions := []Decision{}
+	for i := 0; i < 4; i++ {
+		i := i
+		decisions = append(decisions, throttle.Do("topic", func() { values <- i }))
+	}
+	assert.Equal(t, []Decision{Allowed, Queued, Coalesced, Coalesced}, decisions)
+
+	assert.Equal(t, 0, <-values)
+	select {
+	case v := <-values:
+		assert.Equal(t, 3, v)
+	case <-time.After(time.Second):
+		t.Fatal("coalesced message was not sent")
+	}
+	assert.Equal(t, Stats{Allowed: 1, Queued: 1, Coalesced: 2}, throttle.Stats())
+}
+
+func Test_ThrottleQueueOverflow(t *testing.T) {
+	throttle := NewThrottle(1, 1, ActionQueue, WithQueueSize(2))
+	decisions := []Decision{}
+	for i := 0; i < 4; i++ {
+		decisions = append(decisions, throttle.Do("", func() {}))
+	}
+	assert.Equal(t, []Decision{Allowed, Queued, Queued, Overflowed}, decisions)
+	assert.Equal(t, 2, throttle.Pending())
+	assert.Equal(t, Stats{Allowed: 1, Queued: 2, Overflowed: 1}, throttle.Stats())
+}
+
+func Test_ThrottleTry(t *testing.T) {
+	throttle := NewThrottle(1, 1, ActionQueue, WithAfterFunc(func(time.Duration, func()) {}))
+	decision, wait := throttle.Try()
+	assert.Equal(t, Allowed, decision)
+	assert.Zero(t, wait)
+
+	// Functions are not queued, instead the caller has to try again later
+	decision, wait = throttle.Try()
+	assert.Equal(t, Queued, decision)
+	assert.InDelta(t, time.Second, wait, float64(10*time.Millisecond))
+	assert.Equal(t, 0, throttle.Pending())
+
+	// The waiting functions are run first
+	throttle.Do("", func() {})
+	assert.InDelta(t, 2*time.Second, throttle.Wait(), float64(10*time.Millisecond))
+
+	dropping := NewThrottle(1, 1, ActionDrop)
+	decision, _ = dropping.Try()
+	assert.Equal(t, Allowed, decision)
+	decision, _ = dropping.Try()
+	assert.Equal(t, Dropped, decision)
+	assert.Zero(t, dropping.Wait())
+}
+
+func Test_ThrottleIdle(t *testing.T) {
+	throttle := NewThrottle(1000, 1, ActionQueue, WithAfterFunc(func(time.Duration, func()) {}))
+	assert.True(t, throttle.Idle())
+
+	// The throttle is busy whilst functions are waiting
+	throttle.Do("", func() {})
+	throttle.Do("", func() {})
+	assert.False(t, throttle.Idle())
+	throttle.drain(true)
+	assert.Eventually(t, throttle.Idle, time.Second, time.Millisecond)
+}
+
+func Test_ThrottleCoalesceLatestByKey(t *testing.T) {
+	throttle := NewThrottle(50, 1, ActionCoalesceLatest)
+
+	mu := sync.Mutex{}
+	values := []string{}
+	wg := sync.WaitGroup{}
+	send := func(v string) func() {
+		return func() {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			values = append(values, v)
+		}
+	}
+	wg.Add(3)
+	decisions := []Decision{
+		throttle.Do("a", send("a1")),
+		throttle.Do("a", send("a2")),
+		throttle.Do("b", send("b1")),
+	}
+	// The replaced message is never sent
+	decisions = append(decisions, throttle.Do("a", send("a3")))
+	wg.Wait()
+
+	assert.Equal(t, []Decision{Allowed, Queued, Queued, Coalesced}, decisions)
+	assert.Equal(t, []string{"a1", "a3", "b1"}, values)
+}
+
+func Test_ThrottleFlush(t *testing.T) {
+	// The drainer is run early, e.g. when the scheduled tasks are flushed on shutdown
+	var drain func()
+	throttle := NewThrottle(0.001, 1, ActionQueue, WithAfterFunc(func(d time.Duration, f func()) {
+		drain = f
+	}))
+	count := 0
+	for i := 0; i < 3; i++ {
+		throttle.Do("", func() { count++ })
+	}
+	assert.Equal(t, 1, count)
+	assert.NotNil(t, drain)
+
+	drain()
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 0, throttle.Pending())
+}
+
+func Test_ParseAction(t *testing.T) {
+	action, err := ParseAction("")
+	assert.NoError(t, err)
+	assert.Equal(t, ActionDrop, action)
+
+	action, err = ParseAction("Coalesce-Latest")
+	assert.NoError(t, err)
+	assert.Equal(t, ActionCoalesceLatest, action)
+
+	_, err = ParseAction("unknown")
+	assert.Error(t, err)
+}
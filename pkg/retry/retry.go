@@ -0,0 +1,69 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// Status codes which are retried by default. Requests which fail
+// without a response (e.g. network errors) are always retried
+var DefaultRetryOn = []int{408, 425, 429, 500, 502, 503, 504}
+
+// Policy controls how often a failed request is retried, and how long
+// to wait between attempts (exponential backoff with jitter)
+type Policy struct {
+	// Total number of attempts (including the first attempt)
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Randomize the interval by +/- the given fraction, e.g. 0.2 = 20%
+	Jitter float64
+	// Status codes which should be retried
+	RetryOn []int
+}
+
+// NoRetry only tries once
+var NoRetry = Policy{MaxAttempts: 1}
+
+// Default fraction used to randomize the backoff interval
+const DefaultJitter = 0.2
+
+// Fill in any unset values with the defaults
+func (p Policy) WithDefaults() Policy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = time.Second
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = 30 * time.Second
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	p.Jitter = min(max(p.Jitter, 0), 1)
+	if len(p.RetryOn) == 0 {
+		p.RetryOn = DefaultRetryOn
+	}
+	return p
+}
+
+// Retryable checks if a request which failed with the given status code should be retried.
+// A status code of 0 means that no response was received
+func (p Policy) Retryable(statusCode int) bool {
+	return statusCode == 0 || slices.Contains(p.RetryOn, statusCode)
+}
+
+// Backoff returns how long to wait after the given (failed) attempt before trying again
+func (p Policy) Backoff(attempt int) time.Duration {
+	interval := float64(p.InitialInterval) * math.Pow(p.Multiplier, float64(max(attempt-1, 0)))
+	interval = min(interval, float64(p.MaxInterval))
+	if p.Jitter > 0 {
+		interval += interval * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(interval)
+}
@@ -0,0 +1,46 @@
+package retry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Backoff(t *testing.T) {
+	policy := Policy{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     time.Second,
+	}.WithDefaults()
+
+	assert.Equal(t, 100*time.Millisecond, policy.Backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.Backoff(2))
+	assert.Equal(t, 400*time.Millisecond, policy.Backoff(3))
+	assert.Equal(t, time.Second, policy.Backoff(10))
+}
+
+func Test_BackoffWithJitter(t *testing.T) {
+	policy := Policy{
+		InitialInterval: time.Second,
+		Jitter:          0.5,
+	}.WithDefaults()
+
+	for i := 0; i < 100; i++ {
+		wait := policy.Backoff(1)
+		assert.GreaterOrEqual(t, wait, 500*time.Millisecond)
+		assert.LessOrEqual(t, wait, 1500*time.Millisecond)
+	}
+}
+
+func Test_Retryable(t *testing.T) {
+	policy := Policy{}.WithDefaults()
+	assert.True(t, policy.Retryable(0))
+	assert.True(t, policy.Retryable(503))
+	assert.True(t, policy.Retryable(429))
+	assert.False(t, policy.Retryable(400))
+	assert.False(t, policy.Retryable(404))
+
+	policy = Policy{RetryOn: []int{404}}.WithDefaults()
+	assert.True(t, policy.Retryable(404))
+	assert.False(t, policy.Retryable(503))
+}
@@ -4,7 +4,11 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/tidwall/sjson"
 	"gopkg.in/yaml.v3"
@@ -16,12 +20,55 @@ type Specification struct {
 }
 
 type Route struct {
-	Name         string        `yaml:"name"`
-	Disable      bool          `yaml:"disable"`
-	Topics       []string      `yaml:"topics"`
-	Skip         bool          `yaml:"skip"`
-	Template     Template      `yaml:"template"`
-	PreProcessor *PreProcessor `yaml:"preprocessor,omitempty"`
+	Name     string  `yaml:"name"`
+	Disable  bool    `yaml:"disable"`
+	Topics   []Topic `yaml:"topics"`
+	Skip     bool    `yaml:"skip"`
+	Priority int     `yaml:"priority"`
+	// Ignore retained messages, e.g. the messages which are received after subscribing
+	IgnoreRetained bool          `yaml:"ignore_retained,omitempty"`
+	Template       Template      `yaml:"template"`
+	PreProcessor   *PreProcessor `yaml:"preprocessor,omitempty"`
+	RateLimit      *RateLimit    `yaml:"rate_limit,omitempty"`
+	Retry          *Retry        `yaml:"retry,omitempty"`
+	// Topic which api requests which have failed permanently are published to
+	DeadLetterTopic string `yaml:"dead_letter_topic,omitempty"`
+
+	// File the route was loaded from (if any)
+	File string `yaml:"-"`
+}
+
+// Topic filter which a route subscribes to. A plain string subscribes to the main broker,
+// otherwise a named broker can be selected, e.g. {topic: "factory/#", broker: plant}
+type Topic struct {
+	Topic string `yaml:"topic"`
+	// Name of the broker (from the config file). Empty for the main broker
+	Broker string `yaml:"broker,omitempty"`
+}
+
+func (t *Topic) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = Topic{}
+		return value.Decode(&t.Topic)
+	}
+	type plain Topic
+	return value.Decode((*plain)(t))
+}
+
+func (t Topic) MarshalYAML() (any, error) {
+	if t.Broker == "" {
+		return t.Topic, nil
+	}
+	type plain Topic
+	return plain(t), nil
+}
+
+// String returns the topic filter, prefixed with the broker name if it is not the main broker
+func (t Topic) String() string {
+	if t.Broker == "" {
+		return t.Topic
+	}
+	return t.Broker + ":" + t.Topic
 }
 
 type Template struct {
@@ -30,6 +77,47 @@ type Template struct {
 	Path  string `yaml:"path"`
 }
 
+// Limit the rate of messages which are sent by a route
+type RateLimit struct {
+	// Number of messages per second
+	Rate float64 `yaml:"rate"`
+	// Number of messages which can be sent at once before the rate applies
+	Burst int `yaml:"burst"`
+	// Action when the limit is exceeded: drop, queue or coalesce-latest
+	Action string `yaml:"action"`
+	// Maximum number of messages waiting to be sent (queue and coalesce-latest)
+	QueueSize int `yaml:"queue_size,omitempty"`
+	// Additional limits for each output topic matching a topic filter
+	Topics []TopicRateLimit `yaml:"topics,omitempty"`
+}
+
+// Retry failed api requests using an exponential backoff
+type Retry struct {
+	// Total number of attempts (including the first attempt)
+	MaxAttempts     int           `yaml:"max_attempts" json:"max_attempts,omitempty"`
+	InitialInterval time.Duration `yaml:"initial_interval" json:"initial_interval,omitempty"`
+	MaxInterval     time.Duration `yaml:"max_interval" json:"max_interval,omitempty"`
+	Multiplier      float64       `yaml:"multiplier" json:"multiplier,omitempty"`
+	// Randomize the interval by +/- the given fraction, e.g. 0.2 = 20%
+	Jitter *float64 `yaml:"jitter" json:"jitter,omitempty"`
+	// Status codes which should be retried
+	RetryOn []int `yaml:"retry_on" json:"retry_on,omitempty"`
+}
+
+// Limit the rate of messages sent to each output topic which matches the topic filter
+type TopicRateLimit struct {
+	Topic     string  `yaml:"topic"`
+	Rate      float64 `yaml:"rate"`
+	Burst     int     `yaml:"burst"`
+	Action    string  `yaml:"action"`
+	QueueSize int     `yaml:"queue_size,omitempty"`
+}
+
+// Match checks if the output topic matches the topic filter
+func (l *TopicRateLimit) Match(topic string) bool {
+	return l.Topic == topic || routeIncludesTopic(l.Topic, topic)
+}
+
 type PreProcessor struct {
 	Type           string   `yaml:"type"`
 	Delimiter      string   `yaml:"delimiter"`
@@ -44,7 +132,33 @@ func (r *Route) DisplayTopics(sep ...string) string {
 	if len(sep) > 0 {
 		delim = sep[0]
 	}
-	return strings.Join(r.Topics, delim)
+	topics := make([]string, 0, len(r.Topics))
+	for _, topic := range r.Topics {
+		topics = append(topics, topic.String())
+	}
+	return strings.Join(topics, delim)
+}
+
+// Path to the external template file. Relative paths are resolved
+// relative to the file the route was loaded from
+func (r *Route) TemplatePath() string {
+	if r.Template.Path == "" || filepath.IsAbs(r.Template.Path) || r.File == "" {
+		return r.Template.Path
+	}
+	return filepath.Join(filepath.Dir(r.File), r.Template.Path)
+}
+
+// Load the template source. If a template path is set, then the template is read from file,
+// otherwise the inline template value is used
+func (r *Route) LoadTemplate() (string, error) {
+	if r.Template.Path == "" {
+		return r.Template.Value, nil
+	}
+	b, err := os.ReadFile(r.TemplatePath())
+	if err != nil {
+		return "", fmt.Errorf("could not read template file. %w", err)
+	}
+	return string(b), nil
 }
 
 func (r *Route) PreparePreProcessor() error {
@@ -92,6 +206,32 @@ func Parse(r io.Reader) (*Specification, error) {
 	return spec, nil
 }
 
+// Parse a route specification from file. The file path is recorded on each route
+func ParseFile(path string) (*Specification, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	spec, err := Parse(file)
+	if err != nil {
+		return nil, err
+	}
+	for i := range spec.Routes {
+		spec.Routes[i].File = path
+	}
+	return spec, nil
+}
+
+// Sort routes by priority (highest first). Routes with the same priority
+// keep the order in which they were loaded
+func SortByPriority(routes []Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Priority > routes[j].Priority
+	})
+}
+
 // helpers
 
 // match takes a slice of strings which represent the route being tested having been split on '/'
@@ -118,6 +258,11 @@ func match(route []string, topic []string) bool {
 	return false
 }
 
+// MatchTopic returns true if the topic matches the topic filter (including wildcards and shared subscriptions)
+func MatchTopic(filter, topic string) bool {
+	return filter == topic || routeIncludesTopic(filter, topic)
+}
+
 func routeIncludesTopic(route, topic string) bool {
 	return match(routeSplit(route), strings.Split(topic, "/"))
 }
@@ -137,8 +282,14 @@ func routeSplit(route string) []string {
 // match takes the topic string of the published message and does a basic compare to the
 // string of the current Route, if they match it returns true
 func (r *Route) Match(topic string) bool {
+	return r.MatchBroker("", topic)
+}
+
+// MatchBroker checks if the route subscribes to the topic of a message received from the named
+// broker. The main broker has an empty name
+func (r *Route) MatchBroker(broker string, topic string) bool {
 	for _, routeTopic := range r.Topics {
-		if routeTopic == topic || routeIncludesTopic(routeTopic, topic) {
+		if routeTopic.Broker == broker && MatchTopic(routeTopic.Topic, topic) {
 			return true
 		}
 	}
@@ -2,9 +2,13 @@ package routes
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/MakeNowJust/heredoc/v2"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestCSVPreprocessor(t *testing.T) {
@@ -129,8 +133,61 @@ func Test_RoutePatternMatch(t *testing.T) {
 
 	for _, c := range testcases {
 		route := Route{
-			Topics: []string{c.TopicPattern},
+			Topics: []Topic{{Topic: c.TopicPattern}},
 		}
 		assert.Equal(t, c.Expected, route.Match(c.Topic))
 	}
 }
+
+func Test_ParseRetry(t *testing.T) {
+	spec, err := Parse(strings.NewReader(heredoc.Doc(`
+		routes:
+		- name: retry
+		  topics: [in]
+		  dead_letter_topic: errors/api
+		  retry:
+		    max_attempts: 5
+		    initial_interval: 500ms
+		    max_interval: 1m
+		    jitter: 0
+		    retry_on: [503]
+	`)))
+	assert.NoError(t, err)
+	route := spec.Routes[0]
+	assert.Equal(t, "errors/api", route.DeadLetterTopic)
+	if assert.NotNil(t, route.Retry) {
+		assert.Equal(t, 5, route.Retry.MaxAttempts)
+		assert.Equal(t, 500*time.Millisecond, route.Retry.InitialInterval)
+		assert.Equal(t, time.Minute, route.Retry.MaxInterval)
+		assert.Equal(t, 0.0, *route.Retry.Jitter)
+		assert.Equal(t, []int{503}, route.Retry.RetryOn)
+	}
+}
+
+func Test_ParseTopics(t *testing.T) {
+	spec, err := Parse(strings.NewReader(heredoc.Doc(`
+		routes:
+		- name: bridge
+		  topics:
+		    - te/device/main///m/+
+		    - topic: factory/+/status
+		      broker: plant
+	`)))
+	assert.NoError(t, err)
+	route := spec.Routes[0]
+	assert.Equal(t, []Topic{
+		{Topic: "te/device/main///m/+"},
+		{Topic: "factory/+/status", Broker: "plant"},
+	}, route.Topics)
+	assert.Equal(t, "te/device/main///m/+, plant:factory/+/status", route.DisplayTopics())
+
+	assert.True(t, route.Match("te/device/main///m/env"))
+	assert.False(t, route.Match("factory/line1/status"))
+	assert.True(t, route.MatchBroker("plant", "factory/line1/status"))
+	assert.False(t, route.MatchBroker("plant", "te/device/main///m/env"))
+	assert.False(t, route.MatchBroker("other", "factory/line1/status"))
+
+	b, err := yaml.Marshal(route.Topics)
+	assert.NoError(t, err)
+	assert.Equal(t, "- te/device/main///m/+\n- topic: factory/+/status\n  broker: plant\n", string(b))
+}
@@ -0,0 +1,384 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/retry"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/streamer"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+)
+
+// APIRequest is an api request sent by a route
+type APIRequest struct {
+	Host        string            `json:"host,omitempty"`
+	Endpoint    string            `json:"endpoint,omitempty"`
+	Method      string            `json:"method"`
+	Path        string            `json:"path"`
+	Query       map[string]any    `json:"query,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Accept      string            `json:"accept,omitempty"`
+	Body        any               `json:"body,omitempty"`
+	RawBody     *string           `json:"raw_body,omitempty"`
+	BodyBase64  string            `json:"body_base64,omitempty"`
+	Timeout     time.Duration     `json:"timeout,omitempty"`
+	// Topic which the response is published to (optional)
+	ResponseTopic string `json:"response_topic,omitempty"`
+	// Routing context of the message which created the request
+	Context json.RawMessage `json:"-"`
+}
+
+// Create an api request from the api output of a route
+func NewAPIRequest(r *streamer.RestRequest) APIRequest {
+	return APIRequest{
+		Host:          r.Host,
+		Endpoint:      r.Endpoint,
+		Method:        strings.ToUpper(r.Method),
+		Path:          r.Path,
+		Query:         r.Query,
+		Headers:       r.Headers,
+		ContentType:   r.ContentType,
+		Accept:        r.Accept,
+		Body:          r.Body,
+		RawBody:       r.RawBody,
+		BodyBase64:    r.BodyBase64,
+		Timeout:       time.Duration(float64(r.Timeout) * float64(time.Second)),
+		ResponseTopic: r.ResponseTopic,
+	}
+}
+
+// Body to be sent. Raw and binary bodies are sent as is, and any other body is sent as json
+func (r APIRequest) body() (any, error) {
+	switch {
+	case r.RawBody != nil:
+		return *r.RawBody, nil
+	case r.BodyBase64 != "":
+		return base64.StdEncoding.DecodeString(r.BodyBase64)
+	default:
+		return r.Body, nil
+	}
+}
+
+// Content type of the body. Binary bodies default to application/octet-stream
+func (r APIRequest) contentType() string {
+	if r.ContentType == "" && r.RawBody == nil && r.BodyBase64 != "" {
+		return "application/octet-stream"
+	}
+	return r.ContentType
+}
+
+// Encoded query parameters
+func (r APIRequest) query() string {
+	values := url.Values{}
+	for key, value := range r.Query {
+		switch v := value.(type) {
+		case []any:
+			for _, item := range v {
+				values.Add(key, fmt.Sprint(item))
+			}
+		case nil:
+			values.Add(key, "")
+		default:
+			values.Add(key, fmt.Sprint(v))
+		}
+	}
+	return values.Encode()
+}
+
+// APIResponse is published to the response topic of an api request, so the response
+// can be processed by other routes
+type APIResponse struct {
+	Status  int                `json:"status"`
+	Headers map[string]string  `json:"headers,omitempty"`
+	Body    any                `json:"body,omitempty"`
+	Error   string             `json:"error,omitempty"`
+	Request APIResponseRequest `json:"request"`
+	Context json.RawMessage    `json:"_ctx,omitempty"`
+}
+
+// APIResponseRequest identifies the request of an api response. The body is not included,
+// as it could be large (e.g. a binary), and is already known by the route which sent the request
+type APIResponseRequest struct {
+	Endpoint string         `json:"endpoint,omitempty"`
+	Method   string         `json:"method"`
+	Path     string         `json:"path"`
+	Query    map[string]any `json:"query,omitempty"`
+}
+
+// DeadLetter is published when an api request has failed permanently
+type DeadLetter struct {
+	Route    string              `json:"route,omitempty"`
+	Request  APIRequest          `json:"request"`
+	Response *DeadLetterResponse `json:"response,omitempty"`
+	Error    string              `json:"error"`
+	Attempts int                 `json:"attempts"`
+	Time     time.Time           `json:"time"`
+}
+
+type DeadLetterResponse struct {
+	Status int `json:"status"`
+	Body   any `json:"body,omitempty"`
+}
+
+// Convert the retry settings of a route to a retry policy. Requests are not retried
+// if the route does not have any retry settings
+func newRetryPolicy(config *routes.Retry) retry.Policy {
+	if config == nil {
+		return retry.NoRetry
+	}
+	policy := retry.Policy{
+		MaxAttempts:     config.MaxAttempts,
+		InitialInterval: config.InitialInterval,
+		MaxInterval:     config.MaxInterval,
+		Multiplier:      config.Multiplier,
+		Jitter:          retry.DefaultJitter,
+		RetryOn:         config.RetryOn,
+	}
+	if config.Jitter != nil {
+		policy.Jitter = *config.Jitter
+	}
+	return policy.WithDefaults()
+}
+
+// Send api requests, retrying failed requests according to the retry policy.
+// Requests which have failed permanently are published to the dead-letter topic.
+// Requests to the default api are buffered in the outbox (if set) whilst the api is unreachable
+type apiSender struct {
+	route           string
+	retry           *routes.Retry
+	policy          retry.Policy
+	deadLetterTopic string
+	outbox          *Outbox
+	metrics         *metrics.Metrics
+	health          *Health
+	tasks           *Tasks
+	// The routing context of responses is carried by the message properties (MQTT v5)
+	propertiesContext bool
+
+	send    func(r APIRequest) (*c8y.Response, error)
+	publish func(topic string, payload []byte, props *template.Properties)
+}
+
+func newAPISender(client mqtt.Client, apiClient *APIClient, endpoints Endpoints, outbox *Outbox, m *metrics.Metrics, health *Health, tasks *Tasks, route string, config *routes.Retry, deadLetterTopic string) *apiSender {
+	return &apiSender{
+		route:             route,
+		retry:             config,
+		policy:            newRetryPolicy(config),
+		deadLetterTopic:   deadLetterTopic,
+		outbox:            outbox,
+		metrics:           m,
+		health:            health,
+		tasks:             tasks,
+		propertiesContext: propertiesContext(client),
+		send: func(r APIRequest) (*c8y.Response, error) {
+			endpointClient, err := endpoints.Client(r.Endpoint, apiClient)
+			if err != nil {
+				return nil, err
+			}
+			return SendAPIRequest(endpointClient, r)
+		},
+		publish: func(topic string, payload []byte, props *template.Properties) {
+			if client != nil {
+				publish(client, topic, 1, false, payload, props)
+			}
+		},
+	}
+}
+
+// Request returns a function which sends the api request
+func (s *apiSender) Request(r APIRequest) func() {
+	return func() {
+		// Keep the order of requests whilst older requests are still buffered
+		if s.buffered(r) && s.outbox.Offline() {
+			s.buffer(r)
+			return
+		}
+		s.attempt(r, 1)
+	}
+}
+
+// Only requests to the default api are buffered, as the connectivity is only known for the cloud
+func (s *apiSender) buffered(r APIRequest) bool {
+	return s.outbox != nil && r.Endpoint == ""
+}
+
+func (s *apiSender) buffer(r APIRequest) {
+	m := apiDelayedMessage(r, s.retry, s.deadLetterTopic)
+	m.Route = s.route
+	if err := s.outbox.Add(m); err != nil {
+		slog.Error("Could not buffer api request.", "route", s.route, "method", r.Method, "path", r.Path, "error", err)
+		return
+	}
+	s.record(metrics.APIBuffered)
+}
+
+// Replay a buffered request (without retrying). False is returned if the api
+// is still unreachable, so the request should be kept
+func (s *apiSender) replay(r APIRequest) bool {
+	resp, err := s.send(r)
+	if err == nil {
+		s.record(metrics.APISuccess)
+		s.respond(r, resp, nil)
+		return true
+	}
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode()
+	}
+	if isUnreachable(status, err) {
+		slog.Info("Api is still unreachable.", "route", s.route, "method", r.Method, "path", r.Path, "status", status, "error", err)
+		return false
+	}
+	slog.Error("Failed to send api request.", "route", s.route, "method", r.Method, "path", r.Path, "status", status, "error", err)
+	s.record(metrics.APIFailed)
+	s.respond(r, resp, err)
+	s.deadLetter(r, 1, resp, err)
+	return true
+}
+
+func (s *apiSender) attempt(r APIRequest, n int) {
+	resp, err := s.send(r)
+	if err == nil {
+		s.record(metrics.APISuccess)
+		s.respond(r, resp, nil)
+		return
+	}
+
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode()
+	}
+
+	if n < s.policy.MaxAttempts && s.policy.Retryable(status) && !errors.Is(err, ErrUnknownEndpoint) {
+		wait := s.policy.Backoff(n)
+		slog.Warn("Failed to send api request. Retrying.", "route", s.route, "endpoint", r.Endpoint, "method", r.Method, "path", r.Path, "status", status, "attempt", n, "retry_in", wait, "error", err)
+		s.record(metrics.APIRetry)
+		s.tasks.AfterFunc(wait, func() { s.attempt(r, n+1) })
+		return
+	}
+
+	if s.buffered(r) && isUnreachable(status, err) {
+		s.outbox.SetOffline(err.Error())
+		s.buffer(r)
+		return
+	}
+
+	slog.Error("Failed to send api request.", "route", s.route, "endpoint", r.Endpoint, "method", r.Method, "path", r.Path, "status", status, "attempts", n, "error", err)
+	s.record(metrics.APIFailed)
+	s.respond(r, resp, err)
+	s.deadLetter(r, n, resp, err)
+}
+
+// Record the outcome of an api request attempt
+func (s *apiSender) record(outcome string) {
+	s.metrics.APIRequest(s.route, outcome)
+	if outcome == metrics.APISuccess {
+		s.metrics.Published(s.route, "api")
+	}
+	s.health.APIRequest(outcome)
+}
+
+// Response body as json (if possible), otherwise as a string
+func responseBody(resp *c8y.Response, err error) any {
+	errorResponse := &c8y.ErrorResponse{}
+	if errors.As(err, &errorResponse) {
+		return errorResponse
+	}
+	if resp == nil {
+		return nil
+	}
+	body := resp.Body()
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return json.RawMessage(body)
+	}
+	return string(body)
+}
+
+// Publish the response to the response topic of the request (if set)
+func (s *apiSender) respond(r APIRequest, resp *c8y.Response, err error) {
+	if r.ResponseTopic == "" {
+		return
+	}
+
+	message := APIResponse{
+		Request: APIResponseRequest{
+			Endpoint: r.Endpoint,
+			Method:   r.Method,
+			Path:     r.Path,
+			Query:    r.Query,
+		},
+		Body:    responseBody(resp, err),
+		Context: r.Context,
+	}
+	if resp != nil {
+		message.Status = resp.StatusCode()
+		if header := resp.Header(); len(header) > 0 {
+			message.Headers = make(map[string]string, len(header))
+			for key, values := range header {
+				message.Headers[key] = strings.Join(values, ", ")
+			}
+		}
+	}
+	if err != nil {
+		message.Error = err.Error()
+	}
+
+	var props *template.Properties
+	if s.propertiesContext && len(r.Context) > 0 {
+		ctx := &template.Context{}
+		if err := json.Unmarshal(r.Context, ctx); err == nil {
+			props = withContext(nil, ctx)
+			message.Context = nil
+		}
+	}
+
+	payload, marshalErr := json.Marshal(message)
+	if marshalErr != nil {
+		slog.Warn("Could not create api response message.", "route", s.route, "error", marshalErr)
+		return
+	}
+	slog.Info("Publishing api response.", "route", s.route, "topic", r.ResponseTopic, "status", message.Status)
+	s.publish(r.ResponseTopic, payload, props)
+}
+
+func (s *apiSender) deadLetter(r APIRequest, attempts int, resp *c8y.Response, err error) {
+	if s.deadLetterTopic == "" {
+		return
+	}
+
+	message := DeadLetter{
+		Route:    s.route,
+		Request:  r,
+		Error:    err.Error(),
+		Attempts: attempts,
+		Time:     time.Now(),
+	}
+	if resp != nil && resp.StatusCode() != 0 {
+		message.Response = &DeadLetterResponse{
+			Status: resp.StatusCode(),
+			Body:   responseBody(resp, err),
+		}
+	}
+
+	payload, marshalErr := json.Marshal(message)
+	if marshalErr != nil {
+		slog.Warn("Could not create dead-letter message.", "route", s.route, "error", marshalErr)
+		return
+	}
+	slog.Info("Publishing dead-letter message.", "route", s.route, "topic", s.deadLetterTopic, "message", string(payload))
+	s.publish(s.deadLetterTopic, payload, nil)
+}
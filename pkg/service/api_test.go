@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestResponse(status int) (*c8y.Response, error) {
+	if status < 300 {
+		return &c8y.Response{Response: &http.Response{StatusCode: status}}, nil
+	}
+	resp := &http.Response{
+		StatusCode: status,
+		Request:    httptest.NewRequest("POST", "/event/events", nil),
+	}
+	return &c8y.Response{Response: resp}, &c8y.ErrorResponse{
+		Response:  resp,
+		ErrorType: "test/error",
+		Message:   http.StatusText(status),
+	}
+}
+
+type testAPISender struct {
+	*apiSender
+	mu          sync.Mutex
+	attempts    int
+	deadLetters chan DeadLetter
+}
+
+func newTestAPISender(t *testing.T, config *routes.Retry, statuses ...int) *testAPISender {
+	s := &testAPISender{
+		apiSender:   newAPISender(nil, nil, nil, nil, nil, nil, nil, "test", config, "deadletter"),
+		deadLetters: make(chan DeadLetter, 10),
+	}
+	s.send = func(r APIRequest) (*c8y.Response, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		status := statuses[min(s.attempts, len(statuses)-1)]
+		s.attempts++
+		return newTestResponse(status)
+	}
+	s.publish = func(topic string, payload []byte, props *template.Properties) {
+		assert.Equal(t, "deadletter", topic)
+		message := DeadLetter{}
+		assert.NoError(t, json.Unmarshal(payload, &message))
+		s.deadLetters <- message
+	}
+	return s
+}
+
+func (s *testAPISender) Attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+var testRetry = &routes.Retry{
+	MaxAttempts:     3,
+	InitialInterval: 10 * time.Millisecond,
+}
+
+func Test_APIRequestIsRetried(t *testing.T) {
+	s := newTestAPISender(t, testRetry, 503, 429, 201)
+	s.Request(APIRequest{Method: "POST", Path: "/event/events"})()
+
+	assert.Eventually(t, func() bool { return s.Attempts() == 3 }, time.Second, 5*time.Millisecond)
+	assert.Never(t, func() bool { return len(s.deadLetters) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+func Test_APIRequestDeadLetter(t *testing.T) {
+	testcases := []struct {
+		Name             string
+		Retry            *routes.Retry
+		Statuses         []int
+		ExpectedAttempts int
+		ExpectedStatus   int
+	}{
+		{
+			Name:             "retries exhausted",
+			Retry:            testRetry,
+			Statuses:         []int{503},
+			ExpectedAttempts: 3,
+			ExpectedStatus:   503,
+		},
+		{
+			Name:             "permanent error",
+			Retry:            testRetry,
+			Statuses:         []int{400},
+			ExpectedAttempts: 1,
+			ExpectedStatus:   400,
+		},
+		{
+			Name:             "without retry settings",
+			Statuses:         []int{503},
+			ExpectedAttempts: 1,
+			ExpectedStatus:   503,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.Name, func(t *testing.T) {
+			s := newTestAPISender(t, c.Retry, c.Statuses...)
+			s.Request(APIRequest{Method: "POST", Path: "/event/events", Body: map[string]any{"text": "test"}})()
+
+			select {
+			case message := <-s.deadLetters:
+				assert.Equal(t, "test", message.Route)
+				assert.Equal(t, "/event/events", message.Request.Path)
+				assert.Equal(t, map[string]any{"text": "test"}, message.Request.Body)
+				assert.Equal(t, c.ExpectedAttempts, message.Attempts)
+				if assert.NotNil(t, message.Response) {
+					assert.Equal(t, c.ExpectedStatus, message.Response.Status)
+					assert.Equal(t, http.StatusText(c.ExpectedStatus), message.Response.Body.(map[string]any)["message"])
+				}
+				assert.NotEmpty(t, message.Error)
+			case <-time.After(time.Second):
+				t.Fatal("dead-letter message was not published")
+			}
+			assert.Equal(t, c.ExpectedAttempts, s.Attempts())
+		})
+	}
+}
+
+func Test_APIResponseIsPublished(t *testing.T) {
+	s := newTestAPISender(t, nil, 201)
+	published := make(chan []byte, 1)
+	s.send = func(r APIRequest) (*c8y.Response, error) {
+		resp := &c8y.Response{Response: &http.Response{
+			StatusCode: 201,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+		}}
+		resp.SetBody([]byte(`{"id": "12345"}`))
+		return resp, nil
+	}
+	s.publish = func(topic string, payload []byte, props *template.Properties) {
+		assert.Equal(t, "c8y/responses/operation", topic)
+		published <- payload
+	}
+
+	s.Request(APIRequest{
+		Endpoint:      "c8y",
+		Method:        "POST",
+		Path:          "/devicecontrol/operations",
+		Query:         map[string]any{"withChildren": false},
+		Body:          map[string]any{"deviceId": "12345"},
+		ResponseTopic: "c8y/responses/operation",
+		Context:       json.RawMessage(`{"lvl": 2}`),
+	})()
+
+	select {
+	case payload := <-published:
+		assert.JSONEq(t, `{
+			"status": 201,
+			"headers": {"Content-Type": "application/json"},
+			"body": {"id": "12345"},
+			"request": {"endpoint": "c8y", "method": "POST", "path": "/devicecontrol/operations", "query": {"withChildren": false}},
+			"_ctx": {"lvl": 2}
+		}`, string(payload))
+	default:
+		t.Fatal("api response was not published")
+	}
+}
+
+func Test_SendAPIRequest(t *testing.T) {
+	type received struct {
+		Method      string
+		Path        string
+		Query       url.Values
+		ContentType string
+		Accept      string
+		Header      string
+		Body        []byte
+	}
+	requests := make(chan received, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Query:       r.URL.Query(),
+			ContentType: r.Header.Get("Content-Type"),
+			Accept:      r.Header.Get("Accept"),
+			Header:      r.Header.Get("X-Custom"),
+			Body:        body,
+		}
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &APIClient{Client: c8y.NewClient(nil, server.URL, "", "", "", true)}
+	raw := "a,b,c\n1,2,3\n"
+
+	testcases := []struct {
+		Name     string
+		Request  APIRequest
+		Expected received
+	}{
+		{
+			Name:    "delete with query parameters",
+			Request: APIRequest{Method: "delete", Path: "/event/events", Query: map[string]any{"source": "12345", "pageSize": float64(10), "type": []any{"a", "b"}}},
+			Expected: received{
+				Method: "DELETE",
+				Path:   "/event/events",
+				Query:  url.Values{"source": {"12345"}, "pageSize": {"10"}, "type": {"a", "b"}},
+				Accept: "application/json",
+				Body:   []byte{},
+			},
+		},
+		{
+			Name:    "raw body with headers",
+			Request: APIRequest{Method: "PATCH", Path: "/custom", RawBody: &raw, ContentType: "text/csv", Accept: "text/plain", Headers: map[string]string{"X-Custom": "value"}},
+			Expected: received{
+				Method:      "PATCH",
+				Path:        "/custom",
+				Query:       url.Values{},
+				ContentType: "text/csv",
+				Accept:      "text/plain",
+				Header:      "value",
+				Body:        []byte(raw),
+			},
+		},
+		{
+			Name:    "binary body",
+			Request: APIRequest{Method: "POST", Path: "/inventory/binaries", BodyBase64: base64.StdEncoding.EncodeToString([]byte{0, 1, 2, 255}), ContentType: "application/octet-stream"},
+			Expected: received{
+				Method:      "POST",
+				Path:        "/inventory/binaries",
+				Query:       url.Values{},
+				ContentType: "application/octet-stream",
+				Accept:      "application/json",
+				Body:        []byte{0, 1, 2, 255},
+			},
+		},
+		{
+			Name:    "binary body without content type",
+			Request: APIRequest{Method: "POST", Path: "/inventory/binaries", BodyBase64: base64.StdEncoding.EncodeToString([]byte{0, 1, 2, 255})},
+			Expected: received{
+				Method:      "POST",
+				Path:        "/inventory/binaries",
+				Query:       url.Values{},
+				ContentType: "application/octet-stream",
+				Accept:      "application/json",
+				Body:        []byte{0, 1, 2, 255},
+			},
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.Name, func(t *testing.T) {
+			_, err := SendAPIRequest(client, c.Request)
+			assert.NoError(t, err)
+			assert.Equal(t, c.Expected, <-requests)
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		_, err := SendAPIRequest(client, APIRequest{Method: "GET", Path: "/slow", Timeout: 50 * time.Millisecond})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		<-requests
+	})
+}
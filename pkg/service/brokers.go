@@ -0,0 +1,81 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Name of the main broker connection. Topics and outputs without a broker use the main broker
+const DefaultBroker = ""
+
+// Time to wait for the initial connection to a named broker before continuing without it
+const DefaultBrokerConnectTimeout = 5 * time.Second
+
+// Connect to a named broker. Routes can subscribe to the topics of the broker, and publish
+// messages to it. Brokers must be added before the routes are loaded.
+// If the broker is unreachable, the connection is retried in the background and the service is degraded
+// until it is connected, so a named broker does not stop the service from starting
+func (s *Service) AddBroker(name string, broker string, clientID string, cleanSession bool, dryRun bool, mqttOptions MQTTOptions) error {
+	if name == DefaultBroker {
+		return fmt.Errorf("broker name can not be empty")
+	}
+	if _, exists := s.Brokers[name]; exists {
+		return fmt.Errorf("broker already exists. name=%s", name)
+	}
+
+	client, err := mqttOptions.newClient(broker, clientID, cleanSession, clientHandlers{
+		OnConnect: func(c mqtt.Client, reconnect bool) {
+			s.onBrokerConnect(name, c)
+		},
+		OnMessage: func(c mqtt.Client, m mqtt.Message) {
+			s.dispatch(name, m)
+		},
+		OnConnectionLost: func(c mqtt.Client, err error) {
+			slog.Warn("Lost connection to the MQTT broker.", "broker", name, "error", err)
+			s.Health.ConnectionLost()
+			s.Health.BrokerConnected(name, false)
+		},
+		ConnectRetry: true,
+	})
+	if err != nil {
+		return fmt.Errorf("broker=%s. %w", name, err)
+	}
+
+	if !dryRun {
+		slog.Info("Connecting to broker.", "broker", name, "host", broker, "client_id", clientID)
+		if token := client.Connect(); !token.WaitTimeout(DefaultBrokerConnectTimeout) || token.Error() != nil {
+			slog.Warn("Could not connect to broker. Retrying in the background.", "broker", name, "host", broker, "error", token.Error())
+			s.Health.BrokerConnected(name, false)
+		}
+	}
+
+	if s.Brokers == nil {
+		s.Brokers = make(map[string]mqtt.Client)
+	}
+	s.Brokers[name] = client
+	return nil
+}
+
+// Restore the subscriptions of the routes after reconnecting to a named broker. The subscriptions
+// are also made if the initial connection was only established after the routes were started
+func (s *Service) onBrokerConnect(name string, c mqtt.Client) {
+	s.Health.BrokerConnected(name, true)
+	if s.Stopping() {
+		return
+	}
+
+	s.mu.RLock()
+	var topics map[string]byte
+	if s.subscribed {
+		topics = maps.Clone(s.BrokerSubscriptions[name])
+	}
+	s.mu.RUnlock()
+
+	if err := subscribeTopics(c, topics); err != nil {
+		slog.Warn("Could not restore subscriptions after reconnecting.", "broker", name, "error", err)
+	}
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/errors"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/streamer"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_PublishToNamedBroker(t *testing.T) {
+	route := routes.Route{
+		Name:   "bridge",
+		Topics: []routes.Topic{{Topic: "in"}},
+		Template: routes.Template{
+			Type: "jsonnet",
+			Value: heredoc.Doc(`
+				{
+					topic: 'factory/out',
+					broker: 'plant',
+					message: {value: 1},
+					updates: [
+						{topic: 'factory/update', broker: 'plant', message: {value: 2}},
+						{topic: 'local/update', message: {value: 3}},
+					],
+				}
+			`),
+		},
+	}
+	client := newTestClient()
+	plant := newTestClient()
+	handler, err := NewStreamFactory(client, nil, route, nil, 2, WithBrokers(map[string]mqtt.Client{"plant": plant}))
+	assert.NoError(t, err)
+
+	_, err = handler("in", `{}`, template.Metadata{})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"value": 1, "_ctx": {"lvl": 1}}`, string(plant.published["factory/out"]))
+	assert.JSONEq(t, `{"value": 2}`, string(plant.published["factory/update"]))
+	assert.JSONEq(t, `{"value": 3}`, string(client.published["local/update"]))
+	assert.NotContains(t, client.published, "factory/out")
+
+	// Unknown brokers
+	_, err = NewStreamFactory(client, nil, route, nil, 2)
+	assert.NoError(t, err)
+	route.Topics = []routes.Topic{{Topic: "in", Broker: "other"}}
+	_, err = NewStreamFactory(client, nil, route, nil, 2)
+	assert.ErrorContains(t, err, "unknown broker. name=other")
+}
+
+func Test_LoopProtectionAcrossBrokers(t *testing.T) {
+	// The main broker uses MQTT v5, so the context is carried by the properties, however
+	// the plant broker uses MQTT v3 so the context is added to the payload instead
+	route := routes.Route{
+		Name:   "echo",
+		Topics: []routes.Topic{{Topic: "in", Broker: "plant"}},
+		Template: routes.Template{
+			Type: "jsonnet",
+			Value: heredoc.Doc(`
+				{
+					topic: 'in',
+					broker: 'plant',
+					message: {value: ctx.lvl},
+				}
+			`),
+		},
+	}
+	client := &propertiesClient{testClient: newTestClient(), props: map[string]*template.Properties{}}
+	plant := newTestClient()
+	handler, err := NewStreamFactory(client, nil, route, nil, 2, WithBrokers(map[string]mqtt.Client{"plant": plant}))
+	assert.NoError(t, err)
+
+	message := `{}`
+	iterations := 0
+	for iterations < 5 {
+		_, err = handler("in", message, template.Metadata{})
+		if err != nil {
+			break
+		}
+		iterations++
+		message = string(plant.published["in"])
+		assert.JSONEq(t, fmt.Sprintf(`{"value": %d, "_ctx": {"lvl": %d, "trace": %s}}`, iterations-1, iterations, map[int]string{
+			1: `["echo"]`,
+			2: `["echo", "echo"]`,
+		}[iterations]), message)
+	}
+	assert.Equal(t, 2, iterations)
+	assert.ErrorIs(t, err, errors.ErrRecursiveLevelExceeded)
+}
+
+func Test_DispatchNamedBrokerMessages(t *testing.T) {
+	received := map[string][]template.Metadata{}
+	handler := func(name string) MessageHandler {
+		return func(topic, message string, metadata template.Metadata) (*streamer.OutputMessage, error) {
+			received[name] = append(received[name], metadata)
+			return nil, nil
+		}
+	}
+
+	client := newTestClient()
+	plant := newTestClient()
+	app := &Service{
+		Client:     client,
+		Brokers:    map[string]mqtt.Client{"plant": plant},
+		subscribed: true,
+	}
+	err := app.applyRoutes([]string{"routes.yaml"}, map[string][]RouteHandler{
+		"routes.yaml": {
+			{Route: routes.Route{Name: "local", Topics: []routes.Topic{{Topic: "in"}}}, Handler: handler("local")},
+			{Route: routes.Route{Name: "plant", Topics: []routes.Topic{{Topic: "in", Broker: "plant"}}}, Handler: handler("plant")},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]byte{"in": 1}, client.subscribed)
+	assert.Equal(t, map[string]byte{"in": 1}, plant.subscribed)
+
+	app.onMessage(nil, &testMessage{topic: "in", payload: []byte("{}")})
+	app.dispatch("plant", &testMessage{topic: "in", payload: []byte("{}")})
+	app.dispatch("other", &testMessage{topic: "in", payload: []byte("{}")})
+
+	assert.Len(t, received["local"], 1)
+	assert.Equal(t, "", received["local"][0].Envelope.Broker)
+	assert.Len(t, received["plant"], 1)
+	assert.Equal(t, "plant", received["plant"][0].Envelope.Broker)
+}
+
+func Test_AddUnreachableBroker(t *testing.T) {
+	app := &Service{Health: NewHealth(time.Minute)}
+
+	// The service is started without the broker, and is degraded until the broker is connected
+	err := app.AddBroker("plant", "127.0.0.1:1", "test_plant", true, false, MQTTOptions{ProtocolVersion: MQTTVersion5})
+	assert.NoError(t, err)
+	defer app.Brokers["plant"].Disconnect(0)
+	assert.Contains(t, app.Brokers, "plant")
+	status := app.Health.Status(false)
+	assert.Equal(t, HealthDegraded, status.Status)
+	assert.Equal(t, []string{"plant"}, status.DisconnectedBrokers)
+
+	// Subscriptions are made once connected
+	app.BrokerSubscriptions = map[string]map[string]byte{"plant": {"in": 1}}
+	assert.NoError(t, app.StartSubscriptions())
+}
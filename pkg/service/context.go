@@ -0,0 +1,81 @@
+package service
+
+import (
+	"maps"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/tidwall/gjson"
+)
+
+// User properties which carry the routing context when using MQTT v5
+const (
+	ContextLevelProperty = "_ctx.lvl"
+	ContextTraceProperty = "_ctx.trace"
+)
+
+// The routing context is carried by the message properties if the client supports them (MQTT v5),
+// otherwise it is added to the payload
+func propertiesContext(client mqtt.Client) bool {
+	_, ok := client.(PropertiesPublisher)
+	return ok
+}
+
+// Routing context carried by the message properties, or nil if the properties do not include a context
+func contextFromProperties(props *template.Properties) *template.Context {
+	if props == nil {
+		return nil
+	}
+	level, ok := props.UserProperties[ContextLevelProperty]
+	if !ok {
+		return nil
+	}
+	ctx := &template.Context{}
+	ctx.Level, _ = strconv.Atoi(level)
+	if trace := props.UserProperties[ContextTraceProperty]; trace != "" {
+		ctx.Trace = strings.Split(trace, ",")
+	}
+	return ctx
+}
+
+// Routing context of a received message. The context of the payload is used if the
+// message properties do not include a context (e.g. it was published by a MQTT v3 client)
+func inputContext(message string, metadata template.Metadata) template.Context {
+	if metadata.Context != nil {
+		return *metadata.Context
+	}
+	ctx := template.Context{
+		Level: int(gjson.Get(message, "_ctx.lvl").Int()),
+	}
+	for _, name := range gjson.Get(message, "_ctx.trace").Array() {
+		ctx.Trace = append(ctx.Trace, name.String())
+	}
+	return ctx
+}
+
+// Set the routing context of the message properties. The context is removed if ctx is nil
+func withContext(props *template.Properties, ctx *template.Context) *template.Properties {
+	out := &template.Properties{}
+	if props != nil {
+		*out = *props
+	}
+	out.UserProperties = maps.Clone(out.UserProperties)
+	if out.UserProperties == nil {
+		out.UserProperties = map[string]string{}
+	}
+
+	if ctx == nil {
+		delete(out.UserProperties, ContextLevelProperty)
+		delete(out.UserProperties, ContextTraceProperty)
+		return out
+	}
+	out.UserProperties[ContextLevelProperty] = strconv.Itoa(ctx.Level)
+	if len(ctx.Trace) > 0 {
+		out.UserProperties[ContextTraceProperty] = strings.Join(ctx.Trace, ",")
+	} else {
+		delete(out.UserProperties, ContextTraceProperty)
+	}
+	return out
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/errors"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/streamer"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ContextProperties(t *testing.T) {
+	props := withContext(&template.Properties{
+		ContentType:    "application/json",
+		UserProperties: map[string]string{"source": "child01"},
+	}, &template.Context{Level: 2, Trace: []string{"a", "b"}})
+	assert.Equal(t, "application/json", props.ContentType)
+	assert.Equal(t, map[string]string{
+		"source":             "child01",
+		ContextLevelProperty: "2",
+		ContextTraceProperty: "a,b",
+	}, props.UserProperties)
+	assert.Equal(t, &template.Context{Level: 2, Trace: []string{"a", "b"}}, contextFromProperties(props))
+
+	// Remove the context
+	props = withContext(props, nil)
+	assert.Equal(t, map[string]string{"source": "child01"}, props.UserProperties)
+	assert.Nil(t, contextFromProperties(props))
+	assert.Nil(t, contextFromProperties(nil))
+
+	// The payload context is used if the properties do not include a context
+	assert.Equal(t, template.Context{Level: 3}, inputContext(`{"_ctx": {"lvl": 3}}`, template.Metadata{}))
+	assert.Equal(t, template.Context{Level: 1, Trace: []string{"a"}}, inputContext(`{"_ctx": {"lvl": 3}}`, template.Metadata{
+		Context: &template.Context{Level: 1, Trace: []string{"a"}},
+	}))
+}
+
+func Test_PropertiesContextLoopProtection(t *testing.T) {
+	route := routes.Route{
+		Name:   "recursive",
+		Topics: []routes.Topic{{Topic: "in"}},
+		Template: routes.Template{
+			Type: "jsonnet",
+			Value: heredoc.Doc(`
+				{
+					topic: 'in',
+					message: {value: ctx.lvl},
+				}
+			`),
+		},
+	}
+	client := &propertiesClient{testClient: newTestClient(), props: map[string]*template.Properties{}}
+	handler, err := NewStreamFactory(client, nil, route, nil, 2)
+	assert.NoError(t, err)
+
+	msg := &streamer.OutputMessage{Topic: "in", Message: `{}`}
+	iterations := 0
+	for iterations < 5 {
+		msg, err = handler(msg.Topic, msg.MessageString(), template.Metadata{
+			Properties: msg.Properties,
+			Context:    contextFromProperties(msg.Properties),
+		})
+		if err != nil {
+			break
+		}
+		iterations++
+
+		// The payload is not modified
+		assert.JSONEq(t, fmt.Sprintf(`{"value": %d}`, iterations-1), msg.MessageString())
+		assert.JSONEq(t, msg.MessageString(), string(client.published["in"]))
+		assert.Equal(t, msg.Properties, client.props["in"])
+	}
+	assert.Equal(t, 2, iterations)
+	assert.ErrorIs(t, err, errors.ErrRecursiveLevelExceeded)
+	assert.Equal(t, map[string]string{
+		ContextLevelProperty: "2",
+		ContextTraceProperty: "recursive,recursive",
+	}, client.props["in"].UserProperties)
+}
+
+func Test_PropertiesContextIsSharedWithAPIResponses(t *testing.T) {
+	client := &propertiesClient{testClient: newTestClient(), props: map[string]*template.Properties{}}
+	s := newAPISender(client, nil, nil, nil, nil, nil, nil, "test", nil, "deadletter")
+
+	ctx, err := json.Marshal(template.Context{Level: 1, Trace: []string{"test"}})
+	assert.NoError(t, err)
+	s.respond(APIRequest{ResponseTopic: "response", Context: ctx}, nil, nil)
+
+	assert.NotContains(t, string(client.published["response"]), "_ctx")
+	assert.Equal(t, &template.Context{Level: 1, Trace: []string{"test"}}, contextFromProperties(client.props["response"]))
+}
@@ -0,0 +1,336 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/ratelimit"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/storage"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/teris-io/shortid"
+)
+
+const (
+	DelayedMQTTMessage = "mqtt"
+	DelayedAPIRequest  = "api"
+)
+
+// DelayedMessage is a MQTT message or api request which is sent after a delay
+type DelayedMessage struct {
+	ID    string `json:"id"`
+	Route string `json:"route,omitempty"`
+	// File of the route, as route names are only unique within a file
+	RouteFile string `json:"route_file,omitempty"`
+	Type      string `json:"type"`
+
+	// MQTT message
+	Topic   string `json:"topic,omitempty"`
+	QoS     byte   `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	// MQTT v5 properties of the message
+	Properties *template.Properties `json:"properties,omitempty"`
+	// Name of the broker the message is published to. Empty for the main broker
+	Broker string `json:"broker,omitempty"`
+
+	// API request, and the context which is shared with the response
+	Request *APIRequest     `json:"request,omitempty"`
+	Context json.RawMessage `json:"ctx,omitempty"`
+	// Retry settings and dead-letter topic of the route
+	Retry           *routes.Retry `json:"retry,omitempty"`
+	DeadLetterTopic string        `json:"dead_letter_topic,omitempty"`
+
+	Created time.Time `json:"created"`
+	Due     time.Time `json:"due"`
+}
+
+// The api request, including the context which is shared with the response
+func (m DelayedMessage) request() APIRequest {
+	request := *m.Request
+	request.Context = m.Context
+	return request
+}
+
+// Target describes where the message will be sent to
+func (m DelayedMessage) Target() string {
+	if m.Type == DelayedAPIRequest && m.Request != nil {
+		target := strings.ToUpper(m.Request.Method) + " " + m.Request.Path
+		if m.Request.Endpoint != "" {
+			target = m.Request.Endpoint + ": " + target
+		}
+		return target
+	}
+	return m.Topic
+}
+
+// Default interval used to retry sending a delayed message which could not be sent
+const DefaultDelayedRetryInterval = 10 * time.Second
+
+// Maximum time to wait for a delayed message to be published
+const delayedPublishTimeout = 10 * time.Second
+
+// errRateLimited is returned when a delayed message has to wait for the rate limit of its route.
+// The message is kept by the delay queue until the rate limit allows it to be sent
+var errRateLimited = errors.New("rate limit exceeded")
+
+type rateLimitedError struct {
+	wait time.Duration
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("%s. retry in %s", errRateLimited, e.wait)
+}
+
+func (e *rateLimitedError) Unwrap() error {
+	return errRateLimited
+}
+
+// DelayQueue persists delayed messages so that they are still sent if the
+// service is restarted before the delay has elapsed
+type DelayQueue struct {
+	store *storage.Store
+	send  func(DelayedMessage) error
+	// Interval used to retry sending a message which could not be sent
+	retryInterval time.Duration
+
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+	stopped bool
+}
+
+// Open the delay queue stored in the given directory. The send function is called
+// when a message is due, and the message is only removed once it was sent successfully.
+// A queue without a send function can only be used to inspect or cancel messages
+func NewDelayQueue(dir string, send func(DelayedMessage) error) (*DelayQueue, error) {
+	store, err := storage.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &DelayQueue{
+		store:         store,
+		send:          send,
+		retryInterval: DefaultDelayedRetryInterval,
+		timers:        map[string]*time.Timer{},
+	}, nil
+}
+
+// Schedule a message to be sent after the delay
+func (q *DelayQueue) Schedule(m DelayedMessage, delay time.Duration) (DelayedMessage, error) {
+	if m.ID == "" {
+		id, err := shortid.Generate()
+		if err != nil {
+			return m, err
+		}
+		m.ID = id
+	}
+	m.Created = time.Now()
+	m.Due = m.Created.Add(delay)
+
+	if err := q.store.Put(m.ID, m); err != nil {
+		return m, fmt.Errorf("could not persist delayed message. %w", err)
+	}
+	slog.Info("Scheduled delayed message.", "id", m.ID, "route", m.Route, "target", m.Target(), "due", m.Due.Format(time.RFC3339))
+	q.schedule(m)
+	return m, nil
+}
+
+func (q *DelayQueue) schedule(m DelayedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return
+	}
+	if timer, ok := q.timers[m.ID]; ok {
+		timer.Stop()
+	}
+	q.timers[m.ID] = time.AfterFunc(time.Until(m.Due), func() { q.fire(m.ID) })
+}
+
+func (q *DelayQueue) fire(id string) {
+	q.mu.Lock()
+	delete(q.timers, id)
+	q.mu.Unlock()
+
+	m := DelayedMessage{}
+	if err := q.store.Get(id, &m); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			slog.Info("Delayed message was cancelled.", "id", id)
+		} else {
+			slog.Warn("Could not read delayed message.", "id", id, "error", err)
+		}
+		return
+	}
+
+	if q.send == nil {
+		return
+	}
+
+	slog.Info("Sending delayed message.", "id", m.ID, "route", m.Route, "target", m.Target())
+	if err := q.send(m); err != nil {
+		// Keep the message, so it is not lost if the service is restarted before it was sent
+		retry := q.retryInterval
+		var limited *rateLimitedError
+		if errors.As(err, &limited) {
+			retry = limited.wait
+			slog.Info("Delayed message is waiting for the rate limit.", "id", m.ID, "route", m.Route, "target", m.Target(), "retry", retry)
+		} else {
+			slog.Warn("Could not send delayed message. Retrying later.", "id", m.ID, "route", m.Route, "target", m.Target(), "retry_interval", retry, "error", err)
+		}
+		m.Due = time.Now().Add(retry)
+		q.schedule(m)
+		return
+	}
+
+	if err := q.store.Delete(id); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		slog.Warn("Could not remove delayed message.", "id", id, "error", err)
+	}
+}
+
+// Start rescheduling the messages which were persisted by a previous run.
+// Messages which are already due are sent immediately
+func (q *DelayQueue) Start() error {
+	messages, err := q.List()
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.stopped = false
+	q.mu.Unlock()
+	for _, m := range messages {
+		slog.Info("Restoring delayed message.", "id", m.ID, "route", m.Route, "target", m.Target(), "due", m.Due.Format(time.RFC3339))
+		q.schedule(m)
+	}
+	return nil
+}
+
+// Stop all of the timers. Pending messages are kept, and are rescheduled on the next start
+func (q *DelayQueue) Stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stopped = true
+	for id, timer := range q.timers {
+		timer.Stop()
+		delete(q.timers, id)
+	}
+}
+
+// Pending returns the number of scheduled messages
+func (q *DelayQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.timers)
+}
+
+// List the pending messages, ordered by when they are due
+func (q *DelayQueue) List() ([]DelayedMessage, error) {
+	ids, err := q.store.IDs()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]DelayedMessage, 0, len(ids))
+	for _, id := range ids {
+		m := DelayedMessage{}
+		if err := q.store.Get(id, &m); err != nil {
+			if !errors.Is(err, storage.ErrNotFound) {
+				slog.Warn("Ignoring invalid delayed message.", "id", id, "error", err)
+			}
+			continue
+		}
+		m.ID = id
+		messages = append(messages, m)
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Due.Before(messages[j].Due)
+	})
+	return messages, nil
+}
+
+// Cancel a pending message
+func (q *DelayQueue) Cancel(id string) error {
+	if err := q.store.Delete(id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("delayed message not found. id=%s", id)
+		}
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if timer, ok := q.timers[id]; ok {
+		timer.Stop()
+		delete(q.timers, id)
+	}
+	slog.Info("Cancelled delayed message.", "id", id)
+	return nil
+}
+
+// Send a delayed message using the service's clients, applying the rate limit of the message's route.
+// An error is returned if the message could not be sent, and sending should be retried later.
+// Messages which have to wait for the rate limit are not queued by the rate limiter, but are kept
+// by the delay queue, so they are not lost if the service is restarted whilst waiting
+func (s *Service) sendDelayed(m DelayedMessage) error {
+	switch decision, wait := s.RateLimiters.Try(routeKey(m.RouteFile, m.Route), m.Topic); decision {
+	case ratelimit.Allowed:
+		return s.sendDelayedNow(m)
+	case ratelimit.Queued:
+		return &rateLimitedError{wait: wait}
+	default:
+		// Dropped by the rate limit
+		return nil
+	}
+}
+
+func (s *Service) sendDelayedNow(m DelayedMessage) error {
+	switch m.Type {
+	case DelayedMQTTMessage:
+		client := s.Client
+		if m.Broker != DefaultBroker {
+			client = s.Brokers[m.Broker]
+		}
+		if client == nil {
+			slog.Warn("Could not send delayed message.", "id", m.ID, "broker", m.Broker, "error", ErrNoMQTTClient)
+			return nil
+		}
+		if !client.IsConnected() {
+			return ErrNotConnected
+		}
+		token := publish(client, m.Topic, m.QoS, m.Retain, m.Payload, m.Properties)
+		if !token.WaitTimeout(delayedPublishTimeout) {
+			return fmt.Errorf("timed out publishing message")
+		}
+		if err := token.Error(); err != nil {
+			return err
+		}
+		s.Metrics.Published(m.Route, "mqtt")
+	case DelayedAPIRequest:
+		if m.Request == nil {
+			slog.Warn("Delayed api request is empty.", "id", m.ID)
+			return nil
+		}
+		// Failed requests are retried (or buffered) by the api sender
+		s.apiSender(m).Request(m.request())()
+	default:
+		slog.Warn("Unknown delayed message type.", "id", m.ID, "type", m.Type)
+	}
+	return nil
+}
+
+// Replay an api request which was buffered whilst the api was unreachable
+func (s *Service) replayRequest(m DelayedMessage) bool {
+	if m.Request == nil {
+		slog.Warn("Buffered api request is empty.", "id", m.ID)
+		return true
+	}
+	return s.apiSender(m).replay(m.request())
+}
+
+func (s *Service) apiSender(m DelayedMessage) *apiSender {
+	return newAPISender(s.Client, s.APIClient, s.Endpoints, s.Outbox, s.Metrics, s.Health, s.Tasks, m.Route, m.Retry, m.DeadLetterTopic)
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DelayQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	queue, err := NewDelayQueue(dir, func(m DelayedMessage) error {
+		t.Errorf("message should not be sent before the restart. id=%s", m.ID)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	_, err = queue.Schedule(DelayedMessage{Type: DelayedMQTTMessage, Topic: "out/2", Payload: "2"}, 200*time.Millisecond)
+	assert.NoError(t, err)
+	_, err = queue.Schedule(DelayedMessage{Type: DelayedMQTTMessage, Topic: "out/1", Payload: "1"}, 100*time.Millisecond)
+	assert.NoError(t, err)
+	cancelled, err := queue.Schedule(DelayedMessage{Type: DelayedAPIRequest, Request: &APIRequest{Method: "POST", Path: "/event/events"}}, time.Hour)
+	assert.NoError(t, err)
+
+	messages, err := queue.List()
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 3) {
+		assert.Equal(t, "out/1", messages[0].Target())
+		assert.Equal(t, "out/2", messages[1].Target())
+		assert.Equal(t, "POST /event/events", messages[2].Target())
+	}
+
+	// Simulate a restart
+	queue.Stop()
+	sent := make(chan DelayedMessage, 10)
+	restarted, err := NewDelayQueue(dir, func(m DelayedMessage) error { sent <- m; return nil })
+	assert.NoError(t, err)
+	assert.NoError(t, restarted.Cancel(cancelled.ID))
+	assert.Error(t, restarted.Cancel(cancelled.ID))
+	assert.NoError(t, restarted.Start())
+
+	for _, expected := range []string{"out/1", "out/2"} {
+		select {
+		case m := <-sent:
+			assert.Equal(t, expected, m.Topic)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("delayed message was not sent. topic=%s", expected)
+		}
+	}
+
+	messages, err = restarted.List()
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func Test_DelayQueueCancelFromOtherProcess(t *testing.T) {
+	dir := t.TempDir()
+	sent := make(chan DelayedMessage, 10)
+	queue, err := NewDelayQueue(dir, func(m DelayedMessage) error { sent <- m; return nil })
+	assert.NoError(t, err)
+
+	m, err := queue.Schedule(DelayedMessage{Type: DelayedMQTTMessage, Topic: "out"}, 50*time.Millisecond)
+	assert.NoError(t, err)
+
+	// A queue without a send function is used by the cli to cancel messages
+	cli, err := NewDelayQueue(dir, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Cancel(m.ID))
+
+	select {
+	case <-sent:
+		t.Fatal("cancelled message should not be sent")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func Test_DelayQueueRetriesFailedMessages(t *testing.T) {
+	dir := t.TempDir()
+	attempts := make(chan DelayedMessage, 10)
+	var failed atomic.Bool
+	queue, err := NewDelayQueue(dir, func(m DelayedMessage) error {
+		attempts <- m
+		if failed.CompareAndSwap(false, true) {
+			return ErrNotConnected
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	queue.retryInterval = 100 * time.Millisecond
+	defer queue.Stop()
+
+	_, err = queue.Schedule(DelayedMessage{Type: DelayedMQTTMessage, Topic: "out"}, 10*time.Millisecond)
+	assert.NoError(t, err)
+
+	// The message is kept until it was sent successfully
+	select {
+	case <-attempts:
+	case <-time.After(time.Second):
+		t.Fatal("delayed message was not sent")
+	}
+	messages, err := queue.List()
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+
+	select {
+	case m := <-attempts:
+		assert.Equal(t, "out", m.Topic)
+	case <-time.After(time.Second):
+		t.Fatal("delayed message was not retried")
+	}
+	assert.Eventually(t, func() bool {
+		messages, err := queue.List()
+		return err == nil && len(messages) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_RateLimitedDelayedMessageSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	limiter, err := newRateLimiter(routes.Route{
+		Name:      "limited",
+		RateLimit: &routes.RateLimit{Rate: 0.001, Action: "queue"},
+	}, nil, nil)
+	assert.NoError(t, err)
+
+	client := newTestClient()
+	app := &Service{Client: client, RateLimiters: NewRateLimiters()}
+	app.RateLimiters.replace(map[string]*rateLimiter{routeKey("", "limited"): limiter})
+
+	queue, err := NewDelayQueue(dir, app.sendDelayed)
+	assert.NoError(t, err)
+	for _, topic := range []string{"out/1", "out/2"} {
+		_, err = queue.Schedule(DelayedMessage{Type: DelayedMQTTMessage, Route: "limited", Topic: topic, Payload: topic}, 10*time.Millisecond)
+		assert.NoError(t, err)
+	}
+
+	// Only one message is allowed, and the other waits for the rate limit in the delay queue
+	assert.Eventually(t, func() bool {
+		messages, err := queue.List()
+		return err == nil && len(messages) == 1
+	}, time.Second, 10*time.Millisecond)
+	queue.Stop()
+	client.mu.Lock()
+	assert.Len(t, client.published, 1)
+	client.mu.Unlock()
+
+	restarted, err := NewDelayQueue(dir, nil)
+	assert.NoError(t, err)
+	messages, err := restarted.List()
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/config"
+)
+
+var ErrUnknownEndpoint = errors.New("unknown endpoint")
+
+// Endpoints are named api clients which routes can select using the api.endpoint property
+type Endpoints map[string]*APIClient
+
+// Client returns the api client of the named endpoint, or the default client if the name is empty
+func (e Endpoints) Client(name string, defaultClient *APIClient) (*APIClient, error) {
+	if name == "" {
+		return defaultClient, nil
+	}
+	client, ok := e[name]
+	if !ok {
+		return nil, fmt.Errorf("%w. endpoint=%s", ErrUnknownEndpoint, name)
+	}
+	return client, nil
+}
+
+// Create the api clients for the configured endpoints
+func NewEndpoints(endpoints map[string]config.Endpoint) (Endpoints, error) {
+	clients := make(Endpoints, len(endpoints))
+	for name, endpoint := range endpoints {
+		client, err := NewEndpointClient(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint=%s. %w", name, err)
+		}
+		slog.Info("Registering endpoint.", "name", name, "url", endpoint.URL)
+		clients[name] = client
+	}
+	return clients, nil
+}
+
+// Create an api client for an endpoint. Authentication is added to each request
+// by the http transport rather than by the api client
+func NewEndpointClient(endpoint config.Endpoint) (*APIClient, error) {
+	if err := endpoint.Validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: endpoint.InsecureSkipVerify,
+	}
+	if endpoint.CAFile != "" {
+		pool, err := loadCertPool(endpoint.CAFile, "")
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	httpClient := &http.Client{
+		Timeout: endpoint.Timeout,
+		Transport: &endpointTransport{
+			auth:    endpoint.Auth,
+			headers: endpoint.Headers,
+			next:    transport,
+		},
+	}
+	return &APIClient{
+		Client:        c8y.NewClient(httpClient, endpoint.URL, "", "", "", true),
+		TransportAuth: true,
+	}, nil
+}
+
+// endpointTransport adds the endpoint's headers and authentication to each request
+type endpointTransport struct {
+	auth    *config.Auth
+	headers map[string]string
+	next    http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The request must not be modified, so a copy is used
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		if req.Header.Get(key) == "" {
+			req.Header.Set(key, value)
+		}
+	}
+
+	if t.auth != nil {
+		switch t.auth.Type {
+		case config.AuthBasic:
+			req.SetBasicAuth(t.auth.Username, t.auth.Password)
+		case config.AuthBearer:
+			req.Header.Set("Authorization", "Bearer "+t.auth.Token)
+		case config.AuthHMAC:
+			signature, err := t.sign(req)
+			if err != nil {
+				return nil, err
+			}
+			header := t.auth.Header
+			if header == "" {
+				header = config.DefaultSignatureHeader
+			}
+			req.Header.Set(header, signature)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// Sign the request body using HMAC-SHA256. The signature is formatted as sha256=<hex>
+func (t *endpointTransport) sign(req *http.Request) (string, error) {
+	body := []byte{}
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("could not read request body. %w", err)
+		}
+		body = b
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	mac := hmac.New(sha256.New, []byte(t.auth.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_EndpointAuthentication(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	body := `{"text":"hello"}`
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write([]byte(body))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	testcases := []struct {
+		Name    string
+		Auth    *config.Auth
+		Header  string
+		Expects string
+	}{
+		{Name: "basic", Auth: &config.Auth{Type: config.AuthBasic, Username: "user", Password: "pass"}, Header: "Authorization", Expects: "Basic dXNlcjpwYXNz"},
+		{Name: "bearer", Auth: &config.Auth{Type: config.AuthBearer, Token: "abc"}, Header: "Authorization", Expects: "Bearer abc"},
+		{Name: "hmac", Auth: &config.Auth{Type: config.AuthHMAC, Secret: "s3cr3t"}, Header: config.DefaultSignatureHeader, Expects: signature},
+		{Name: "hmac with custom header", Auth: &config.Auth{Type: config.AuthHMAC, Secret: "s3cr3t", Header: "X-Hub-Signature-256"}, Header: "X-Hub-Signature-256", Expects: signature},
+		{Name: "no auth", Header: "Authorization", Expects: ""},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.Name, func(t *testing.T) {
+			client, err := NewEndpointClient(config.Endpoint{
+				URL:     server.URL + "/hooks",
+				Auth:    c.Auth,
+				Headers: map[string]string{"X-Source": "tedge"},
+			})
+			assert.NoError(t, err)
+
+			raw := body
+			_, err = SendAPIRequest(client, APIRequest{Method: "POST", Path: "/message", RawBody: &raw, ContentType: "application/json"})
+			assert.NoError(t, err)
+
+			r := <-requests
+			assert.Equal(t, "/hooks/message", r.URL.Path)
+			assert.Equal(t, c.Expects, r.Header.Get(c.Header))
+			assert.Equal(t, "tedge", r.Header.Get("X-Source"))
+			assert.Equal(t, body, string(<-bodies))
+		})
+	}
+}
+
+func Test_EndpointCustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caFile, caPEM, 0644))
+
+	// The server's certificate is not trusted by default
+	client, err := NewEndpointClient(config.Endpoint{URL: server.URL})
+	assert.NoError(t, err)
+	_, err = SendAPIRequest(client, APIRequest{Method: "GET", Path: "/"})
+	assert.Error(t, err)
+
+	client, err = NewEndpointClient(config.Endpoint{URL: server.URL, CAFile: caFile})
+	assert.NoError(t, err)
+	_, err = SendAPIRequest(client, APIRequest{Method: "GET", Path: "/"})
+	assert.NoError(t, err)
+}
+
+func Test_UnknownEndpoint(t *testing.T) {
+	endpoints := Endpoints{"local": &APIClient{}}
+
+	client, err := endpoints.Client("", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, client)
+
+	client, err = endpoints.Client("local", nil)
+	assert.NoError(t, err)
+	assert.Same(t, endpoints["local"], client)
+
+	_, err = endpoints.Client("other", nil)
+	assert.ErrorIs(t, err, ErrUnknownEndpoint)
+}
@@ -8,18 +8,26 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/fatih/color"
 	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/config"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/errors"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/jsonnet"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/pipeline"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/streamer"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/pretty"
 	"github.com/tidwall/sjson"
@@ -27,74 +35,297 @@ import (
 
 var TedgeBinary = "tedge"
 
-func optionalDelay(delaySec float32, f func()) {
+func optionalDelay(tasks *Tasks, delaySec float32, f func()) {
 	// Don't bother with sub second delays
 	if delaySec > 0.9 {
-		time.AfterFunc(time.Duration(int(delaySec*1000))*time.Millisecond, f)
+		tasks.AfterFunc(time.Duration(int(delaySec*1000))*time.Millisecond, f)
 	} else {
 		f()
 	}
 }
 
-func WithMQTTPublisher(client mqtt.Client, topic string, qos byte, retain bool, message any) func() {
+func WithMQTTPublisher(client mqtt.Client, topic string, qos byte, retain bool, message any, props *template.Properties) func() {
 	return func() {
-		client.Publish(topic, qos, retain, message)
+		publish(client, topic, qos, retain, message, props)
 	}
 }
 
-func WithRESTRequest(client *APIClient, host, method, path string, message any) func() {
+func WithRESTRequest(client *APIClient, r APIRequest) func() {
 	return func() {
-		if err := SendAPIRequest(client, host, method, path, message); err != nil {
+		if _, err := SendAPIRequest(client, r); err != nil {
 			slog.Warn("Failed to send api request.", "error", err)
 		}
 	}
 }
 
+func mqttDelayedMessage(broker string, topic string, qos byte, retain bool, payload string, props *template.Properties) DelayedMessage {
+	return DelayedMessage{
+		Type:       DelayedMQTTMessage,
+		Broker:     broker,
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retain,
+		Payload:    payload,
+		Properties: props,
+	}
+}
+
+func apiDelayedMessage(r APIRequest, retry *routes.Retry, deadLetterTopic string) DelayedMessage {
+	return DelayedMessage{
+		Type:            DelayedAPIRequest,
+		Request:         &r,
+		Context:         r.Context,
+		Retry:           retry,
+		DeadLetterTopic: deadLetterTopic,
+	}
+}
+
 type VariablesFactory func() string
 
-func NewStreamFactory(client mqtt.Client, apiClient *APIClient, route routes.Route, variablesFactory VariablesFactory, maxDepth int, postDelay time.Duration, opts ...jsonnet.TemplateOption) MessageHandler {
+type FactoryOptions struct {
+	TemplateOptions []jsonnet.TemplateOption
+	DelayQueue      *DelayQueue
+	DeadLetterTopic string
+	Endpoints       Endpoints
+	Outbox          *Outbox
+	ErrorReporter   *ErrorReporter
+	Metrics         *metrics.Metrics
+	Health          *Health
+	Tasks           *Tasks
+	Brokers         map[string]mqtt.Client
+	RateLimiters    *RateLimiters
+}
+
+// Client used to publish messages to the named broker. The given client (of the main broker)
+// is used if the name is empty, or if no messages are published at all (e.g. client is nil)
+func (o *FactoryOptions) brokerClient(client mqtt.Client, name string) (mqtt.Client, error) {
+	if name == DefaultBroker || client == nil {
+		return client, nil
+	}
+	brokerClient, ok := o.Brokers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown broker. name=%s", name)
+	}
+	return brokerClient, nil
+}
+
+type FactoryOption func(*FactoryOptions)
+
+func WithTemplateOptions(opts ...jsonnet.TemplateOption) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.TemplateOptions = append(o.TemplateOptions, opts...)
+	}
+}
+
+// Persist delayed messages so that they are not lost if the service is restarted.
+// Without a delay queue, delayed messages are only kept in memory
+func WithDelayQueue(q *DelayQueue) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.DelayQueue = q
+	}
+}
+
+// Topic used to publish api requests which have failed permanently. The dead_letter_topic
+// of the route takes precedence
+func WithDeadLetterTopic(topic string) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.DeadLetterTopic = topic
+	}
+}
+
+// Buffer api requests whilst the api is unreachable, and replay them once it is reachable again
+func WithOutbox(outbox *Outbox) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.Outbox = outbox
+	}
+}
+
+// Publish processing errors of the route
+func WithErrorReporter(reporter *ErrorReporter) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.ErrorReporter = reporter
+	}
+}
+
+// Record the processing metrics of the route
+func WithMetrics(m *metrics.Metrics) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.Metrics = m
+	}
+}
+
+// Record the api failures of the route in the health status
+func WithHealth(h *Health) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.Health = h
+	}
+}
+
+// Track the delayed messages and api retries which are kept in memory, so they can be flushed on shutdown
+func WithTasks(t *Tasks) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.Tasks = t
+	}
+}
+
+// Named brokers which messages can be received from and published to
+func WithBrokers(brokers map[string]mqtt.Client) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.Brokers = brokers
+	}
+}
+
+// Registry of the rate limiters of the routes, so the limits are also applied when sending delayed messages
+func WithRateLimiters(limiters *RateLimiters) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.RateLimiters = limiters
+	}
+}
+
+// Named endpoints which api requests can be sent to
+func WithEndpoints(endpoints Endpoints) FactoryOption {
+	return func(o *FactoryOptions) {
+		o.Endpoints = endpoints
+	}
+}
+
+func NewStreamFactory(client mqtt.Client, apiClient *APIClient, route routes.Route, variablesFactory VariablesFactory, maxDepth int, factoryOpts ...FactoryOption) (MessageHandler, error) {
 
 	if maxDepth <= 0 {
 		maxDepth = 3
 	}
 
+	options := &FactoryOptions{}
+	for _, opt := range factoryOpts {
+		opt(options)
+	}
+	opts := options.TemplateOptions
+
+	for _, topic := range route.Topics {
+		if _, err := options.brokerClient(client, topic.Broker); err != nil {
+			return nil, err
+		}
+	}
+
+	limiter, err := newRateLimiter(route, options.Tasks, options.Metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := route.LoadTemplate()
+	if err != nil {
+		return nil, err
+	}
+	if path := route.TemplatePath(); path != "" {
+		opts = append(opts[:len(opts):len(opts)], jsonnet.WithFilename(path))
+	}
+
+	// MQTT v5 clients carry the routing context in the message properties, so the payload is not modified
+	usePropertiesContext := propertiesContext(client)
+	if usePropertiesContext {
+		opts = append(opts[:len(opts):len(opts)], jsonnet.WithPropertiesContext(true))
+	}
+
 	engine := jsonnet.NewEngine(
-		route.Template.Value,
+		tmpl,
 		opts...,
 	)
+	if err := engine.Compile(); err != nil {
+		return nil, err
+	}
 	stream := streamer.NewStreamer(engine)
 
 	if route.PreProcessor != nil {
-		route.PreparePreProcessor()
+		if err := route.PreparePreProcessor(); err != nil {
+			return nil, err
+		}
+	}
+
+	deadLetterTopic := route.DeadLetterTopic
+	if deadLetterTopic == "" {
+		deadLetterTopic = options.DeadLetterTopic
+	}
+	api := newAPISender(client, apiClient, options.Endpoints, options.Outbox, options.Metrics, options.Health, options.Tasks, route.Name, route.Retry, deadLetterTopic)
+
+	// Publish a message, which is counted once it has been accepted by the broker
+	publishMQTT := func(outputType string, target mqtt.Client, topic string, qos byte, retain bool, message any, props *template.Properties) func() {
+		return func() {
+			token := publish(target, topic, qos, retain, message, props)
+			if options.Metrics == nil {
+				return
+			}
+			go func() {
+				<-token.Done()
+				if token.Error() == nil {
+					options.Metrics.Published(route.Name, outputType)
+				}
+			}()
+		}
+	}
+
+	// Send a message now, or after its delay. The rate limit is applied when the message is sent
+	deliver := func(delaySec float32, delayed DelayedMessage, send func()) {
+		if options.DelayQueue != nil && delaySec > 0.9 {
+			delayed.Route = route.Name
+			delayed.RouteFile = route.File
+			delay := time.Duration(int(delaySec*1000)) * time.Millisecond
+			if _, err := options.DelayQueue.Schedule(delayed, delay); err != nil {
+				slog.Warn("Could not schedule delayed message.", "route", route.Name, "error", err)
+			}
+			return
+		}
+		optionalDelay(options.Tasks, delaySec, limiter.Wrap(delayed.Topic, send))
 	}
 
+	// The limiter is only used for delayed messages once the route is active (see applyRoutes)
+	options.RateLimiters.stage(routeKey(route.File, route.Name), limiter)
+
 	variablesFunc := func() string { return "" }
 
 	if variablesFactory != nil {
 		variablesFunc = variablesFactory
 	}
 
-	return func(topic, message string) (*streamer.OutputMessage, error) {
+	return func(topic, message string, metadata template.Metadata) (*streamer.OutputMessage, error) {
 		slog.Info("Route activated on message.", "route", route.Name, "topic", topic, "message", message)
+		options.Metrics.Matched(route.Name)
+
+		// Publish the error (with the original message)
+		input := message
+		report := func(stage string, err error) {
+			options.Metrics.Errored(route.Name, stage)
+			options.ErrorReporter.Report(NewRouteError(route.Name, stage, topic, input, err))
+		}
 
 		if route.HasPreprocessor() {
 			slog.Debug("Applying preprocessor to message")
 			v, err := route.ExecutePreprocessor(message)
 			if err != nil {
 				// TODO: Should preprocessor errors be logged instead of returning early
-				return nil, fmt.Errorf("preprocessor error. %s, message=%s", err, message)
+				// The message is already included in the reported error
+				err = fmt.Errorf("preprocessor error. %w", err)
+				report(StagePreprocessor, err)
+				return nil, err
 			} else {
 				slog.Debug("Preprocessor m.", "output", v)
 				message = v
 			}
 		}
 
-		sm, err := stream.Process(topic, message, variablesFunc())
+		inputCtx := inputContext(input, metadata)
+		if usePropertiesContext {
+			metadata.Context = &inputCtx
+		}
+
+		started := time.Now()
+		sm, err := stream.Process(topic, message, variablesFunc(), metadata)
+		options.Metrics.ObserveTemplate(route.Name, time.Since(started))
 		if err != nil {
 			slog.Error("Template error.", "route", route.Name)
 
 			// Print error to stderr directly as sometimes errors are nicely formatted
 			fmt.Fprint(os.Stderr, err.Error())
+			report(templateStage(err), err)
 			return nil, errors.ErrTemplateException
 		}
 
@@ -106,76 +337,130 @@ func NewStreamFactory(client mqtt.Client, apiClient *APIClient, route routes.Rou
 		output, err := json.Marshal(sm.Message)
 		if err != nil {
 			slog.Warn("Preprocessor error.", "error", err)
+			report(StageOutput, err)
 			return nil, err
 		}
 
 		// Check if there are any message to be sent before processing the main message
 		for _, m := range sm.Updates {
 			if m.Skip {
+				options.Metrics.Skipped(route.Name, metrics.SkipTemplate)
+				continue
+			}
+			target, err := options.brokerClient(client, m.Broker)
+			if err != nil {
+				slog.Warn("Invalid update message.", "error", err)
+				report(StageOutput, fmt.Errorf("invalid update message. topic=%s, %w", m.Topic, err))
 				continue
 			}
 			switch m.Message.(type) {
 			case string:
 				slog.Info("Publishing update message.", "topic", m.Topic, "message", m.Message)
-				if client != nil && !engine.DryRun() {
-					optionalDelay(m.Delay, WithMQTTPublisher(client, m.Topic, m.GetQoS(), m.Retain, m.Message))
+				if target != nil && !engine.DryRun() {
+					deliver(m.Delay, mqttDelayedMessage(m.Broker, m.Topic, m.GetQoS(), m.Retain, m.MessageString(), m.Properties), publishMQTT("update", target, m.Topic, m.GetQoS(), m.Retain, m.Message, m.Properties))
 				}
 			default:
 				preMsg, preErr := json.Marshal(m.Message)
 				if preErr != nil {
 					slog.Warn("Invalid update message.", "error", preErr)
+					report(StageOutput, fmt.Errorf("invalid update message. topic=%s, %w", m.Topic, preErr))
 				} else {
 					slog.Info("Publishing update message.", "topic", m.Topic, "message", string(preMsg))
-					if client != nil && !engine.DryRun() {
-						optionalDelay(m.Delay, WithMQTTPublisher(client, m.Topic, m.GetQoS(), m.Retain, preMsg))
+					if target != nil && !engine.DryRun() {
+						deliver(m.Delay, mqttDelayedMessage(m.Broker, m.Topic, m.GetQoS(), m.Retain, string(preMsg), m.Properties), publishMQTT("update", target, m.Topic, m.GetQoS(), m.Retain, preMsg, m.Properties))
 					}
 				}
 			}
 		}
 
+		var target mqtt.Client
+		if sm.IsMQTTMessage() {
+			target, err = options.brokerClient(client, sm.Broker)
+			if err != nil {
+				slog.Error("Invalid output message.", "error", err)
+				report(StageOutput, err)
+				return nil, err
+			}
+		}
+
 		// Apply depth limit to all messages, and not just a message
 		// which generates a message from the same topic to protect against
 		// infinite loops via multiple routes, e.g.: A -> B -> C -> A (not just A -> A)
-		if n := gjson.GetBytes(output, "_ctx.lvl"); n.Exists() {
-			if n.Int() > int64(maxDepth) {
-				slog.Warn("Nested level exceeded.", "topic", sm.Topic, "message", string(output), "limit", maxDepth)
+		var outputCtx *template.Context
+		if usePropertiesContext {
+			outputCtx = &template.Context{
+				Level: inputCtx.Level + 1,
+				Trace: append(slices.Clone(inputCtx.Trace), route.Name),
+			}
+			if outputCtx.Level > maxDepth {
+				slog.Warn("Nested level exceeded.", "topic", sm.Topic, "trace", outputCtx.Trace, "limit", maxDepth)
+				report(StageDepth, fmt.Errorf("%w. limit=%d", errors.ErrRecursiveLevelExceeded, maxDepth))
 				return nil, errors.ErrRecursiveLevelExceeded
 			}
-		}
 
-		if sm.End {
-			if o, err := sjson.SetBytes(output, "_ctx.lvl", maxDepth); err == nil {
-				output = o
-				slog.Info("Setting end message.", "topic", sm.Topic, "message", string(output))
+			if sm.End {
+				outputCtx.Level = maxDepth
+				slog.Info("Setting end message.", "topic", sm.Topic)
 			}
-		}
 
-		if sm.DisableContext() {
-			// TODO: Check that the message will not trigger other routes (since the infinite loop is being disabled)
-			if o, err := sjson.DeleteBytes(output, "_ctx"); err == nil {
-				output = o
-				slog.Info("Removing context from message.", "topic", sm.Topic, "message", string(output))
-			} else {
-				slog.Info("Failed to remove context from message.", "topic", sm.Topic, "message", string(output), "error", err)
+			if sm.DisableContext() {
+				outputCtx = nil
+				slog.Info("Removing context from message.", "topic", sm.Topic)
+			}
+
+			if sm.IsMQTTMessage() {
+				if target == nil || propertiesContext(target) {
+					sm.Properties = withContext(sm.Properties, outputCtx)
+				} else if outputCtx != nil && sm.RawMessage == nil && gjson.ValidBytes(output) && gjson.ParseBytes(output).IsObject() {
+					// The broker does not support properties (MQTT v3), so the context is added to
+					// the payload to keep the loop protection working across the brokers
+					if o, err := sjson.SetBytes(output, "_ctx", outputCtx); err == nil {
+						output = o
+					}
+				}
+			}
+		} else {
+			if n := gjson.GetBytes(output, "_ctx.lvl"); n.Exists() {
+				if n.Int() > int64(maxDepth) {
+					slog.Warn("Nested level exceeded.", "topic", sm.Topic, "message", string(output), "limit", maxDepth)
+					report(StageDepth, fmt.Errorf("%w. limit=%d", errors.ErrRecursiveLevelExceeded, maxDepth))
+					return nil, errors.ErrRecursiveLevelExceeded
+				}
+			}
+
+			if sm.End {
+				if o, err := sjson.SetBytes(output, "_ctx.lvl", maxDepth); err == nil {
+					output = o
+					slog.Info("Setting end message.", "topic", sm.Topic, "message", string(output))
+				}
+			}
+
+			if sm.DisableContext() {
+				// TODO: Check that the message will not trigger other routes (since the infinite loop is being disabled)
+				if o, err := sjson.DeleteBytes(output, "_ctx"); err == nil {
+					output = o
+					slog.Info("Removing context from message.", "topic", sm.Topic, "message", string(output))
+				} else {
+					slog.Info("Failed to remove context from message.", "topic", sm.Topic, "message", string(output), "error", err)
+				}
 			}
 		}
 
 		// TODO: Switch to using the .MessageString() method
-		useDelay := false
 		if sm.IsMQTTMessage() {
 			if sm.Skip {
 				slog.Info("skip.", "topic", sm.Topic, "message", string(output))
+				options.Metrics.Skipped(route.Name, metrics.SkipTemplate)
 			} else {
-				useDelay = true
 				if sm.RawMessage != nil {
 					slog.Info("Publishing new raw message.", "topic", sm.Topic, "message", *sm.RawMessage, "retain", sm.Retain, "delay", sm.Delay)
-					if client != nil && !engine.DryRun() {
-						optionalDelay(sm.Delay, WithMQTTPublisher(client, sm.Topic, sm.GetQoS(), sm.Retain, *sm.RawMessage))
+					if target != nil && !engine.DryRun() {
+						deliver(sm.Delay, mqttDelayedMessage(sm.Broker, sm.Topic, sm.GetQoS(), sm.Retain, *sm.RawMessage, sm.Properties), publishMQTT("mqtt", target, sm.Topic, sm.GetQoS(), sm.Retain, *sm.RawMessage, sm.Properties))
 					}
 				} else {
 					slog.Info("Publishing new message.", "topic", sm.Topic, "message", string(output), "delay", sm.Delay)
-					if client != nil && !engine.DryRun() {
-						optionalDelay(sm.Delay, WithMQTTPublisher(client, sm.Topic, sm.GetQoS(), sm.Retain, output))
+					if target != nil && !engine.DryRun() {
+						deliver(sm.Delay, mqttDelayedMessage(sm.Broker, sm.Topic, sm.GetQoS(), sm.Retain, string(output), sm.Properties), publishMQTT("mqtt", target, sm.Topic, sm.GetQoS(), sm.Retain, output, sm.Properties))
 					}
 				}
 			}
@@ -184,52 +469,85 @@ func NewStreamFactory(client mqtt.Client, apiClient *APIClient, route routes.Rou
 		if sm.IsAPIRequest() {
 			if sm.API.Skip {
 				slog.Info("skip api.", "topic", sm.Topic, "message", string(output))
+				options.Metrics.Skipped(route.Name, metrics.SkipTemplate)
 			} else {
-				useDelay = true
 				if err := sm.API.Validate(); err != nil {
 					slog.Error("Invalid api request.", "error", err)
+					report(StageAPI, fmt.Errorf("invalid api request. %w", err))
+					return nil, err
+				}
+				if _, err := options.Endpoints.Client(sm.API.Endpoint, apiClient); err != nil {
+					slog.Error("Invalid api request.", "error", err)
+					report(StageAPI, fmt.Errorf("invalid api request. %w", err))
 					return nil, err
 				}
 				if !engine.DryRun() {
-					optionalDelay(sm.Delay, WithRESTRequest(apiClient, sm.API.Host, sm.API.Method, sm.API.Path, sm.API.Body))
+					request := NewAPIRequest(sm.API)
+					// Share the context with the response so that loop protection still applies
+					if usePropertiesContext {
+						if outputCtx != nil {
+							request.Context, _ = json.Marshal(outputCtx)
+						}
+					} else if ctx := gjson.GetBytes(output, "_ctx"); ctx.Exists() {
+						request.Context = json.RawMessage(ctx.Raw)
+					}
+					deliver(sm.Delay, apiDelayedMessage(request, route.Retry, deadLetterTopic), api.Request(request))
 				}
 			}
 		}
 
-		// Prevent posting to quickly
-		if useDelay {
-			time.Sleep(postDelay)
-		}
-
 		// Update modified output message (with updated context)
 		if err := json.Unmarshal(output, &sm.Message); err != nil {
+			report(StageOutput, err)
 			return nil, err
 		}
 
 		return sm, nil
-	}
+	}, nil
 }
 
-func SendAPIRequest(client *APIClient, host, method, path string, body any) (err error) {
+// Send an api request. The response is returned (if one was received) even if the request failed
+func SendAPIRequest(client *APIClient, r APIRequest) (*c8y.Response, error) {
 	if client == nil {
-		return fmt.Errorf("api client is not set")
+		return nil, fmt.Errorf("api client is not set")
+	}
+
+	body, err := r.body()
+	if err != nil {
+		return nil, err
 	}
 
 	opt := c8y.RequestOptions{
-		Host:             host,       // if host is empty, then the default host in the c8y client is used
-		NoAuthentication: host != "", // but don't send the auth token to prevent sending credentials to potentially unsecured service
-		Method:           method,
-		Path:             path,
-		Accept:           "application/json",
+		Host:             r.Host,                               // if host is empty, then the default host in the c8y client is used
+		NoAuthentication: r.Host != "" || client.TransportAuth, // but don't send the auth token to prevent sending credentials to potentially unsecured service
+		Method:           strings.ToUpper(r.Method),
+		Path:             r.Path,
+		Query:            r.query(),
+		ContentType:      r.contentType(),
 		Body:             body,
+		Header:           http.Header{},
+	}
+	// The client always sets the accept header to json, so a custom value is set as a header
+	if r.Accept != "" {
+		opt.Header.Set("Accept", r.Accept)
+	}
+	for key, value := range r.Headers {
+		opt.Header.Set(key, value)
 	}
 
-	resp, err := client.SendRequest(context.Background(), opt)
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	resp, err := client.SendRequest(ctx, opt)
 	if err != nil {
-		return err
+		return resp, err
 	}
 	slog.Info("Sent request.", "response", resp.JSON().Raw)
-	return nil
+	return resp, nil
 }
 
 type MetaOption func(m map[string]any)
@@ -332,7 +650,6 @@ type DefaultServiceOptions struct {
 	HTTPEndpoint               string
 	RouteDirs                  []string
 	MaxRouteDepth              int
-	PostMessageDelay           time.Duration
 	Debug                      bool
 	DryRun                     bool
 	MetaOptions                []MetaOption
@@ -340,16 +657,89 @@ type DefaultServiceOptions struct {
 	UseColor                   bool
 	EntityFile                 string
 	EnableRegistrationListener bool
+	// Connection settings of the mqtt clients
+	MQTT MQTTOptions
+
+	// Number of workers used to process messages. Messages are processed
+	// in the mqtt client's callback if set to 0
+	Workers int
+	// Maximum number of messages waiting to be processed
+	QueueSize int
+	// Behavior when the queue is full
+	QueuePolicy pipeline.Policy
+	// Key used to preserve the order of messages, "topic" or "device"
+	OrderingKey string
+	// Number of jsonnet vms per route. Defaults to the number of workers
+	VMPoolSize int
+	// Rate limit used by routes which don't define their own rate limit
+	DefaultRateLimit *routes.RateLimit
+	// Directory used to persist state, e.g. delayed messages
+	StateDir string
+	// Topic used to publish api requests which have failed permanently
+	DeadLetterTopic string
+	// Named http endpoints which routes can send api requests to
+	Endpoints map[string]config.Endpoint
+	// Named broker connections which routes can receive messages from and publish messages to
+	Brokers map[string]config.Broker
+	// Maximum number of api requests which are buffered whilst the api is unreachable.
+	// Requests are not buffered if set to 0
+	OutboxSize int
+	// Maximum age of buffered api requests
+	OutboxMaxAge time.Duration
+	// Topic used to detect if the cloud bridge is up or down
+	BridgeHealthTopic string
+	// Topic used to publish processing errors of the routes. Errors are not published if empty
+	ErrorTopic string
+	// Maximum number of errors which are published per second
+	ErrorRate float64
+	// Prometheus metrics. If nil, no metrics are recorded
+	Metrics *metrics.Metrics
 }
 
 func NewDefaultService(opts *DefaultServiceOptions) (*Service, error) {
-	app, err := NewService(opts.Broker, opts.ClientID, opts.CleanSession, opts.HTTPEndpoint, opts.DryRun)
+	app, err := NewService(opts.Broker, opts.ClientID, opts.CleanSession, opts.HTTPEndpoint, opts.DryRun, opts.MQTT)
 	if err != nil {
 		return nil, err
 	}
 
+	endpoints, err := NewEndpoints(opts.Endpoints)
+	if err != nil {
+		return nil, err
+	}
+	app.Endpoints = endpoints
+
+	brokerNames := make([]string, 0, len(opts.Brokers))
+	for name := range opts.Brokers {
+		brokerNames = append(brokerNames, name)
+	}
+	sort.Strings(brokerNames)
+	for _, name := range brokerNames {
+		broker := opts.Brokers[name]
+		brokerOptions := opts.MQTT
+		brokerOptions.MQTT = broker.MQTT
+		if broker.Version != 0 {
+			brokerOptions.ProtocolVersion = broker.Version
+		}
+		clientID := broker.ClientID
+		if clientID == "" {
+			clientID = opts.ClientID + "_" + name
+		}
+		if err := app.AddBroker(name, broker.Host, clientID, opts.CleanSession, opts.DryRun, brokerOptions); err != nil {
+			return nil, err
+		}
+	}
+
 	meta := NewMetaData(opts.MetaOptions...)
 
+	if opts.Workers > 0 {
+		orderingKey, err := pipeline.ParseKeyFunc(opts.OrderingKey)
+		if err != nil {
+			return nil, err
+		}
+		app.OrderingKey = orderingKey
+		app.Pipeline = pipeline.New(opts.Workers, opts.QueueSize, opts.QueuePolicy)
+	}
+
 	if opts.EntityFile != "" {
 		if _, err := os.Stat(opts.EntityFile); err == nil {
 			entityFileContents, readErr := os.ReadFile(opts.EntityFile)
@@ -362,10 +752,31 @@ func NewDefaultService(opts *DefaultServiceOptions) (*Service, error) {
 	}
 
 	// Handle entity registration independently
-	registrationClient := mqtt.NewClient(mqtt.NewClientOptions().SetClientID(opts.ClientID + "_regListener").AddBroker(opts.Broker).SetCleanSession(opts.CleanSession))
-	if token := registrationClient.Connect(); !token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+	regTopics := map[string]byte{
+		"te/+/+/+/+": 1,
+	}
+	onRegistrationConnect := func(c mqtt.Client, reconnect bool) {
+		if !reconnect || !opts.EnableRegistrationListener {
+			return
+		}
+		// The callback is still registered with the client, so only the broker needs to be updated
+		if token := c.SubscribeMultiple(regTopics, nil); token.Wait() && token.Error() != nil {
+			slog.Warn("Could not restore registration subscription after reconnecting.", "topics", regTopics, "error", token.Error())
+		}
+	}
+	registrationClient, err := opts.MQTT.newClient(opts.Broker, opts.ClientID+"_regListener", opts.CleanSession, clientHandlers{
+		OnConnect: onRegistrationConnect,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if token := registrationClient.Connect(); !token.WaitTimeout(DefaultBrokerConnectTimeout) || token.Error() != nil {
+		if err := token.Error(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("timeout connecting registration client. broker=%s", opts.Broker)
 	}
+	app.RegistrationClient = registrationClient
 
 	if opts.EnableRegistrationListener {
 		registerCallback := func(c mqtt.Client, m mqtt.Message) {
@@ -380,7 +791,7 @@ func NewDefaultService(opts *DefaultServiceOptions) (*Service, error) {
 
 			entity := Entity{}
 			if err := json.Unmarshal(m.Payload(), &entity); err != nil {
-				slog.Warn("Invalid registration payload.", err)
+				slog.Warn("Invalid registration payload.", "error", err)
 				return
 			}
 
@@ -394,45 +805,149 @@ func NewDefaultService(opts *DefaultServiceOptions) (*Service, error) {
 			slog.Info("Registered entity successfully", "entity", slog.StringValue(fmt.Sprintf("%#v", entity)))
 		}
 
-		regTopics := map[string]byte{
-			"te/+/+/+/+": 1,
-		}
 		if token := registrationClient.SubscribeMultiple(regTopics, registerCallback); token.Wait() && token.Error() != nil {
 			return nil, fmt.Errorf("error subscribing to topic '%v': %v", regTopics, token.Error())
 		}
 	}
 
-	routes := app.ScanMappingFiles(opts.RouteDirs)
-	for _, route := range routes {
-		if !route.Skip {
-			slog.Info("Registering route.", "name", route.Name, "topics", route.DisplayTopics())
-			err = app.Register(
-				route.Topics,
-				1,
-				NewStreamFactory(
-					app.Client,
-					app.APIClient,
-					route,
-					app.GetVariables,
-					opts.MaxRouteDepth,
-					opts.PostMessageDelay,
-					jsonnet.WithMetaData(meta),
-					jsonnet.WithDebug(opts.Debug),
-					jsonnet.WithDryRun(opts.DryRun),
-					jsonnet.WithLibraryPaths(opts.LibraryPaths...),
-					jsonnet.WithColorStackTrace(opts.UseColor),
-				),
-			)
-			if err != nil {
-				slog.Warn("Failed to register route. It will be ignored.", "name", route.Name, "error", err)
-			}
+	vmPoolSize := opts.VMPoolSize
+	if vmPoolSize <= 0 {
+		vmPoolSize = max(opts.Workers, 1)
+	}
+
+	if opts.StateDir != "" && !opts.DryRun {
+		delayQueue, err := NewDelayQueue(filepath.Join(opts.StateDir, "delayed"), app.sendDelayed)
+		if err != nil {
+			slog.Warn("Could not open delay queue. Delayed messages will not be persisted.", "error", err)
 		} else {
-			slog.Info("Ignoring route marked as skip.", "name", route.Name, "topics", route.DisplayTopics())
+			app.DelayQueue = delayQueue
+		}
+	}
+
+	if opts.StateDir != "" && !opts.DryRun && opts.OutboxSize > 0 {
+		outbox, err := NewOutbox(filepath.Join(opts.StateDir, "outbox"), opts.OutboxSize, opts.OutboxMaxAge, app.replayRequest)
+		if err != nil {
+			slog.Warn("Could not open outbox. Api requests will not be buffered whilst offline.", "error", err)
+		} else {
+			app.Outbox = outbox
+		}
+	}
+
+	app.Metrics = opts.Metrics
+	app.registerMetrics()
+
+	var errorReporter *ErrorReporter
+	if opts.ErrorTopic != "" && !opts.DryRun {
+		errorRate := opts.ErrorRate
+		if errorRate <= 0 {
+			errorRate = DefaultRouteErrorRate
+		}
+		errorReporter = NewErrorReporter(app.Client, opts.ErrorTopic, errorRate, DefaultRouteErrorBurst)
+	}
+
+	app.LibraryPaths = opts.LibraryPaths
+	app.NewHandler = func(route routes.Route) (MessageHandler, error) {
+		if route.RateLimit == nil {
+			route.RateLimit = opts.DefaultRateLimit
+		}
+		return NewStreamFactory(
+			app.Client,
+			app.APIClient,
+			route,
+			app.GetVariables,
+			opts.MaxRouteDepth,
+			WithDelayQueue(app.DelayQueue),
+			WithDeadLetterTopic(opts.DeadLetterTopic),
+			WithEndpoints(app.Endpoints),
+			WithOutbox(app.Outbox),
+			WithErrorReporter(errorReporter),
+			WithMetrics(app.Metrics),
+			WithHealth(app.Health),
+			WithTasks(app.Tasks),
+			WithBrokers(app.Brokers),
+			WithRateLimiters(app.RateLimiters),
+			WithTemplateOptions(
+				jsonnet.WithMetaData(meta),
+				jsonnet.WithDebug(opts.Debug),
+				jsonnet.WithDryRun(opts.DryRun),
+				jsonnet.WithLibraryPaths(opts.LibraryPaths...),
+				jsonnet.WithColorStackTrace(opts.UseColor),
+				jsonnet.WithVMPoolSize(vmPoolSize),
+			),
+		)
+	}
+	if err := app.ReloadRoutes(opts.RouteDirs); err != nil {
+		return nil, err
+	}
+
+	if app.DelayQueue != nil {
+		if err := app.DelayQueue.Start(); err != nil {
+			slog.Warn("Could not restore delayed messages.", "error", err)
+		}
+	}
+
+	if app.Outbox != nil {
+		if opts.BridgeHealthTopic != "" {
+			onBridgeHealth := func(c mqtt.Client, m mqtt.Message) {
+				app.Outbox.OnBridgeHealth(m.Payload())
+			}
+			if err := app.subscribeWith(map[string]byte{opts.BridgeHealthTopic: 1}, onBridgeHealth); err != nil {
+				slog.Warn("Could not subscribe to the bridge health topic.", "topic", opts.BridgeHealthTopic, "error", err)
+			}
+		}
+		if pending := app.Outbox.Pending(); pending > 0 {
+			slog.Info("Replaying buffered api requests from a previous run.", "pending", pending)
+		}
+		app.Outbox.Start()
+	}
+
+	if !opts.DryRun {
+		if err := app.subscribeHealthCheck(); err != nil {
+			slog.Warn("Could not subscribe to the health check topics.", "error", err)
 		}
 	}
 	return app, nil
 }
 
+// Register the service-wide metrics
+func (s *Service) registerMetrics() {
+	if s.Metrics == nil {
+		return
+	}
+	s.Metrics.Gauge("mqtt_connected", "MQTT connection state (1 = connected).", func() float64 {
+		if s.Client != nil && s.Client.IsConnectionOpen() {
+			return 1
+		}
+		return 0
+	})
+	s.Metrics.Gauge("routes", "Number of registered routes.", func() float64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return float64(len(s.handlers))
+	})
+	if s.Pipeline != nil {
+		s.Metrics.Gauge("queue_depth", "Number of messages waiting to be processed.", func() float64 {
+			return float64(s.Pipeline.Len())
+		})
+		s.Metrics.Counter("queue_dropped_total", "Number of messages dropped because the queue was full.", func() float64 {
+			return float64(s.Pipeline.Dropped())
+		})
+		s.Metrics.Counter("queue_rejected_total", "Number of messages rejected because the queue was full.", func() float64 {
+			return float64(s.Pipeline.Rejected())
+		})
+	}
+	if s.DelayQueue != nil {
+		s.Metrics.Gauge("delayed_messages_pending", "Number of delayed messages waiting to be sent.", func() float64 {
+			return float64(s.DelayQueue.Pending())
+		})
+	}
+	if s.Outbox != nil {
+		s.Metrics.Gauge("outbox_pending", "Number of api requests buffered whilst the api is unreachable.", func() float64 {
+			return float64(s.Outbox.Pending())
+		})
+	}
+}
+
 func DisplayMessage(name string, in, out *streamer.OutputMessage, w io.Writer, compact bool, useColor bool) bool {
 
 	header := color.New(color.Bold).Add(color.BgCyan)
@@ -441,6 +956,9 @@ func DisplayMessage(name string, in, out *streamer.OutputMessage, w io.Writer, c
 
 	fmt.Fprint(w, "\nInput Message\n")
 	fmt.Fprintf(w, "  %-10v%v\n", "topic:", in.Topic)
+	if in.Broker != "" {
+		fmt.Fprintf(w, "  %-10v%v\n", "broker:", in.Broker)
+	}
 
 	if !out.Skip {
 		// Display and update messages
@@ -453,6 +971,9 @@ func DisplayMessage(name string, in, out *streamer.OutputMessage, w io.Writer, c
 					} else {
 						fmt.Fprintf(w, "  %-10s%v\n", "topic:", update.Topic)
 					}
+					if update.Broker != "" {
+						fmt.Fprintf(w, "  %-10s%v\n", "broker:", update.Broker)
+					}
 					displayJsonMessage(w, update.Message, compact, useColor)
 				}
 			}
@@ -464,6 +985,9 @@ func DisplayMessage(name string, in, out *streamer.OutputMessage, w io.Writer, c
 	}
 	if out.IsMQTTMessage() && !out.Skip {
 		fmt.Fprintf(w, "  %-10s%v\n", "topic:", out.Topic)
+		if out.Broker != "" {
+			fmt.Fprintf(w, "  %-10s%v\n", "broker:", out.Broker)
+		}
 		if out.End {
 			fmt.Fprintf(w, "  %-10s%v\n", "end:", out.End)
 		}
@@ -472,10 +996,31 @@ func DisplayMessage(name string, in, out *streamer.OutputMessage, w io.Writer, c
 	if out.IsAPIRequest() && !out.API.Skip {
 		// API message don't chain, so no point printing the 'end' meta info
 		fmt.Fprintf(w, "\nOutput Message (%s)\n", out.GetType())
-		if body, err := json.Marshal(out.API.Body); err == nil {
-			fmt.Fprintf(w, "  %-10s%v %v %s\n", "request:", out.API.Method, out.API.Path, body)
-		} else {
-			fmt.Fprintf(w, "  %-10s%v %v\n", "request:", out.API.Method, out.API.Path)
+		request := NewAPIRequest(out.API)
+		target := request.Path
+		if query := request.query(); query != "" {
+			target += "?" + query
+		}
+		switch {
+		case request.RawBody != nil:
+			fmt.Fprintf(w, "  %-10s%v %v %s\n", "request:", request.Method, target, *request.RawBody)
+		case request.BodyBase64 != "":
+			fmt.Fprintf(w, "  %-10s%v %v (binary body)\n", "request:", request.Method, target)
+		default:
+			if body, err := json.Marshal(out.API.Body); err == nil {
+				fmt.Fprintf(w, "  %-10s%v %v %s\n", "request:", request.Method, target, body)
+			} else {
+				fmt.Fprintf(w, "  %-10s%v %v\n", "request:", request.Method, target)
+			}
+		}
+		for key, value := range request.Headers {
+			fmt.Fprintf(w, "  %-10s%s: %s\n", "header:", key, value)
+		}
+		if request.Endpoint != "" {
+			fmt.Fprintf(w, "  %-10s%v\n", "endpoint:", request.Endpoint)
+		}
+		if out.API.ResponseTopic != "" {
+			fmt.Fprintf(w, "  %-10s%v\n", "response:", out.API.ResponseTopic)
 		}
 	}
 
@@ -1,19 +1,29 @@
 package service
 
 import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/MakeNowJust/heredoc/v2"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/errors"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/jsonnet"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/streamer"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_RemoveContext(t *testing.T) {
 	route := routes.Route{
 		Name:   "Recursive route",
-		Topics: []string{"in"},
+		Topics: []routes.Topic{{Topic: "in"}},
 		Template: routes.Template{
 			Type: "jsonnet",
 			Value: `
@@ -61,8 +71,9 @@ func Test_RemoveContext(t *testing.T) {
 
 	for _, c := range testcases {
 		route.Template = c.Route.Template
-		handler := NewStreamFactory(nil, nil, c.Route, nil, 2, 0)
-		out, err := handler(c.Topic, c.Message)
+		handler, err := NewStreamFactory(nil, nil, c.Route, nil, 2)
+		assert.NoError(t, err)
+		out, err := handler(c.Topic, c.Message, template.Metadata{})
 		assert.NoError(t, err)
 		assert.JSONEq(t, c.ExpectedMsg, out.MessageString())
 	}
@@ -72,7 +83,7 @@ func Test_RemoveContext(t *testing.T) {
 func Test_MaxDepthLimit(t *testing.T) {
 	recursiveRoute := routes.Route{
 		Name:   "Recursive route",
-		Topics: []string{"in"},
+		Topics: []routes.Topic{{Topic: "in"}},
 		Template: routes.Template{
 			Type: "jsonnet",
 			Value: heredoc.Doc(`
@@ -87,7 +98,7 @@ func Test_MaxDepthLimit(t *testing.T) {
 	}
 	nonRecursiveRoute := routes.Route{
 		Name:   "Non recursive route",
-		Topics: []string{"in"},
+		Topics: []routes.Topic{{Topic: "in"}},
 		Template: routes.Template{
 			Type: "jsonnet",
 			Value: heredoc.Doc(`
@@ -137,19 +148,19 @@ func Test_MaxDepthLimit(t *testing.T) {
 	}
 
 	for _, c := range testcases {
-		handler := NewStreamFactory(nil, nil, c.Route, nil, c.Depth, 0)
+		handler, err := NewStreamFactory(nil, nil, c.Route, nil, c.Depth)
+		assert.NoError(t, err)
 		msg := &streamer.OutputMessage{
 			Topic:   c.Topic,
 			Message: c.Message,
 		}
 
-		var err error
 		i := 0
 		for i < 5 {
 			if !c.Route.Match(msg.Topic) {
 				break
 			}
-			msg, err = handler(msg.Topic, msg.MessageString())
+			msg, err = handler(msg.Topic, msg.MessageString(), template.Metadata{})
 			if err != nil {
 				break
 			}
@@ -165,3 +176,144 @@ func Test_MaxDepthLimit(t *testing.T) {
 		}
 	}
 }
+
+func Test_TemplateFromFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"templates/helpers.libsonnet": `{ prefix: 'out/' }`,
+		"templates/route.jsonnet": heredoc.Doc(`
+			local helpers = import 'helpers.libsonnet';
+			{
+				topic: helpers.prefix + topic,
+				message: {
+					value: message.value,
+				},
+				context: false,
+			}
+		`),
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	route := routes.Route{
+		Name:   "External template",
+		Topics: []routes.Topic{{Topic: "in"}},
+		File:   filepath.Join(dir, "routes.yaml"),
+		Template: routes.Template{
+			Type: "jsonnet",
+			Path: "templates/route.jsonnet",
+		},
+	}
+
+	handler, err := NewStreamFactory(nil, nil, route, nil, 2)
+	assert.NoError(t, err)
+
+	out, err := handler("in", `{"value": 1}`, template.Metadata{})
+	assert.NoError(t, err)
+	assert.Equal(t, "out/in", out.Topic)
+	assert.JSONEq(t, `{"value": 1}`, out.MessageString())
+
+	// Missing template files should return an error
+	route.Template.Path = "templates/missing.jsonnet"
+	_, err = NewStreamFactory(nil, nil, route, nil, 2)
+	assert.Error(t, err)
+}
+
+func Test_HandlerIsSafeForConcurrentUse(t *testing.T) {
+	route := routes.Route{
+		Name:   "Concurrent route",
+		Topics: []routes.Topic{{Topic: "in/+"}},
+		Template: routes.Template{
+			Type: "jsonnet",
+			Value: heredoc.Doc(`
+				{
+					topic: 'out/' + std.split(topic, '/')[1],
+					message: {
+						value: message.value,
+					},
+					context: false,
+				}
+			`),
+		},
+	}
+
+	handler, err := NewStreamFactory(nil, nil, route, nil, 2, WithTemplateOptions(jsonnet.WithVMPoolSize(4)))
+	assert.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				out, err := handler(fmt.Sprintf("in/%d", i), fmt.Sprintf(`{"value": %d}`, j), template.Metadata{})
+				if assert.NoError(t, err) {
+					assert.Equal(t, fmt.Sprintf("out/%d", i), out.Topic)
+					assert.JSONEq(t, fmt.Sprintf(`{"value": %d}`, j), out.MessageString())
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func Test_RouteMetrics(t *testing.T) {
+	m := metrics.New()
+	handler, err := NewStreamFactory(nil, nil, routes.Route{
+		Name:   "measured",
+		Topics: []routes.Topic{{Topic: "in"}},
+		Template: routes.Template{
+			Type:  "jsonnet",
+			Value: `{topic: 'out', message: {value: message.value}, skip: message.value == 0}`,
+		},
+	}, nil, 2, WithMetrics(m))
+	assert.NoError(t, err)
+
+	for _, message := range []string{`{"value": 1}`, `{"value": 0}`, `{}`} {
+		handler("in", message, template.Metadata{})
+	}
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	output := w.Body.String()
+	assert.Contains(t, output, `tedge_mapper_template_messages_matched_total{route="measured"} 3`)
+	assert.Contains(t, output, `tedge_mapper_template_messages_skipped_total{reason="template",route="measured"} 1`)
+	assert.Contains(t, output, `tedge_mapper_template_messages_errored_total{route="measured",stage="template"} 1`)
+	assert.Contains(t, output, `tedge_mapper_template_template_duration_seconds_count{route="measured"} 3`)
+}
+
+func Test_RouteMetricsOfRateLimitedMessages(t *testing.T) {
+	m := metrics.New()
+	client := newTestClient()
+	handler, err := NewStreamFactory(client, nil, routes.Route{
+		Name:   "limited",
+		Topics: []routes.Topic{{Topic: "in"}},
+		Template: routes.Template{
+			Type:  "jsonnet",
+			Value: `{topic: 'out', message: message}`,
+		},
+		RateLimit: &routes.RateLimit{Rate: 0.001, Burst: 1, Action: "drop"},
+	}, nil, 2, WithMetrics(m))
+	assert.NoError(t, err)
+
+	handler("in", `{"value": 1}`, template.Metadata{})
+	handler("in", `{"value": 2}`, template.Metadata{})
+
+	// Only the sent message is counted as published, and the dropped message as skipped
+	assert.Eventually(t, func() bool {
+		return strings.Contains(scrapeMetrics(m), `tedge_mapper_template_messages_published_total{route="limited",type="mqtt"} 1`)
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(t, scrapeMetrics(m), `tedge_mapper_template_messages_skipped_total{reason="rate_limited",route="limited"} 1`)
+}
+
+func scrapeMetrics(m *metrics.Metrics) string {
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+)
+
+// Health states of the service
+const (
+	HealthUp       = "up"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// Default interval used to publish the health status
+const DefaultHealthInterval = 60 * time.Second
+
+// Time after an api failure or a broker reconnect during which the service is reported as degraded
+const DefaultHealthWindow = 5 * time.Minute
+
+// thin-edge.io topic used to request the health status of all services
+const HealthCheckAllTopic = "te/device/main///cmd/health/check"
+
+// HealthStatus is published to the health topic of the service
+type HealthStatus struct {
+	Status string `json:"status"`
+	PID    int    `json:"pid"`
+	Time   int64  `json:"time"`
+	// Reasons why the service is degraded
+	Reasons        []string `json:"reasons,omitempty"`
+	APIFailures    int      `json:"api_failures,omitempty"`
+	DisabledRoutes []string `json:"disabled_routes,omitempty"`
+	Reconnects     int      `json:"reconnects,omitempty"`
+	// Named brokers which are not connected
+	DisconnectedBrokers []string `json:"disconnected_brokers,omitempty"`
+}
+
+// Health tracks the conditions which degrade the service. All methods can be
+// called on a nil Health, in which case nothing is recorded
+type Health struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu             sync.Mutex
+	apiFailures    int
+	lastAPIFailure time.Time
+	disabledRoutes []string
+	reconnects     int
+	lastReconnect  time.Time
+	disconnected   map[string]bool
+}
+
+func NewHealth(window time.Duration) *Health {
+	return &Health{
+		window: window,
+		now:    time.Now,
+	}
+}
+
+// APIRequest records the outcome of an api request. A successful request resets the failures
+func (h *Health) APIRequest(outcome string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch outcome {
+	case metrics.APISuccess:
+		h.apiFailures = 0
+	case metrics.APIFailed:
+		h.apiFailures++
+		h.lastAPIFailure = h.now()
+	}
+}
+
+// SetDisabledRoutes sets the routes which could not be registered due to errors
+func (h *Health) SetDisabledRoutes(names []string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.disabledRoutes = slices.Clone(names)
+}
+
+// ConnectionLost records a lost connection to the broker
+func (h *Health) ConnectionLost() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reconnects++
+	h.lastReconnect = h.now()
+}
+
+// BrokerConnected records whether a named broker is connected
+func (h *Health) BrokerConnected(name string, connected bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if connected {
+		delete(h.disconnected, name)
+		return
+	}
+	if h.disconnected == nil {
+		h.disconnected = make(map[string]bool)
+	}
+	h.disconnected[name] = true
+}
+
+// Status returns the current health status. The api is unreachable if the outbox is offline
+func (h *Health) Status(apiUnreachable bool) HealthStatus {
+	status := HealthStatus{
+		Status: HealthUp,
+		PID:    os.Getpid(),
+		Time:   time.Now().Unix(),
+	}
+	if apiUnreachable {
+		status.Reasons = append(status.Reasons, "api is unreachable")
+	}
+	if h != nil {
+		h.mu.Lock()
+		now := h.now()
+		status.APIFailures = h.apiFailures
+		status.DisabledRoutes = slices.Clone(h.disabledRoutes)
+		status.Reconnects = h.reconnects
+		if h.apiFailures > 0 && now.Sub(h.lastAPIFailure) < h.window {
+			status.Reasons = append(status.Reasons, "api requests are failing")
+		}
+		if len(h.disabledRoutes) > 0 {
+			status.Reasons = append(status.Reasons, "routes are disabled due to errors")
+		}
+		if h.reconnects > 0 && now.Sub(h.lastReconnect) < h.window {
+			status.Reasons = append(status.Reasons, "connection to the broker was lost")
+		}
+		for name := range h.disconnected {
+			status.DisconnectedBrokers = append(status.DisconnectedBrokers, name)
+		}
+		if len(status.DisconnectedBrokers) > 0 {
+			sort.Strings(status.DisconnectedBrokers)
+			status.Reasons = append(status.Reasons, "brokers are disconnected")
+		}
+		h.mu.Unlock()
+	}
+	if len(status.Reasons) > 0 {
+		status.Status = HealthDegraded
+	}
+	return status
+}
+
+// Topic used to publish the health status of the service
+func (s *Service) HealthTopic() string {
+	return s.ServiceTopic + "/status/health"
+}
+
+// Topic used by thin-edge.io to request the health status of the service
+func (s *Service) HealthCheckTopic() string {
+	return s.ServiceTopic + "/cmd/health/check"
+}
+
+func (s *Service) HealthStatus() HealthStatus {
+	return s.Health.Status(s.Outbox != nil && s.Outbox.Offline())
+}
+
+// PublishHealth publishes the current health status. The status is retained
+func (s *Service) PublishHealth() {
+	if s.Client == nil || s.ServiceTopic == "" || !s.Client.IsConnected() || s.Stopping() {
+		return
+	}
+	status := s.HealthStatus()
+	payload, err := json.Marshal(status)
+	if err != nil {
+		slog.Warn("Could not create health message.", "error", err)
+		return
+	}
+	if status.Status != HealthUp {
+		slog.Warn("Service is degraded.", "reasons", status.Reasons)
+	}
+	s.Client.Publish(s.HealthTopic(), 1, true, payload)
+}
+
+// Respond to health check requests of the service, or of all services
+func (s *Service) subscribeHealthCheck() error {
+	onHealthCheck := func(c mqtt.Client, m mqtt.Message) {
+		slog.Info("Received health check request.", "topic", m.Topic())
+		s.PublishHealth()
+	}
+	topics := map[string]byte{
+		s.HealthCheckTopic(): 1,
+		HealthCheckAllTopic:  1,
+	}
+	return s.subscribeWith(topics, onHealthCheck)
+}
+
+// ReportHealth publishes the health status periodically until the context is cancelled
+func (s *Service) ReportHealth(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.PublishHealth()
+		}
+	}
+}
+
+func (s *Service) onConnectionLost(c mqtt.Client, err error) {
+	slog.Warn("Lost connection to the MQTT broker.", "error", err)
+	s.Health.ConnectionLost()
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HealthStatus(t *testing.T) {
+	now := time.Now()
+	health := NewHealth(time.Minute)
+	health.now = func() time.Time { return now }
+
+	status := health.Status(false)
+	assert.Equal(t, HealthUp, status.Status)
+	assert.Equal(t, os.Getpid(), status.PID)
+	assert.NotZero(t, status.Time)
+	assert.Empty(t, status.Reasons)
+
+	// Api failures degrade the service until a request succeeds
+	health.APIRequest(metrics.APIFailed)
+	health.APIRequest(metrics.APIFailed)
+	status = health.Status(false)
+	assert.Equal(t, HealthDegraded, status.Status)
+	assert.Equal(t, 2, status.APIFailures)
+	health.APIRequest(metrics.APISuccess)
+	assert.Equal(t, HealthUp, health.Status(false).Status)
+
+	// Reconnects only degrade the service for a limited time
+	health.ConnectionLost()
+	status = health.Status(false)
+	assert.Equal(t, HealthDegraded, status.Status)
+	assert.Equal(t, 1, status.Reconnects)
+	now = now.Add(2 * time.Minute)
+	status = health.Status(false)
+	assert.Equal(t, HealthUp, status.Status)
+	assert.Equal(t, 1, status.Reconnects)
+
+	assert.Equal(t, HealthDegraded, health.Status(true).Status)
+
+	// Disconnected named brokers degrade the service until they are connected
+	health.BrokerConnected("plant", false)
+	status = health.Status(false)
+	assert.Equal(t, HealthDegraded, status.Status)
+	assert.Equal(t, []string{"plant"}, status.DisconnectedBrokers)
+	health.BrokerConnected("plant", true)
+	assert.Equal(t, HealthUp, health.Status(false).Status)
+
+	var nilHealth *Health
+	assert.NotPanics(t, func() {
+		nilHealth.APIRequest(metrics.APIFailed)
+		nilHealth.ConnectionLost()
+		nilHealth.BrokerConnected("plant", false)
+		nilHealth.SetDisabledRoutes([]string{"route1"})
+	})
+	assert.Equal(t, HealthUp, nilHealth.Status(false).Status)
+}
+
+func Test_HealthReportsDisabledRoutes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "routes.yaml")
+
+	app := &Service{
+		Subscriptions: map[string]byte{},
+		Health:        NewHealth(time.Minute),
+		NewHandler: func(route routes.Route) (MessageHandler, error) {
+			return NewStreamFactory(nil, nil, route, nil, 2)
+		},
+	}
+
+	writeRouteFile(t, file, heredoc.Doc(`
+		routes:
+		- name: route1
+		  topics: [in/1]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/1'}"
+		- name: route2
+		  topics: [in/2]
+		  template:
+		    type: jsonnet
+		    value: "{topic: "
+	`))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	status := app.HealthStatus()
+	assert.Equal(t, HealthDegraded, status.Status)
+	assert.Equal(t, []string{"route2"}, status.DisabledRoutes)
+
+	// The route is still disabled if the previous version of the file is kept
+	writeRouteFile(t, file, "routes: [")
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Equal(t, []string{"route2"}, app.HealthStatus().DisabledRoutes)
+
+	writeRouteFile(t, file, heredoc.Doc(`
+		routes:
+		- name: route1
+		  topics: [in/1]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/1'}"
+	`))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	status = app.HealthStatus()
+	assert.Equal(t, HealthUp, status.Status)
+	assert.Empty(t, status.DisabledRoutes)
+}
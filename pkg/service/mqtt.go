@@ -0,0 +1,215 @@
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/config"
+)
+
+// Default maximum time between attempts to reconnect to the broker
+const DefaultMaxReconnectInterval = 30 * time.Second
+
+// Default keep alive interval of the mqtt connection
+const DefaultKeepAlive = 30 * time.Second
+
+// MQTTOptions are the connection settings shared by the mqtt clients of the service
+type MQTTOptions struct {
+	// MQTT protocol version of the client which receives the messages (3 or 5). Defaults to 3
+	ProtocolVersion int
+
+	// Maximum time between attempts to reconnect to the broker
+	MaxReconnectInterval time.Duration
+	KeepAlive            time.Duration
+
+	// TLS and authentication settings
+	config.MQTT
+}
+
+// TLSConfig returns the TLS settings of the connection, or nil if TLS is not configured
+func (o MQTTOptions) TLSConfig() (*tls.Config, error) {
+	if !o.TLS() {
+		return nil, nil
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: o.ServerName,
+	}
+	if o.CAFile != "" || o.CADir != "" {
+		pool, err := loadCertPool(o.CAFile, o.CADir)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate. %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Broker url. The ssl:// scheme is used if TLS is configured and the broker does not include a scheme
+func (o MQTTOptions) BrokerURL(broker string) string {
+	if o.TLS() && !strings.Contains(broker, "://") {
+		return "ssl://" + broker
+	}
+	return broker
+}
+
+// ClientOptions returns the paho options of a client. The client reconnects automatically
+// and logs any changes of the connection state. onConnect is called after each
+// connection, with reconnect set if the client was connected before.
+func (o MQTTOptions) ClientOptions(broker, clientID string, cleanSession bool, onConnect func(c mqtt.Client, reconnect bool)) (*mqtt.ClientOptions, error) {
+	tlsConfig, err := o.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	broker = o.BrokerURL(broker)
+
+	maxReconnectInterval := o.MaxReconnectInterval
+	if maxReconnectInterval <= 0 {
+		maxReconnectInterval = DefaultMaxReconnectInterval
+	}
+	keepAlive := o.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = DefaultKeepAlive
+	}
+
+	connections := atomic.Int64{}
+	opts := mqtt.NewClientOptions().
+		SetClientID(clientID).
+		AddBroker(broker).
+		SetCleanSession(cleanSession).
+		SetKeepAlive(keepAlive).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(maxReconnectInterval).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			reconnect := connections.Add(1) > 1
+			if reconnect {
+				slog.Info("Reconnected to the MQTT broker.", "client_id", clientID, "broker", broker)
+			} else {
+				slog.Info("Connected to the MQTT broker.", "client_id", clientID, "broker", broker)
+			}
+			if onConnect != nil {
+				onConnect(c, reconnect)
+			}
+		}).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			slog.Warn("Lost connection to the MQTT broker.", "client_id", clientID, "error", err)
+		}).
+		SetReconnectingHandler(func(c mqtt.Client, opts *mqtt.ClientOptions) {
+			slog.Info("Reconnecting to the MQTT broker.", "client_id", clientID, "broker", broker)
+		})
+
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if o.Username != "" {
+		opts.SetUsername(o.Username)
+		opts.SetPassword(o.Password)
+	}
+	return opts, nil
+}
+
+// Callbacks of a client which dispatches all received messages to a single handler
+type clientHandlers struct {
+	OnConnect        func(c mqtt.Client, reconnect bool)
+	OnMessage        mqtt.MessageHandler
+	OnConnectionLost mqtt.ConnectionLostHandler
+	// Last will message which is published by the broker if the connection is lost (optional)
+	WillTopic   string
+	WillPayload string
+	// Keep retrying the initial connection in the background if it fails
+	ConnectRetry bool
+}
+
+// Create a MQTT v3 or v5 client depending on the protocol version. The client is not connected
+func (o MQTTOptions) newClient(broker, clientID string, cleanSession bool, handlers clientHandlers) (mqtt.Client, error) {
+	switch o.ProtocolVersion {
+	case 0, MQTTVersion3:
+		opts, err := o.ClientOptions(broker, clientID, cleanSession, handlers.OnConnect)
+		if err != nil {
+			return nil, err
+		}
+		if handlers.WillTopic != "" {
+			opts.SetWill(handlers.WillTopic, handlers.WillPayload, 1, true)
+		}
+		opts.SetDefaultPublishHandler(handlers.OnMessage).SetConnectionLostHandler(handlers.OnConnectionLost)
+		if handlers.ConnectRetry {
+			opts.SetConnectRetry(true).SetConnectRetryInterval(opts.MaxReconnectInterval)
+		}
+		return mqtt.NewClient(opts), nil
+	case MQTTVersion5:
+		c, err := o.newMQTT5Client(broker, clientID, cleanSession, handlers.OnConnect)
+		if err != nil {
+			return nil, err
+		}
+		if handlers.WillTopic != "" {
+			c.SetWill(handlers.WillTopic, handlers.WillPayload, 1, true)
+		}
+		c.SetDefaultPublishHandler(handlers.OnMessage).SetConnectionLostHandler(handlers.OnConnectionLost).SetConnectRetry(handlers.ConnectRetry)
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unsupported mqtt version. expected %d or %d. got=%d", MQTTVersion3, MQTTVersion5, o.ProtocolVersion)
+	}
+}
+
+// Subscribe to topics which are handled by their own callback. The topics are
+// subscribed to again after reconnecting
+func (s *Service) subscribeWith(topics map[string]byte, callback mqtt.MessageHandler) error {
+	s.mu.Lock()
+	if s.callbackSubscriptions == nil {
+		s.callbackSubscriptions = make(map[string]byte)
+	}
+	for topic, qos := range topics {
+		s.callbackSubscriptions[topic] = qos
+	}
+	s.mu.Unlock()
+
+	if token := s.Client.SubscribeMultiple(topics, callback); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// Restore the service after reconnecting. The broker might not have kept the
+// subscriptions (e.g. when using a clean session, or after a broker restart)
+func (s *Service) onConnect(c mqtt.Client, reconnect bool) {
+	if !reconnect || s.Stopping() {
+		return
+	}
+
+	s.mu.RLock()
+	topics := make(map[string]byte, len(s.Subscriptions)+len(s.callbackSubscriptions))
+	if s.subscribed {
+		for topic, qos := range s.Subscriptions {
+			topics[topic] = qos
+		}
+	}
+	// The callbacks are still registered with the client, so only the broker needs to be updated
+	for topic, qos := range s.callbackSubscriptions {
+		topics[topic] = qos
+	}
+	s.mu.RUnlock()
+
+	if err := s.subscribe(topics); err != nil {
+		slog.Warn("Could not restore subscriptions after reconnecting.", "error", err)
+	}
+	if err := s.publishRegistration(); err != nil {
+		slog.Warn("Could not publish service registration after reconnecting.", "error", err)
+	}
+	s.PublishHealth()
+	s.PublishRoutes()
+}
@@ -0,0 +1,609 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/autopaho/queue/memory"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+)
+
+// Supported MQTT protocol versions
+const (
+	MQTTVersion3 = 3
+	MQTTVersion5 = 5
+)
+
+// Maximum time to wait for a message to be published or a subscription to be acknowledged
+const mqtt5RequestTimeout = 10 * time.Second
+
+// Delay between attempts to reconnect to the broker
+const mqtt5ConnectRetryDelay = 5 * time.Second
+
+var ErrNotConnected = errors.New("not connected to the broker")
+
+// PropertiesPublisher is implemented by clients which support publishing MQTT v5 properties
+type PropertiesPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload any, props *template.Properties) mqtt.Token
+}
+
+// PropertiesMessage is implemented by messages which include MQTT v5 properties
+type PropertiesMessage interface {
+	Properties() *template.Properties
+}
+
+// Publish a message including its properties. The properties are dropped if the client does not support them
+func publish(client mqtt.Client, topic string, qos byte, retained bool, payload any, props *template.Properties) mqtt.Token {
+	if props != nil {
+		if c, ok := client.(PropertiesPublisher); ok {
+			return c.PublishWithProperties(topic, qos, retained, payload, props)
+		}
+		slog.Debug("Ignoring message properties as they are only supported by MQTT v5.", "topic", topic)
+	}
+	return client.Publish(topic, qos, retained, payload)
+}
+
+// Metadata of a received message which is passed to the templates
+func messageMetadata(m mqtt.Message) template.Metadata {
+	metadata := template.Metadata{
+		Envelope: &template.Envelope{
+			Retain:       m.Retained(),
+			QoS:          m.Qos(),
+			Duplicate:    m.Duplicate(),
+			ReceivedTime: time.Now(),
+		},
+	}
+	if pm, ok := m.(PropertiesMessage); ok {
+		metadata.Properties = pm.Properties()
+		metadata.Context = contextFromProperties(metadata.Properties)
+	}
+	return metadata
+}
+
+func toPublishProperties(props *template.Properties) *paho.PublishProperties {
+	if props == nil {
+		return nil
+	}
+	out := &paho.PublishProperties{
+		ContentType:   props.ContentType,
+		ResponseTopic: props.ResponseTopic,
+		MessageExpiry: props.MessageExpiry,
+	}
+	if props.CorrelationData != "" {
+		out.CorrelationData = []byte(props.CorrelationData)
+	}
+	for key, value := range props.UserProperties {
+		out.User.Add(key, value)
+	}
+	return out
+}
+
+// Convert the received properties. If a user property is repeated, then the last value is used
+func fromPublishProperties(props *paho.PublishProperties) *template.Properties {
+	if props == nil {
+		return nil
+	}
+	out := &template.Properties{
+		ContentType:     props.ContentType,
+		ResponseTopic:   props.ResponseTopic,
+		CorrelationData: string(props.CorrelationData),
+		MessageExpiry:   props.MessageExpiry,
+	}
+	if len(props.User) > 0 {
+		out.UserProperties = make(map[string]string, len(props.User))
+		for _, p := range props.User {
+			out.UserProperties[p.Key] = p.Value
+		}
+	}
+	return out
+}
+
+// mqtt5Token is completed once the request has finished. A token without a done channel
+// is already completed
+type mqtt5Token struct {
+	done chan struct{}
+	err  error
+}
+
+func newMQTT5Token() *mqtt5Token {
+	return &mqtt5Token{done: make(chan struct{})}
+}
+
+func (t *mqtt5Token) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *mqtt5Token) Wait() bool {
+	<-t.Done()
+	return true
+}
+
+func (t *mqtt5Token) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.Done():
+		return true
+	default:
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.Done():
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *mqtt5Token) Error() error {
+	select {
+	case <-t.Done():
+		return t.err
+	default:
+		return nil
+	}
+}
+
+func (t *mqtt5Token) Done() <-chan struct{} {
+	if t.done == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return t.done
+}
+
+// mqtt5Message is a received message including its MQTT v5 properties
+type mqtt5Message struct {
+	packet *paho.Publish
+}
+
+func (m *mqtt5Message) Duplicate() bool   { return m.packet.Duplicate() }
+func (m *mqtt5Message) Qos() byte         { return m.packet.QoS }
+func (m *mqtt5Message) Retained() bool    { return m.packet.Retain }
+func (m *mqtt5Message) Topic() string     { return m.packet.Topic }
+func (m *mqtt5Message) MessageID() uint16 { return m.packet.PacketID }
+func (m *mqtt5Message) Payload() []byte   { return m.packet.Payload }
+func (m *mqtt5Message) Ack()              {}
+func (m *mqtt5Message) Properties() *template.Properties {
+	return fromPublishProperties(m.packet.Properties)
+}
+
+type mqtt5Route struct {
+	filter   string
+	callback mqtt.MessageHandler
+}
+
+// mqtt5Client is a MQTT v5 client which implements the same interface as the paho v3 client,
+// so it can be used by the service without any other changes. The client reconnects automatically
+type mqtt5Client struct {
+	config         autopaho.ClientConfig
+	clientID       string
+	onConnect      func(c mqtt.Client, reconnect bool)
+	defaultHandler mqtt.MessageHandler
+	connectionLost mqtt.ConnectionLostHandler
+	// Keep retrying the initial connection in the background if it fails
+	connectRetry bool
+
+	connected   atomic.Bool
+	connections atomic.Int64
+	firstError  chan error
+	// Messages waiting to be published, which are kept whilst reconnecting
+	queue *memory.Queue
+	// Messages which are waiting to be acknowledged by the broker
+	inflight sync.WaitGroup
+
+	mu     sync.RWMutex
+	cm     *autopaho.ConnectionManager
+	cancel context.CancelFunc
+	routes []mqtt5Route
+}
+
+// newMQTT5Client returns a MQTT v5 client which uses the same connection settings as the v3 clients.
+// onConnect is called after each connection, with reconnect set if the client was connected before.
+func (o MQTTOptions) newMQTT5Client(broker, clientID string, cleanSession bool, onConnect func(c mqtt.Client, reconnect bool)) (*mqtt5Client, error) {
+	tlsConfig, err := o.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	broker = o.BrokerURL(broker)
+	if !strings.Contains(broker, "://") {
+		broker = "mqtt://" + broker
+	}
+	serverURL, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url. %w", err)
+	}
+
+	maxReconnectInterval := o.MaxReconnectInterval
+	if maxReconnectInterval <= 0 {
+		maxReconnectInterval = DefaultMaxReconnectInterval
+	}
+	keepAlive := o.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = DefaultKeepAlive
+	}
+
+	c := &mqtt5Client{
+		clientID:   clientID,
+		onConnect:  onConnect,
+		firstError: make(chan error, 1),
+		queue:      memory.New(),
+	}
+	c.config = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverURL},
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     uint16(min(keepAlive.Seconds(), math.MaxUint16)),
+		CleanStartOnInitialConnection: cleanSession,
+		ConnectRetryDelay:             min(mqtt5ConnectRetryDelay, maxReconnectInterval),
+		OnConnectionUp:                c.onConnectionUp,
+		OnConnectError:                c.onConnectError,
+		Queue:                         c.queue,
+		ClientConfig: paho.ClientConfig{
+			ClientID:           clientID,
+			OnPublishReceived:  []func(paho.PublishReceived) (bool, error){c.onPublishReceived},
+			OnClientError:      c.onClientError,
+			OnServerDisconnect: c.onServerDisconnect,
+		},
+	}
+	if !cleanSession {
+		// Keep the session until the client connects again (like the v3 client)
+		c.config.SessionExpiryInterval = math.MaxUint32
+	}
+	if o.Username != "" {
+		c.config.ConnectUsername = o.Username
+		c.config.ConnectPassword = []byte(o.Password)
+	}
+	return c, nil
+}
+
+// SetWill sets the message which is published by the broker if the connection is lost
+func (c *mqtt5Client) SetWill(topic string, payload string, qos byte, retained bool) *mqtt5Client {
+	c.config.WillMessage = &paho.WillMessage{
+		Topic:   topic,
+		Payload: []byte(payload),
+		QoS:     qos,
+		Retain:  retained,
+	}
+	return c
+}
+
+// SetDefaultPublishHandler sets the handler of messages which do not match a subscription with its own callback
+func (c *mqtt5Client) SetDefaultPublishHandler(handler mqtt.MessageHandler) *mqtt5Client {
+	c.defaultHandler = handler
+	return c
+}
+
+func (c *mqtt5Client) SetConnectionLostHandler(handler mqtt.ConnectionLostHandler) *mqtt5Client {
+	c.connectionLost = handler
+	return c
+}
+
+// SetConnectRetry keeps the client retrying the initial connection if it fails, instead of giving up.
+// Connect still returns the error of the first attempt
+func (c *mqtt5Client) SetConnectRetry(retry bool) *mqtt5Client {
+	c.connectRetry = retry
+	return c
+}
+
+func (c *mqtt5Client) onConnectionUp(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+	c.connected.Store(true)
+	reconnect := c.connections.Add(1) > 1
+	if reconnect {
+		slog.Info("Reconnected to the MQTT broker.", "client_id", c.clientID, "protocol", MQTTVersion5)
+	} else {
+		slog.Info("Connected to the MQTT broker.", "client_id", c.clientID, "protocol", MQTTVersion5)
+	}
+	if c.onConnect != nil {
+		c.onConnect(c, reconnect)
+	}
+}
+
+func (c *mqtt5Client) onConnectError(err error) {
+	if c.connections.Load() == 0 {
+		select {
+		case c.firstError <- err:
+		default:
+		}
+		return
+	}
+	slog.Info("Reconnecting to the MQTT broker.", "client_id", c.clientID, "error", err)
+}
+
+func (c *mqtt5Client) onClientError(err error) {
+	c.lost(err)
+}
+
+func (c *mqtt5Client) onServerDisconnect(d *paho.Disconnect) {
+	reason := ""
+	if d.Properties != nil {
+		reason = d.Properties.ReasonString
+	}
+	c.lost(fmt.Errorf("disconnected by the broker. code=%d, reason=%s", d.ReasonCode, reason))
+}
+
+func (c *mqtt5Client) lost(err error) {
+	if !c.connected.CompareAndSwap(true, false) {
+		return
+	}
+	if c.connectionLost != nil {
+		c.connectionLost(c, err)
+	} else {
+		slog.Warn("Lost connection to the MQTT broker.", "client_id", c.clientID, "error", err)
+	}
+}
+
+func (c *mqtt5Client) onPublishReceived(pr paho.PublishReceived) (bool, error) {
+	m := &mqtt5Message{packet: pr.Packet}
+
+	c.mu.RLock()
+	callback := c.defaultHandler
+	for _, route := range c.routes {
+		if routes.MatchTopic(route.filter, m.Topic()) {
+			callback = route.callback
+			break
+		}
+	}
+	c.mu.RUnlock()
+
+	if callback != nil {
+		callback(c, m)
+	}
+	return true, nil
+}
+
+func (c *mqtt5Client) connection() (*autopaho.ConnectionManager, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cm == nil || !c.connected.Load() {
+		return nil, ErrNotConnected
+	}
+	return c.cm, nil
+}
+
+func (c *mqtt5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *mqtt5Client) IsConnectionOpen() bool {
+	return c.connected.Load()
+}
+
+// Connect to the broker. An error is returned if the first connection attempt fails
+func (c *mqtt5Client) Connect() mqtt.Token {
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, c.config)
+	if err != nil {
+		cancel()
+		return &mqtt5Token{err: err}
+	}
+	c.mu.Lock()
+	c.cm = cm
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	connected := make(chan error, 1)
+	go func() {
+		connected <- cm.AwaitConnection(ctx)
+	}()
+	select {
+	case err = <-connected:
+	case err = <-c.firstError:
+	}
+	if err != nil {
+		if !c.connectRetry {
+			cancel()
+			c.mu.Lock()
+			c.cm = nil
+			c.mu.Unlock()
+		}
+		return &mqtt5Token{err: err}
+	}
+	return &mqtt5Token{}
+}
+
+// Disconnect from the broker, waiting up to quiesce milliseconds for the disconnect to be sent
+func (c *mqtt5Client) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	cm, cancel := c.cm, c.cancel
+	c.cm, c.cancel = nil, nil
+	c.mu.Unlock()
+	if cm == nil {
+		return
+	}
+
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancelTimeout()
+	// Give the queued and inflight messages a chance to be published
+	if c.connected.Load() {
+		published := make(chan struct{})
+		go func() {
+			<-c.queue.WaitForEmpty()
+			c.inflight.Wait()
+			close(published)
+		}()
+		select {
+		case <-published:
+		case <-ctx.Done():
+			slog.Warn("Disconnecting before all queued messages were published.", "client_id", c.clientID)
+		}
+	}
+	c.connected.Store(false)
+	if err := cm.Disconnect(ctx); err != nil {
+		slog.Debug("Could not disconnect from the MQTT broker.", "client_id", c.clientID, "error", err)
+	}
+	cancel()
+}
+
+func (c *mqtt5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.PublishWithProperties(topic, qos, retained, payload, nil)
+}
+
+// PublishWithProperties publishes a message including its MQTT v5 properties. QoS 1 and 2 messages
+// are published directly whilst connected, and the token is completed once the broker has
+// acknowledged the message. Other messages are added to a queue and are published in order in
+// the background. Messages which are published whilst reconnecting are kept in the queue until
+// the connection is restored (like the v3 client)
+func (c *mqtt5Client) PublishWithProperties(topic string, qos byte, retained bool, payload any, props *template.Properties) mqtt.Token {
+	var data []byte
+	switch v := payload.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	case bytes.Buffer:
+		data = v.Bytes()
+	case *bytes.Buffer:
+		data = v.Bytes()
+	default:
+		return &mqtt5Token{err: fmt.Errorf("unknown payload type. %T", payload)}
+	}
+
+	c.mu.RLock()
+	cm := c.cm
+	c.mu.RUnlock()
+	if cm == nil {
+		slog.Warn("Could not publish message.", "client_id", c.clientID, "topic", topic, "error", ErrNotConnected)
+		return &mqtt5Token{err: ErrNotConnected}
+	}
+	msg := &paho.Publish{
+		Topic:      topic,
+		QoS:        qos,
+		Retain:     retained,
+		Payload:    data,
+		Properties: toPublishProperties(props),
+	}
+	if qos == 0 || !c.connected.Load() {
+		return &mqtt5Token{err: c.enqueue(cm, msg)}
+	}
+
+	token := newMQTT5Token()
+	c.inflight.Add(1)
+	go func() {
+		defer c.inflight.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), mqtt5RequestTimeout)
+		defer cancel()
+		_, err := cm.Publish(ctx, msg)
+		if err != nil {
+			slog.Warn("Could not publish message.", "client_id", c.clientID, "topic", topic, "error", err)
+			// The connection was lost before the message was sent, so keep it until the connection is restored
+			if errors.Is(err, autopaho.ConnectionDownError) {
+				c.enqueue(cm, &paho.Publish{
+					Topic:      msg.Topic,
+					QoS:        msg.QoS,
+					Retain:     msg.Retain,
+					Payload:    msg.Payload,
+					Properties: msg.Properties,
+				})
+			}
+		}
+		token.complete(err)
+	}()
+	return token
+}
+
+// enqueue adds a message to the queue of messages which are published in the background
+func (c *mqtt5Client) enqueue(cm *autopaho.ConnectionManager, msg *paho.Publish) error {
+	if !c.connected.Load() {
+		slog.Info("Queuing message until the connection is restored.", "client_id", c.clientID, "topic", msg.Topic)
+	}
+	err := cm.PublishViaQueue(context.Background(), &autopaho.QueuePublish{Publish: msg})
+	if err != nil {
+		slog.Warn("Could not publish message.", "client_id", c.clientID, "topic", msg.Topic, "error", err)
+	}
+	return err
+}
+
+func (c *mqtt5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple subscribes to the topics. If the callback is nil, then the messages are
+// handled by the default handler (or the callback which was previously registered for the topic)
+func (c *mqtt5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	if callback != nil {
+		for topic := range filters {
+			c.AddRoute(topic, callback)
+		}
+	}
+
+	cm, err := c.connection()
+	if err != nil {
+		return &mqtt5Token{err: err}
+	}
+	subscriptions := make([]paho.SubscribeOptions, 0, len(filters))
+	for topic, qos := range filters {
+		subscriptions = append(subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5RequestTimeout)
+	defer cancel()
+	suback, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: subscriptions})
+	if err != nil {
+		return &mqtt5Token{err: err}
+	}
+	for i, reason := range suback.Reasons {
+		if reason >= 0x80 && i < len(subscriptions) {
+			return &mqtt5Token{err: fmt.Errorf("subscription was rejected. topic=%s, code=%d", subscriptions[i].Topic, reason)}
+		}
+	}
+	return &mqtt5Token{}
+}
+
+func (c *mqtt5Client) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	c.routes = slices.DeleteFunc(c.routes, func(r mqtt5Route) bool {
+		for _, topic := range topics {
+			if r.filter == topic {
+				return true
+			}
+		}
+		return false
+	})
+	c.mu.Unlock()
+
+	cm, err := c.connection()
+	if err != nil {
+		return &mqtt5Token{err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5RequestTimeout)
+	defer cancel()
+	_, err = cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+	return &mqtt5Token{err: err}
+}
+
+// AddRoute registers a callback for messages matching the topic filter, without subscribing to it
+func (c *mqtt5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, route := range c.routes {
+		if route.filter == topic {
+			c.routes[i].callback = callback
+			return
+		}
+	}
+	c.routes = append(c.routes, mqtt5Route{filter: topic, callback: callback})
+}
+
+// OptionsReader returns the client id and broker of the client. Other options are not available
+func (c *mqtt5Client) OptionsReader() mqtt.ClientOptionsReader {
+	opts := mqtt.NewClientOptions().SetClientID(c.clientID)
+	for _, server := range c.config.ServerUrls {
+		opts.AddBroker(server.String())
+	}
+	// The reader can only be created by a (unconnected) v3 client
+	return mqtt.NewClient(opts).OptionsReader()
+}
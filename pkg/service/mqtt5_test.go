@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/config"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+// propertiesClient records the properties of the published messages
+type propertiesClient struct {
+	*testClient
+	props map[string]*template.Properties
+}
+
+func (c *propertiesClient) PublishWithProperties(topic string, qos byte, retained bool, payload any, props *template.Properties) mqtt.Token {
+	c.props[topic] = props
+	return c.Publish(topic, qos, retained, payload)
+}
+
+func Test_MQTT5Properties(t *testing.T) {
+	expiry := uint32(60)
+	props := &template.Properties{
+		ContentType:     "application/json",
+		ResponseTopic:   "reply",
+		CorrelationData: "abc",
+		MessageExpiry:   &expiry,
+		UserProperties:  map[string]string{"source": "child01"},
+	}
+	converted := toPublishProperties(props)
+	assert.Equal(t, "application/json", converted.ContentType)
+	assert.Equal(t, []byte("abc"), converted.CorrelationData)
+	assert.Equal(t, "child01", converted.User.Get("source"))
+	assert.Equal(t, props, fromPublishProperties(converted))
+
+	assert.Nil(t, toPublishProperties(nil))
+	assert.Nil(t, fromPublishProperties(nil))
+
+	// The last value of a repeated user property is used
+	received := fromPublishProperties(&paho.PublishProperties{
+		User: paho.UserProperties{{Key: "type", Value: "a"}, {Key: "type", Value: "b"}},
+	})
+	assert.Equal(t, map[string]string{"type": "b"}, received.UserProperties)
+}
+
+func Test_PublishWithProperties(t *testing.T) {
+	props := &template.Properties{ContentType: "text/plain"}
+
+	// Properties are dropped by v3 clients
+	client := newTestClient()
+	assert.NoError(t, publish(client, "out", 1, false, "hello", props).Error())
+	assert.Equal(t, []byte("hello"), client.published["out"])
+
+	v5 := &propertiesClient{testClient: newTestClient(), props: map[string]*template.Properties{}}
+	assert.NoError(t, publish(v5, "out", 1, false, "hello", props).Error())
+	assert.Equal(t, props, v5.props["out"])
+	assert.Equal(t, []byte("hello"), v5.published["out"])
+}
+
+func Test_MQTT5ClientDispatch(t *testing.T) {
+	c, err := MQTTOptions{}.newMQTT5Client("localhost:1883", "test", true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "mqtt://localhost:1883", c.config.ServerUrls[0].String())
+
+	received := map[string]template.Metadata{}
+	c.SetDefaultPublishHandler(func(_ mqtt.Client, m mqtt.Message) {
+		received["default:"+m.Topic()] = messageMetadata(m)
+	})
+	c.AddRoute("cmd/#", func(_ mqtt.Client, m mqtt.Message) {
+		received["route:"+m.Topic()] = messageMetadata(m)
+	})
+
+	c.onPublishReceived(paho.PublishReceived{Packet: &paho.Publish{
+		Topic:      "cmd/restart",
+		Payload:    []byte("{}"),
+		Properties: &paho.PublishProperties{User: paho.UserProperties{{Key: "source", Value: "child01"}}},
+	}})
+	c.onPublishReceived(paho.PublishReceived{Packet: &paho.Publish{Topic: "in/1", Payload: []byte("{}")}})
+
+	assert.Equal(t, map[string]string{"source": "child01"}, received["route:cmd/restart"].Properties.UserProperties)
+	assert.Contains(t, received, "default:in/1")
+	assert.Nil(t, received["default:in/1"].Properties)
+
+	// Publishing fails whilst not connected
+	assert.ErrorIs(t, c.Publish("out", 0, false, "{}").Error(), ErrNotConnected)
+}
+
+func Test_MQTT5ClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _ := writeTestCertificate(t, dir)
+
+	c, err := MQTTOptions{
+		MQTT: config.MQTT{CAFile: caFile, Username: "user", Password: "secret"},
+	}.newMQTT5Client("localhost:8883", "test", false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "ssl://localhost:8883", c.config.ServerUrls[0].String())
+	assert.NotNil(t, c.config.TlsCfg)
+	assert.Equal(t, "user", c.config.ConnectUsername)
+	assert.Equal(t, []byte("secret"), c.config.ConnectPassword)
+	assert.False(t, c.config.CleanStartOnInitialConnection)
+	assert.Equal(t, uint16(DefaultKeepAlive.Seconds()), c.config.KeepAlive)
+}
+
+func Test_NewServiceMQTTVersion(t *testing.T) {
+	app, err := NewService("localhost:1883", "test", true, "", true, MQTTOptions{ProtocolVersion: MQTTVersion5})
+	assert.NoError(t, err)
+	assert.IsType(t, &mqtt5Client{}, app.Client)
+
+	_, err = NewService("localhost:1883", "test", true, "", true, MQTTOptions{ProtocolVersion: 4})
+	assert.Error(t, err)
+}
+
+func Test_MQTT5PublishIsQueuedWhilstReconnecting(t *testing.T) {
+	c, err := MQTTOptions{}.newMQTT5Client("127.0.0.1:1", "test", true, nil)
+	assert.NoError(t, err)
+
+	// The connection manager keeps trying to connect to the unreachable broker
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cm, err := autopaho.NewConnection(ctx, c.config)
+	assert.NoError(t, err)
+	c.cm = cm
+
+	assert.False(t, c.IsConnected())
+	assert.NoError(t, c.Publish("out", 1, false, "{}").Error())
+	entry, err := c.queue.Peek()
+	assert.NoError(t, err)
+	assert.NoError(t, entry.Leave())
+}
+
+func Test_MQTT5Token(t *testing.T) {
+	assert.True(t, (&mqtt5Token{}).WaitTimeout(0))
+
+	token := newMQTT5Token()
+	assert.False(t, token.WaitTimeout(10*time.Millisecond))
+	assert.NoError(t, token.Error())
+
+	token.complete(ErrNotConnected)
+	assert.True(t, token.WaitTimeout(10*time.Millisecond))
+	assert.True(t, token.Wait())
+	assert.ErrorIs(t, token.Error(), ErrNotConnected)
+}
+
+func Test_MQTT5PublishWaitsForAcknowledgement(t *testing.T) {
+	c, err := MQTTOptions{}.newMQTT5Client("127.0.0.1:1", "test", true, nil)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cm, err := autopaho.NewConnection(ctx, c.config)
+	assert.NoError(t, err)
+	c.cm = cm
+
+	// The connection is lost before the message is sent, so the token reports the error
+	// and the message is kept in the queue until the connection is restored
+	c.connected.Store(true)
+	token := c.Publish("out", 1, false, "{}")
+	assert.True(t, token.WaitTimeout(time.Second))
+	assert.ErrorIs(t, token.Error(), autopaho.ConnectionDownError)
+	entry, err := c.queue.Peek()
+	assert.NoError(t, err)
+	assert.NoError(t, entry.Leave())
+}
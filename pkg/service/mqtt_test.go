@@ -0,0 +1,147 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (doneToken) Error() error { return nil }
+
+// testClient records the subscriptions and published messages
+type testClient struct {
+	mqtt.Client
+
+	mu         sync.Mutex
+	subscribed map[string]byte
+	published  map[string][]byte
+}
+
+func newTestClient() *testClient {
+	return &testClient{
+		subscribed: map[string]byte{},
+		published:  map[string][]byte{},
+	}
+}
+
+func (c *testClient) IsConnected() bool { return true }
+
+func (c *testClient) IsConnectionOpen() bool { return true }
+
+func (c *testClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic, qos := range filters {
+		c.subscribed[topic] = qos
+	}
+	return doneToken{}
+}
+
+func (c *testClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch v := payload.(type) {
+	case []byte:
+		c.published[topic] = v
+	case string:
+		c.published[topic] = []byte(v)
+	}
+	return doneToken{}
+}
+
+func Test_ResubscribeAfterReconnect(t *testing.T) {
+	client := newTestClient()
+	app := &Service{
+		Client:        client,
+		ServiceTopic:  "te/device/main/service/test",
+		Subscriptions: map[string]byte{"in/1": 1, "in/2": 1},
+		subscribed:    true,
+	}
+	assert.NoError(t, app.subscribeWith(map[string]byte{"bridge/health": 1}, nil))
+
+	client.subscribed = map[string]byte{}
+	app.onConnect(client, false)
+	assert.Empty(t, client.subscribed)
+
+	app.onConnect(client, true)
+	assert.Equal(t, map[string]byte{"in/1": 1, "in/2": 1, "bridge/health": 1}, client.subscribed)
+	assert.JSONEq(t, `{"@type":"service","@parent":"device/main//"}`, string(client.published["te/device/main/service/test"]))
+	assert.Contains(t, string(client.published["te/device/main/service/test/status/health"]), `"status":"up"`)
+	assert.Contains(t, client.published, "te/device/main/service/test/twin/routes")
+}
+
+// Write a self-signed certificate and its private key
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func Test_MQTTClientOptions(t *testing.T) {
+	opts, err := MQTTOptions{}.ClientOptions("localhost:1883", "test", true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp://localhost:1883", opts.Servers[0].String())
+	assert.Nil(t, opts.TLSConfig)
+	assert.True(t, opts.AutoReconnect)
+	assert.Equal(t, DefaultMaxReconnectInterval, opts.MaxReconnectInterval)
+
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	opts, err = MQTTOptions{MQTT: config.MQTT{
+		CAFile:     certFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		Username:   "mapper",
+		Password:   "secret",
+		ServerName: "broker.local",
+	}}.ClientOptions("localhost:8883", "test", true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "ssl://localhost:8883", opts.Servers[0].String())
+	assert.Len(t, opts.TLSConfig.Certificates, 1)
+	assert.NotNil(t, opts.TLSConfig.RootCAs)
+	assert.Equal(t, "broker.local", opts.TLSConfig.ServerName)
+	assert.Equal(t, "mapper", opts.Username)
+	assert.Equal(t, "secret", opts.Password)
+
+	_, err = MQTTOptions{MQTT: config.MQTT{CAFile: keyFile}}.ClientOptions("localhost:8883", "test", true, nil)
+	assert.ErrorContains(t, err, "does not contain any certificates")
+	_, err = MQTTOptions{MQTT: config.MQTT{CertFile: certFile}}.ClientOptions("localhost:8883", "test", true, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,347 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/storage"
+)
+
+// Default interval used to check if the api is reachable again whilst offline
+const DefaultOutboxProbeInterval = 30 * time.Second
+
+// Default topic used by thin-edge.io to publish the health of the Cumulocity bridge
+const DefaultBridgeHealthTopic = "te/device/main/service/mosquitto-c8y-bridge/status/health"
+
+// Outbox buffers api requests on disk whilst the api is unreachable (e.g. when the device
+// is offline), and replays them in order once connectivity returns
+type Outbox struct {
+	store  *storage.Store
+	replay func(DelayedMessage) bool
+
+	// Maximum number of buffered requests. The oldest requests are dropped when full
+	maxSize int
+	// Maximum age of buffered requests. Older requests are dropped instead of being replayed
+	maxAge        time.Duration
+	probeInterval time.Duration
+
+	mu      sync.Mutex
+	offline bool
+	pending int
+	seq     atomic.Uint64
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open the outbox stored in the given directory. The replay function sends a buffered request,
+// and returns false if the api is still unreachable (so the request is kept)
+func NewOutbox(dir string, maxSize int, maxAge time.Duration, replay func(DelayedMessage) bool) (*Outbox, error) {
+	store, err := storage.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := store.IDs()
+	if err != nil {
+		return nil, err
+	}
+	return &Outbox{
+		store:         store,
+		replay:        replay,
+		maxSize:       maxSize,
+		maxAge:        maxAge,
+		probeInterval: DefaultOutboxProbeInterval,
+		pending:       len(ids),
+		wake:          make(chan struct{}, 1),
+	}, nil
+}
+
+// Offline checks if new requests should be buffered, either because the api is unreachable
+// or because older requests are still waiting to be replayed
+func (o *Outbox) Offline() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.offline || o.pending > 0
+}
+
+// Pending returns the number of buffered requests
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.pending
+}
+
+// SetOffline marks the api as unreachable, so new requests are buffered
+func (o *Outbox) SetOffline(reason string) {
+	o.mu.Lock()
+	changed := !o.offline
+	o.offline = true
+	o.mu.Unlock()
+	if changed {
+		slog.Warn("Api is unreachable. Buffering api requests.", "reason", reason)
+	}
+}
+
+// SetOnline marks the api as reachable, and starts replaying the buffered requests
+func (o *Outbox) SetOnline(reason string) {
+	o.mu.Lock()
+	changed := o.offline
+	o.offline = false
+	pending := o.pending
+	o.mu.Unlock()
+	if changed {
+		slog.Info("Api is reachable.", "reason", reason, "pending", pending)
+	}
+	o.notify()
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Add a request to the end of the outbox. The oldest requests are dropped if the outbox is full
+func (o *Outbox) Add(m DelayedMessage) error {
+	m.Created = time.Now()
+	// ids are ordered by creation time, so requests are replayed in order
+	m.ID = fmt.Sprintf("%019d-%06d", m.Created.UnixNano(), o.seq.Add(1)%1000000)
+	if err := o.store.Put(m.ID, m); err != nil {
+		return fmt.Errorf("could not persist api request. %w", err)
+	}
+
+	o.mu.Lock()
+	o.pending++
+	pending := o.pending
+	o.mu.Unlock()
+	slog.Info("Buffered api request.", "id", m.ID, "route", m.Route, "target", m.Target(), "pending", pending)
+
+	if o.maxSize > 0 && pending > o.maxSize {
+		o.evictOldest(pending - o.maxSize)
+	}
+	return nil
+}
+
+func (o *Outbox) evictOldest(n int) {
+	ids, err := o.store.IDs()
+	if err != nil {
+		slog.Warn("Could not read buffered api requests.", "error", err)
+		return
+	}
+	for _, id := range ids[:min(n, len(ids))] {
+		m := DelayedMessage{}
+		if err := o.store.Get(id, &m); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				// Already replayed or removed
+				continue
+			}
+			if o.remove(id) {
+				slog.Warn("Outbox is full. Dropped invalid buffered api request.", "id", id, "max_size", o.maxSize, "error", err)
+			}
+			continue
+		}
+		if o.remove(id) {
+			slog.Warn("Outbox is full. Dropped oldest api request.", "id", id, "route", m.Route, "target", m.Target(), "created", m.Created.Format(time.RFC3339), "max_size", o.maxSize)
+		}
+	}
+}
+
+// Remove a request. False is returned if it was already removed
+func (o *Outbox) remove(id string) bool {
+	if err := o.store.Delete(id); err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			slog.Warn("Could not remove buffered api request.", "id", id, "error", err)
+		}
+		return false
+	}
+	o.mu.Lock()
+	o.pending = max(o.pending-1, 0)
+	o.mu.Unlock()
+	return true
+}
+
+// Start replaying buffered requests in the background. Whilst requests are pending, the api
+// is probed periodically by replaying the oldest request
+func (o *Outbox) Start() {
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+	go func() {
+		defer close(o.done)
+		ticker := time.NewTicker(o.probeInterval)
+		defer ticker.Stop()
+		o.notify()
+		for {
+			select {
+			case <-o.stop:
+				return
+			case <-o.wake:
+			case <-ticker.C:
+			}
+			if o.Pending() > 0 {
+				o.drain()
+			}
+		}
+	}()
+}
+
+// Stop replaying requests. Buffered requests are kept, and are replayed on the next start
+func (o *Outbox) Stop() {
+	if o.stop == nil {
+		return
+	}
+	close(o.stop)
+	<-o.done
+	o.stop = nil
+}
+
+// Replay the buffered requests in order until the outbox is empty or the api is unreachable
+func (o *Outbox) drain() {
+	for {
+		select {
+		case <-o.stop:
+			return
+		default:
+		}
+
+		ids, err := o.store.IDs()
+		if err != nil {
+			slog.Warn("Could not read buffered api requests.", "error", err)
+			return
+		}
+		if len(ids) == 0 {
+			o.SetOnline("outbox is empty")
+			return
+		}
+
+		id := ids[0]
+		m := DelayedMessage{}
+		if err := o.store.Get(id, &m); err != nil {
+			if !errors.Is(err, storage.ErrNotFound) {
+				slog.Warn("Dropping invalid buffered api request.", "id", id, "error", err)
+				o.remove(id)
+			}
+			continue
+		}
+
+		if age := time.Since(m.Created); o.maxAge > 0 && age > o.maxAge {
+			if o.remove(id) {
+				slog.Warn("Dropped expired api request.", "id", id, "route", m.Route, "target", m.Target(), "age", age.Round(time.Second), "max_age", o.maxAge)
+			}
+			continue
+		}
+
+		slog.Info("Replaying buffered api request.", "id", id, "route", m.Route, "target", m.Target())
+		if !o.replay(m) {
+			o.SetOffline("replayed api request failed")
+			return
+		}
+		o.remove(id)
+	}
+}
+
+// List the buffered requests (oldest first)
+func (o *Outbox) List() ([]DelayedMessage, error) {
+	ids, err := o.store.IDs()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]DelayedMessage, 0, len(ids))
+	for _, id := range ids {
+		m := DelayedMessage{}
+		if err := o.store.Get(id, &m); err != nil {
+			continue
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// OnBridgeHealth updates the connectivity based on the health of the cloud bridge.
+// Both the mosquitto bridge ("1" or "0") and json ({"status":"up"}) formats are supported
+func (o *Outbox) OnBridgeHealth(payload []byte) {
+	up, ok := parseHealthStatus(payload)
+	if !ok {
+		slog.Debug("Ignoring unknown bridge health status.", "payload", string(payload))
+		return
+	}
+	if up {
+		o.SetOnline("bridge is up")
+	} else {
+		o.SetOffline("bridge is down")
+	}
+}
+
+func parseHealthStatus(payload []byte) (up bool, ok bool) {
+	value := strings.TrimSpace(string(payload))
+	switch value {
+	case "1":
+		return true, true
+	case "0":
+		return false, true
+	}
+	status := struct {
+		Status string `json:"status"`
+	}{}
+	if err := json.Unmarshal(payload, &status); err != nil {
+		return false, false
+	}
+	switch status.Status {
+	case "up":
+		return true, true
+	case "down":
+		return false, true
+	}
+	return false, false
+}
+
+// Check if an api request failed because the api is unreachable, in which case it can be
+// buffered until connectivity returns. Requests which failed for any other reason (e.g. an invalid
+// request or a certificate error) are not buffered, as they would block the requests behind them
+func isUnreachable(statusCode int, err error) bool {
+	switch statusCode {
+	case 502, 503, 504:
+		return true
+	case 0:
+		return isTransportError(err)
+	}
+	return false
+}
+
+// Check if a request failed as the connection could not be established or was interrupted,
+// e.g. connection refused, dns failure or timeout
+func isTransportError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &certErr) || errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	if errors.As(err, &dnsErr) || errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestOutbox(t *testing.T, dir string, maxSize int, maxAge time.Duration, replay func(DelayedMessage) bool) *Outbox {
+	outbox, err := NewOutbox(dir, maxSize, maxAge, replay)
+	assert.NoError(t, err)
+	outbox.probeInterval = 10 * time.Millisecond
+	t.Cleanup(outbox.Stop)
+	return outbox
+}
+
+func apiMessage(path string) DelayedMessage {
+	return DelayedMessage{Type: DelayedAPIRequest, Request: &APIRequest{Method: "POST", Path: path}}
+}
+
+func Test_OutboxReplaysInOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	var mu sync.Mutex
+	online := false
+	replayed := []string{}
+	replay := func(m DelayedMessage) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if !online {
+			return false
+		}
+		replayed = append(replayed, m.Request.Path)
+		return true
+	}
+
+	outbox := newTestOutbox(t, dir, 10, time.Hour, replay)
+	outbox.SetOffline("test")
+	for _, path := range []string{"/1", "/2", "/3"} {
+		assert.NoError(t, outbox.Add(apiMessage(path)))
+	}
+	assert.True(t, outbox.Offline())
+
+	// Requests are kept whilst the api is unreachable, including after a restart
+	outbox.Start()
+	time.Sleep(50 * time.Millisecond)
+	outbox.Stop()
+	assert.Equal(t, 3, outbox.Pending())
+
+	restarted := newTestOutbox(t, dir, 10, time.Hour, replay)
+	assert.Equal(t, 3, restarted.Pending())
+	restarted.Start()
+
+	mu.Lock()
+	online = true
+	mu.Unlock()
+	restarted.OnBridgeHealth([]byte(`{"status":"up"}`))
+
+	assert.Eventually(t, func() bool { return restarted.Pending() == 0 }, time.Second, 5*time.Millisecond)
+	assert.False(t, restarted.Offline())
+	mu.Lock()
+	assert.Equal(t, []string{"/1", "/2", "/3"}, replayed)
+	mu.Unlock()
+}
+
+func Test_OutboxLimits(t *testing.T) {
+	outbox := newTestOutbox(t, t.TempDir(), 2, time.Hour, nil)
+	for _, path := range []string{"/1", "/2", "/3"} {
+		assert.NoError(t, outbox.Add(apiMessage(path)))
+	}
+
+	// The oldest request is dropped when full
+	messages, err := outbox.List()
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "/2", messages[0].Request.Path)
+		assert.Equal(t, "/3", messages[1].Request.Path)
+	}
+	assert.Equal(t, 2, outbox.Pending())
+
+	// Expired requests are dropped instead of being replayed
+	replayed := make(chan string, 10)
+	expiring := newTestOutbox(t, t.TempDir(), 10, 20*time.Millisecond, func(m DelayedMessage) bool {
+		replayed <- m.Request.Path
+		return true
+	})
+	assert.NoError(t, expiring.Add(apiMessage("/expired")))
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, expiring.Add(apiMessage("/recent")))
+	expiring.Start()
+
+	assert.Eventually(t, func() bool { return expiring.Pending() == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "/recent", <-replayed)
+	assert.Empty(t, replayed)
+}
+
+func Test_OutboxEvictsInvalidRequests(t *testing.T) {
+	dir := t.TempDir()
+	outbox := newTestOutbox(t, dir, 2, time.Hour, nil)
+	assert.NoError(t, outbox.Add(apiMessage("/1")))
+	messages, err := outbox.List()
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, messages[0].ID+".json"), []byte("{"), 0644))
+
+	// The oldest (invalid) request is dropped when full
+	assert.NoError(t, outbox.Add(apiMessage("/2")))
+	assert.NoError(t, outbox.Add(apiMessage("/3")))
+	messages, err = outbox.List()
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "/2", messages[0].Request.Path)
+		assert.Equal(t, "/3", messages[1].Request.Path)
+	}
+	assert.Equal(t, 2, outbox.Pending())
+}
+
+func Test_APIRequestIsBufferedWhilstUnreachable(t *testing.T) {
+	s := newTestAPISender(t, nil, 503, 201)
+	outbox := newTestOutbox(t, t.TempDir(), 10, time.Hour, func(m DelayedMessage) bool {
+		return s.replay(m.request())
+	})
+	s.outbox = outbox
+
+	// The request is buffered instead of being dead-lettered
+	s.Request(APIRequest{Method: "POST", Path: "/event/events"})()
+	assert.True(t, outbox.Offline())
+	assert.Equal(t, 1, outbox.Pending())
+
+	// Requests to other endpoints are not buffered
+	s.Request(APIRequest{Endpoint: "local", Method: "POST", Path: "/hook"})()
+	assert.Equal(t, 2, s.Attempts())
+	assert.Equal(t, 1, outbox.Pending())
+
+	outbox.Start()
+	outbox.OnBridgeHealth([]byte("1"))
+	assert.Eventually(t, func() bool { return outbox.Pending() == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 3, s.Attempts())
+	assert.Empty(t, s.deadLetters)
+}
+
+func Test_OutboxIsNotBlockedByInvalidRequests(t *testing.T) {
+	s := newTestAPISender(t, nil, 201)
+	send := s.send
+	s.send = func(r APIRequest) (*c8y.Response, error) {
+		if r.Path == "/poison" {
+			return nil, fmt.Errorf("invalid request")
+		}
+		return send(r)
+	}
+	outbox := newTestOutbox(t, t.TempDir(), 10, time.Hour, func(m DelayedMessage) bool {
+		return s.replay(m.request())
+	})
+	s.outbox = outbox
+
+	// The invalid request at the head of the queue is dead-lettered instead of being kept
+	outbox.SetOffline("test")
+	assert.NoError(t, outbox.Add(apiMessage("/poison")))
+	assert.NoError(t, outbox.Add(apiMessage("/1")))
+	outbox.Start()
+	outbox.OnBridgeHealth([]byte(`{"status":"up"}`))
+	assert.Eventually(t, func() bool { return outbox.Pending() == 0 }, time.Second, 5*time.Millisecond)
+	assert.False(t, outbox.Offline())
+
+	select {
+	case message := <-s.deadLetters:
+		assert.Equal(t, "/poison", message.Request.Path)
+	case <-time.After(time.Second):
+		t.Fatal("invalid request was not dead-lettered")
+	}
+
+	// New invalid requests are not buffered either
+	s.Request(APIRequest{Method: "POST", Path: "/poison"})()
+	assert.Equal(t, 0, outbox.Pending())
+	assert.False(t, outbox.Offline())
+}
+
+func Test_IsUnreachable(t *testing.T) {
+	testcases := map[string]struct {
+		Status   int
+		Err      error
+		Expected bool
+	}{
+		"connection refused": {Err: &url.Error{Op: "Post", URL: "https://example.com", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, Expected: true},
+		"dns failure":        {Err: &url.Error{Op: "Post", URL: "https://example.com", Err: &net.DNSError{Err: "no such host", Name: "example.com"}}, Expected: true},
+		"timeout":            {Err: fmt.Errorf("request failed. %w", context.DeadlineExceeded), Expected: true},
+		"gateway timeout":    {Status: 504, Err: fmt.Errorf("gateway timeout"), Expected: true},
+		"unknown authority":  {Err: &url.Error{Op: "Post", URL: "https://example.com", Err: x509.UnknownAuthorityError{}}, Expected: false},
+		"invalid request":    {Err: fmt.Errorf("invalid request"), Expected: false},
+		"unknown endpoint":   {Err: ErrUnknownEndpoint, Expected: false},
+		"bad request":        {Status: 400, Err: fmt.Errorf("bad request"), Expected: false},
+	}
+	for name, c := range testcases {
+		assert.Equal(t, c.Expected, isUnreachable(c.Status, c.Err), name)
+	}
+}
+
+func Test_ParseHealthStatus(t *testing.T) {
+	testcases := map[string]struct {
+		Up bool
+		OK bool
+	}{
+		`1`:                  {Up: true, OK: true},
+		`0`:                  {Up: false, OK: true},
+		`{"status":"up"}`:    {Up: true, OK: true},
+		`{"status":"down"}`:  {Up: false, OK: true},
+		`{"status":"other"}`: {},
+		`unknown`:            {},
+	}
+	for payload, expected := range testcases {
+		up, ok := parseHealthStatus([]byte(payload))
+		assert.Equal(t, expected.Up, up, payload)
+		assert.Equal(t, expected.OK, ok, payload)
+	}
+}
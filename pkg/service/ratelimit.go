@@ -0,0 +1,260 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/ratelimit"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+)
+
+// Apply the rate limits of a route to the messages sent by the route
+type rateLimiter struct {
+	route    string
+	throttle *ratelimit.Throttle
+	topics   []*topicRateLimiter
+	metrics  *metrics.Metrics
+}
+
+// Rate limiters of the active routes, so the limits can also be applied to messages
+// which are sent later on, e.g. by the delay queue
+type RateLimiters struct {
+	mu       sync.RWMutex
+	limiters map[string]*rateLimiter
+	// Limiters of the routes which were created, but are not active yet
+	staged map[string]*rateLimiter
+}
+
+func NewRateLimiters() *RateLimiters {
+	return &RateLimiters{
+		limiters: map[string]*rateLimiter{},
+		staged:   map[string]*rateLimiter{},
+	}
+}
+
+// Key of a route's limiter. Route names are only unique within a file
+func routeKey(file string, name string) string {
+	return file + "#" + name
+}
+
+// Keep the limiter of a route which was created successfully, until the route is loaded
+func (r *RateLimiters) stage(key string, limiter *rateLimiter) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.staged[key] = limiter
+}
+
+// Take the staged limiter of a route, so it can be kept together with the route's handler
+func (r *RateLimiters) claim(key string) *rateLimiter {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	limiter := r.staged[key]
+	delete(r.staged, key)
+	return limiter
+}
+
+// Replace the limiters with the ones of the active routes
+func (r *RateLimiters) replace(limiters map[string]*rateLimiter) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limiters = limiters
+}
+
+// Try applies the route's rate limits to a message which is kept by the caller until it can be sent
+func (r *RateLimiters) Try(route string, topic string) (ratelimit.Decision, time.Duration) {
+	if r == nil {
+		return ratelimit.Allowed, 0
+	}
+	r.mu.RLock()
+	limiter := r.limiters[route]
+	r.mu.RUnlock()
+	return limiter.Try(topic)
+}
+
+// Number of topic throttles after which the idle throttles are removed
+const topicThrottlesEvictAt = 100
+
+// Each output topic matching the filter has its own limit
+type topicRateLimiter struct {
+	limit     routes.TopicRateLimit
+	action    ratelimit.Action
+	tasks     *Tasks
+	mu        sync.Mutex
+	throttles map[string]*ratelimit.Throttle
+	evictAt   int
+}
+
+func (t *topicRateLimiter) get(topic string) *ratelimit.Throttle {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	throttle, ok := t.throttles[topic]
+	if !ok {
+		if len(t.throttles) >= t.evictAt {
+			t.evictIdle()
+		}
+		throttle = ratelimit.NewThrottle(t.limit.Rate, t.limit.Burst, t.action, ratelimit.WithQueueSize(t.limit.QueueSize), ratelimit.WithAfterFunc(t.tasks.AfterFunc))
+		t.throttles[topic] = throttle
+	}
+	return throttle
+}
+
+// Remove the throttles which behave like new ones, so the throttles of topics which are
+// no longer used do not accumulate. The lock must be held
+func (t *topicRateLimiter) evictIdle() {
+	for topic, throttle := range t.throttles {
+		if throttle.Idle() {
+			delete(t.throttles, topic)
+		}
+	}
+	t.evictAt = max(topicThrottlesEvictAt, 2*len(t.throttles))
+}
+
+// Waiting messages are scheduled using the tasks, so they are sent when the tasks are flushed on shutdown
+func newRateLimiter(route routes.Route, tasks *Tasks, m *metrics.Metrics) (*rateLimiter, error) {
+	if route.RateLimit == nil {
+		return nil, nil
+	}
+	config := route.RateLimit
+	limiter := &rateLimiter{
+		route:   route.Name,
+		metrics: m,
+	}
+
+	if config.Rate < 0 {
+		return nil, fmt.Errorf("invalid rate limit. rate must be greater than 0. got=%v", config.Rate)
+	}
+	if config.Rate > 0 {
+		action, err := ratelimit.ParseAction(config.Action)
+		if err != nil {
+			return nil, err
+		}
+		limiter.throttle = ratelimit.NewThrottle(config.Rate, config.Burst, action, ratelimit.WithQueueSize(config.QueueSize), ratelimit.WithAfterFunc(tasks.AfterFunc))
+	}
+
+	for _, topicLimit := range config.Topics {
+		if topicLimit.Topic == "" {
+			return nil, fmt.Errorf("invalid topic rate limit. topic must not be empty")
+		}
+		if topicLimit.Rate <= 0 {
+			return nil, fmt.Errorf("invalid topic rate limit. rate must be greater than 0. topic=%s, got=%v", topicLimit.Topic, topicLimit.Rate)
+		}
+		action, err := ratelimit.ParseAction(topicLimit.Action)
+		if err != nil {
+			return nil, err
+		}
+		limiter.topics = append(limiter.topics, &topicRateLimiter{
+			limit:     topicLimit,
+			action:    action,
+			tasks:     tasks,
+			throttles: map[string]*ratelimit.Throttle{},
+			evictAt:   topicThrottlesEvictAt,
+		})
+	}
+	return limiter, nil
+}
+
+// A throttle and the name of its limit (the topic filter, or route)
+type namedThrottle struct {
+	limit    string
+	throttle *ratelimit.Throttle
+}
+
+// Throttles which apply to the topic, in the order they are applied.
+// The topic limits are applied first, followed by the route's limit
+func (l *rateLimiter) throttles(topic string) []namedThrottle {
+	throttles := make([]namedThrottle, 0, len(l.topics)+1)
+	if topic != "" {
+		for _, t := range l.topics {
+			if t.limit.Match(topic) {
+				throttles = append(throttles, namedThrottle{limit: t.limit.Topic, throttle: t.get(topic)})
+			}
+		}
+	}
+	if l.throttle != nil {
+		throttles = append(throttles, namedThrottle{limit: "route", throttle: l.throttle})
+	}
+	return throttles
+}
+
+// Wrap a function which sends a message so that it is only called when allowed by the rate limits
+func (l *rateLimiter) Wrap(topic string, send func()) func() {
+	if l == nil {
+		return send
+	}
+	throttles := l.throttles(topic)
+	allowed := send
+	send = func() {
+		l.metrics.RateLimited(l.route, string(ratelimit.Allowed))
+		allowed()
+	}
+	for i := len(throttles) - 1; i >= 0; i-- {
+		send = l.apply(throttles[i], topic, send)
+	}
+	return send
+}
+
+// Try applies the rate limits to a message which is kept by the caller (e.g. a persisted delayed message)
+// instead of being queued. If the message has to wait, then Queued is returned along with the time to wait
+// before trying again. Tokens are only taken if the message can be sent now
+func (l *rateLimiter) Try(topic string) (ratelimit.Decision, time.Duration) {
+	if l == nil {
+		return ratelimit.Allowed, 0
+	}
+	throttles := l.throttles(topic)
+	var wait time.Duration
+	for _, t := range throttles {
+		wait = max(wait, t.throttle.Wait())
+	}
+	if wait > 0 {
+		slog.Info("Rate limit exceeded. Message delayed.", "route", l.route, "topic", topic, "decision", ratelimit.Queued, "wait", wait)
+		l.metrics.RateLimited(l.route, string(ratelimit.Queued))
+		return ratelimit.Queued, wait
+	}
+	for _, t := range throttles {
+		if decision, wait := t.throttle.Try(); decision != ratelimit.Allowed {
+			l.report(t, topic, decision)
+			return decision, wait
+		}
+	}
+	l.metrics.RateLimited(l.route, string(ratelimit.Allowed))
+	return ratelimit.Allowed, 0
+}
+
+func (l *rateLimiter) apply(t namedThrottle, topic string, send func()) func() {
+	return func() {
+		if decision := t.throttle.Do(topic, send); decision != ratelimit.Allowed {
+			l.report(t, topic, decision)
+		}
+	}
+}
+
+func (l *rateLimiter) report(t namedThrottle, topic string, decision ratelimit.Decision) {
+	stats := t.throttle.Stats()
+	attrs := []any{"route", l.route, "topic", topic, "limit", t.limit, "decision", decision, "queued", stats.Queued, "dropped", stats.Dropped, "coalesced", stats.Coalesced, "overflowed", stats.Overflowed}
+	l.metrics.RateLimited(l.route, string(decision))
+	switch decision {
+	case ratelimit.Dropped:
+		slog.Warn("Rate limit exceeded. Message dropped.", attrs...)
+		l.metrics.Skipped(l.route, metrics.SkipRateLimited)
+	case ratelimit.Overflowed:
+		slog.Warn("Rate limit exceeded and queue is full. Message dropped.", attrs...)
+		l.metrics.Skipped(l.route, metrics.SkipRateLimited)
+	case ratelimit.Coalesced:
+		slog.Info("Rate limit exceeded. Message replaced the waiting message.", attrs...)
+		l.metrics.Skipped(l.route, metrics.SkipRateLimited)
+	default:
+		slog.Info("Rate limit exceeded. Message delayed.", attrs...)
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RateLimiterTopicLimits(t *testing.T) {
+	m := metrics.New()
+	limiter, err := newRateLimiter(routes.Route{
+		Name: "limited",
+		RateLimit: &routes.RateLimit{
+			Rate:   0.001,
+			Burst:  3,
+			Action: "drop",
+			Topics: []routes.TopicRateLimit{
+				{Topic: "te/+/+/+/+/m/+", Rate: 0.001, Burst: 1},
+			},
+		},
+	}, nil, m)
+	assert.NoError(t, err)
+
+	sent := map[string]int{}
+	send := func(topic string) {
+		limiter.Wrap(topic, func() { sent[topic]++ })()
+	}
+
+	// Each matching output topic has its own limit
+	send("te/device/main///m/env")
+	send("te/device/main///m/env")
+	send("te/device/child01///m/env")
+
+	// Other topics are only limited by the route's limit
+	send("c8y/s/us")
+	send("c8y/s/us")
+
+	assert.Equal(t, map[string]int{
+		"te/device/main///m/env":    1,
+		"te/device/child01///m/env": 1,
+		"c8y/s/us":                  1,
+	}, sent)
+	output := scrapeMetrics(m)
+	assert.Contains(t, output, `tedge_mapper_template_rate_limited_total{decision="allowed",route="limited"} 3`)
+	assert.Contains(t, output, `tedge_mapper_template_rate_limited_total{decision="dropped",route="limited"} 2`)
+}
+
+func Test_RateLimiterEvictsIdleTopicThrottles(t *testing.T) {
+	limiter, err := newRateLimiter(routes.Route{
+		Name: "limited",
+		RateLimit: &routes.RateLimit{
+			Topics: []routes.TopicRateLimit{{Topic: "out/+", Rate: 1000, Burst: 1}},
+		},
+	}, nil, nil)
+	assert.NoError(t, err)
+
+	for i := 0; i < topicThrottlesEvictAt; i++ {
+		limiter.Wrap(fmt.Sprintf("out/%d", i), func() {})()
+	}
+	assert.Len(t, limiter.topics[0].throttles, topicThrottlesEvictAt)
+
+	// The throttles are idle once their tokens are refilled
+	time.Sleep(10 * time.Millisecond)
+	limiter.Wrap("out/new", func() {})()
+	assert.Len(t, limiter.topics[0].throttles, 1)
+}
+
+func Test_RateLimiterWithoutLimit(t *testing.T) {
+	limiter, err := newRateLimiter(routes.Route{Name: "unlimited"}, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, limiter)
+
+	count := 0
+	for i := 0; i < 10; i++ {
+		limiter.Wrap("out", func() { count++ })()
+	}
+	assert.Equal(t, 10, count)
+}
+
+func Test_RateLimiterQueueIsFlushed(t *testing.T) {
+	tasks := NewTasks()
+	limiter, err := newRateLimiter(routes.Route{
+		Name:      "queued",
+		RateLimit: &routes.RateLimit{Rate: 0.001, Action: "queue"},
+	}, tasks, nil)
+	assert.NoError(t, err)
+
+	mu := sync.Mutex{}
+	sent := []int{}
+	for i := 0; i < 3; i++ {
+		i := i
+		limiter.Wrap("out", func() {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, i)
+		})()
+	}
+	assert.Equal(t, 1, tasks.Pending())
+
+	// The waiting messages are sent in order when shutting down
+	assert.NoError(t, tasks.Flush(context.Background()))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []int{0, 1, 2}, sent)
+}
+
+func Test_RateLimiterInvalidConfig(t *testing.T) {
+	testcases := map[string]routes.RateLimit{
+		"negative rate":      {Rate: -1},
+		"invalid action":     {Rate: 1, Action: "unknown"},
+		"missing topic":      {Topics: []routes.TopicRateLimit{{Rate: 1}}},
+		"missing topic rate": {Topics: []routes.TopicRateLimit{{Topic: "out"}}},
+	}
+	for name, config := range testcases {
+		config := config
+		t.Run(name, func(t *testing.T) {
+			_, err := NewStreamFactory(nil, nil, routes.Route{
+				Name:      name,
+				Template:  routes.Template{Type: "jsonnet", Value: "{}"},
+				RateLimit: &config,
+			}, nil, 2)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_DelayedMessagesUseRouteRateLimit(t *testing.T) {
+	m := metrics.New()
+	limiter, err := newRateLimiter(routes.Route{
+		Name:      "delayed",
+		RateLimit: &routes.RateLimit{Rate: 0.001, Action: "drop"},
+	}, nil, m)
+	assert.NoError(t, err)
+
+	client := newTestClient()
+	app := &Service{Client: client, RateLimiters: NewRateLimiters()}
+	app.RateLimiters.replace(map[string]*rateLimiter{routeKey("", "delayed"): limiter})
+
+	// Messages which are due at the same time are still limited
+	assert.NoError(t, app.sendDelayed(DelayedMessage{Type: DelayedMQTTMessage, Route: "delayed", Topic: "out/1", Payload: "1"}))
+	assert.NoError(t, app.sendDelayed(DelayedMessage{Type: DelayedMQTTMessage, Route: "delayed", Topic: "out/2", Payload: "2"}))
+	assert.NoError(t, app.sendDelayed(DelayedMessage{Type: DelayedMQTTMessage, Route: "other", Topic: "out/3", Payload: "3"}))
+
+	assert.Equal(t, map[string][]byte{"out/1": []byte("1"), "out/3": []byte("3")}, client.published)
+	output := scrapeMetrics(m)
+	assert.Contains(t, output, `tedge_mapper_template_rate_limited_total{decision="allowed",route="delayed"} 1`)
+	assert.Contains(t, output, `tedge_mapper_template_rate_limited_total{decision="dropped",route="delayed"} 1`)
+}
+
+func Test_RateLimitersFollowTheActiveRoutes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "routes.yaml")
+	app := &Service{Subscriptions: map[string]byte{}, RateLimiters: NewRateLimiters()}
+	app.NewHandler = func(route routes.Route) (MessageHandler, error) {
+		return NewStreamFactory(nil, nil, route, nil, 2, WithRateLimiters(app.RateLimiters))
+	}
+	active := func() *rateLimiter {
+		app.RateLimiters.mu.RLock()
+		defer app.RateLimiters.mu.RUnlock()
+		assert.Empty(t, app.RateLimiters.staged)
+		return app.RateLimiters.limiters[routeKey(file, "limited")]
+	}
+
+	writeRouteFile(t, file, heredoc.Doc(`
+		routes:
+		- name: limited
+		  topics: [in]
+		  rate_limit: {rate: 1}
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out'}"
+	`))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	limiter := active()
+	assert.NotNil(t, limiter)
+
+	// A failed reload keeps the limiter of the running route
+	writeRouteFile(t, file, heredoc.Doc(`
+		routes:
+		- name: limited
+		  topics: [in]
+		  rate_limit: {rate: 2}
+		  template:
+		    type: jsonnet
+		    value: "{topic: "
+	`))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Same(t, limiter, active())
+
+	// Removed routes remove their limiter
+	assert.NoError(t, os.Remove(file))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Nil(t, active())
+}
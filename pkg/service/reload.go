@@ -0,0 +1,283 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/jsonnet"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"gopkg.in/yaml.v3"
+)
+
+// RouteHandler is a loaded route and the handler which processes its messages
+type RouteHandler struct {
+	Route       routes.Route
+	Handler     MessageHandler
+	fingerprint string
+	// Files imported by the route's template
+	imports []string
+	// Rate limiter of the route, which is also used for its delayed messages
+	limiter *rateLimiter
+}
+
+// The fingerprint includes the contents of any external template file and of the files imported
+// by the template, so that changes to those files also cause the route to be reloaded.
+// The paths of the imported files are also returned
+func routeFingerprint(route routes.Route, libraryPaths []string) (string, []string, error) {
+	b, err := yaml.Marshal(route)
+	if err != nil {
+		return "", nil, err
+	}
+	tmpl, err := route.LoadTemplate()
+	if err != nil {
+		return "", nil, err
+	}
+
+	sb := strings.Builder{}
+	sb.Write(b)
+	sb.WriteString(tmpl)
+
+	// Invalid templates are reported when creating the handler
+	imports, err := jsonnet.Imports(route.TemplatePath(), tmpl, libraryPaths...)
+	if err != nil {
+		slog.Debug("Could not find the imports of the template.", "name", route.Name, "error", err)
+	}
+	paths := make([]string, 0, len(imports))
+	for path := range imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		sb.WriteString("\n" + path + "\n" + imports[path])
+	}
+	return sb.String(), paths, nil
+}
+
+// Load the routes from a single file. Routes which have not changed since the previous load
+// reuse their existing handler. The successfully loaded routes are always returned, even if
+// an error occurred, so the caller can decide if a partially loaded file should be used or not.
+// The names of the routes which failed to load are also returned.
+func (s *Service) loadRouteFile(path string, previous []RouteHandler) ([]RouteHandler, []string, error) {
+	spec, err := routes.ParseFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing := make(map[string]RouteHandler, len(previous))
+	for _, lr := range previous {
+		existing[lr.fingerprint] = lr
+	}
+
+	loaded := make([]RouteHandler, 0, len(spec.Routes))
+	errList := make([]error, 0)
+	failed := make([]string, 0)
+	for _, route := range enabledRoutes(path, spec) {
+		fingerprint, imports, err := routeFingerprint(route, s.LibraryPaths)
+		if err != nil {
+			errList = append(errList, fmt.Errorf("route=%s. %w", route.Name, err))
+			failed = append(failed, route.Name)
+			continue
+		}
+
+		if prev, ok := existing[fingerprint]; ok {
+			slog.Debug("Route is unchanged.", "name", route.Name, "file", path)
+			loaded = append(loaded, prev)
+			continue
+		}
+
+		lr := RouteHandler{
+			Route:       route,
+			fingerprint: fingerprint,
+			imports:     imports,
+		}
+
+		if route.Skip {
+			slog.Info("Ignoring route marked as skip.", "name", route.Name, "topics", route.DisplayTopics())
+			loaded = append(loaded, lr)
+			continue
+		}
+
+		if s.NewHandler == nil {
+			errList = append(errList, fmt.Errorf("route=%s. no handler factory", route.Name))
+			failed = append(failed, route.Name)
+			continue
+		}
+
+		slog.Info("Registering route.", "name", route.Name, "topics", route.DisplayTopics())
+		handler, err := s.NewHandler(route)
+		if err != nil {
+			slog.Warn("Failed to register route.", "name", route.Name, "file", path, "error", err)
+			errList = append(errList, fmt.Errorf("route=%s. %w", route.Name, err))
+			failed = append(failed, route.Name)
+			continue
+		}
+		lr.Handler = handler
+		lr.limiter = s.RateLimiters.claim(routeKey(route.File, route.Name))
+		loaded = append(loaded, lr)
+	}
+	return loaded, failed, errors.Join(errList...)
+}
+
+// ReloadRoutes scans the given directories for route files and applies any changes
+// to the registered routes. Only new or changed routes are recreated, and any topics
+// which are no longer used are unsubscribed from.
+//
+// If a file which was previously loaded fails to parse, or any of its routes fail to compile,
+// then the previous version of the file is kept.
+func (s *Service) ReloadRoutes(dirs []string) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.RLock()
+	previous := s.loaded
+	previousDisabled := s.disabled
+	s.mu.RUnlock()
+
+	files, err := findRouteFiles(dirs)
+	if err != nil {
+		if previous != nil {
+			return fmt.Errorf("failed to scan route directories. keeping existing routes. %w", err)
+		}
+		slog.Default().Warn("Error whilst looking for files.", "err", err)
+	}
+
+	next := make(map[string][]RouteHandler, len(files))
+	disabled := make(map[string][]string, len(files))
+	for _, path := range files {
+		loaded, failed, err := s.loadRouteFile(path, previous[path])
+		if err != nil {
+			if prev, ok := previous[path]; ok {
+				slog.Warn("Failed to reload route file. The previous version will be kept.", "file", path, "error", err)
+				next[path] = prev
+				disabled[path] = previousDisabled[path]
+				continue
+			}
+			slog.Warn("Failed to load route file. Invalid routes will be ignored.", "file", path, "error", err)
+		}
+		next[path] = loaded
+		disabled[path] = failed
+	}
+
+	for path := range previous {
+		if _, ok := next[path]; !ok {
+			slog.Info("Removing routes from deleted file.", "file", path)
+		}
+	}
+
+	err = s.applyRoutes(files, next)
+
+	disabledRoutes := make([]string, 0)
+	for _, path := range files {
+		disabledRoutes = append(disabledRoutes, disabled[path]...)
+	}
+	s.mu.Lock()
+	s.disabled = disabled
+	s.mu.Unlock()
+	s.Health.SetDisabledRoutes(disabledRoutes)
+
+	s.PublishRoutes()
+	return err
+}
+
+// Directories containing external template files (and the files they import) used by the loaded routes
+func (s *Service) TemplateDirs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.templateDirs
+}
+
+// Swap the active routes and handlers, and update the subscriptions
+func (s *Service) applyRoutes(files []string, loaded map[string][]RouteHandler) error {
+	activeRoutes := make([]routes.Route, 0)
+	handlers := make([]RouteHandler, 0)
+	subscriptions := make(map[string]byte)
+	brokerSubscriptions := make(map[string]map[string]byte)
+	templateDirs := make([]string, 0)
+	limiters := make(map[string]*rateLimiter)
+
+	for _, path := range files {
+		for _, lr := range loaded[path] {
+			activeRoutes = append(activeRoutes, lr.Route)
+			if templatePath := lr.Route.TemplatePath(); templatePath != "" {
+				templateDirs = append(templateDirs, filepath.Dir(templatePath))
+			}
+			for _, path := range lr.imports {
+				templateDirs = append(templateDirs, filepath.Dir(path))
+			}
+			if lr.Handler == nil {
+				continue
+			}
+			handlers = append(handlers, lr)
+			if lr.limiter != nil {
+				limiters[routeKey(lr.Route.File, lr.Route.Name)] = lr.limiter
+			}
+			for _, topic := range lr.Route.Topics {
+				if topic.Broker == DefaultBroker {
+					subscriptions[topic.Topic] = 1
+					continue
+				}
+				if brokerSubscriptions[topic.Broker] == nil {
+					brokerSubscriptions[topic.Broker] = make(map[string]byte)
+				}
+				brokerSubscriptions[topic.Broker][topic.Topic] = 1
+			}
+		}
+	}
+
+	// Use the same order as the routes check command
+	routes.SortByPriority(activeRoutes)
+	sort.SliceStable(handlers, func(i, j int) bool {
+		return handlers[i].Route.Priority > handlers[j].Route.Priority
+	})
+
+	s.mu.Lock()
+	current := s.Subscriptions
+	currentBrokers := s.BrokerSubscriptions
+	s.templateDirs = templateDirs
+	// Limiters of removed routes are dropped, and failed reloads keep the limiter of the previous version
+	s.RateLimiters.replace(limiters)
+	s.Routes = activeRoutes
+	s.handlers = handlers
+	s.Subscriptions = subscriptions
+	s.BrokerSubscriptions = brokerSubscriptions
+	s.loaded = loaded
+	subscribed := s.subscribed
+	s.mu.Unlock()
+
+	if !subscribed {
+		return nil
+	}
+
+	removed, added := diffSubscriptions(current, subscriptions)
+	errList := []error{s.unsubscribe(removed...), s.subscribe(added)}
+	for name, client := range s.Brokers {
+		if !client.IsConnectionOpen() {
+			// The subscriptions are restored once connected
+			continue
+		}
+		removed, added := diffSubscriptions(currentBrokers[name], brokerSubscriptions[name])
+		errList = append(errList, unsubscribeTopics(client, removed...), subscribeTopics(client, added))
+	}
+	return errors.Join(errList...)
+}
+
+// Topics which need to be unsubscribed from and subscribed to when changing the subscriptions
+func diffSubscriptions(current, next map[string]byte) ([]string, map[string]byte) {
+	removed := make([]string, 0)
+	for topic := range current {
+		if _, ok := next[topic]; !ok {
+			removed = append(removed, topic)
+		}
+	}
+	added := make(map[string]byte)
+	for topic, qos := range next {
+		if prevQoS, ok := current[topic]; !ok || prevQoS != qos {
+			added[topic] = qos
+		}
+	}
+	return removed, added
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRouteFile(t *testing.T, path string, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ReloadRoutes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "routes.yaml")
+
+	created := map[string]int{}
+	app := &Service{
+		Subscriptions: map[string]byte{},
+		NewHandler: func(route routes.Route) (MessageHandler, error) {
+			created[route.Name]++
+			return NewStreamFactory(nil, nil, route, nil, 2)
+		},
+	}
+
+	writeRouteFile(t, file, heredoc.Doc(`
+		routes:
+		- name: route1
+		  topics: [in/1]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/1'}"
+		- name: route2
+		  topics: [in/2]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/2'}"
+	`))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Len(t, app.GetRoutes(), 2)
+	assert.Equal(t, map[string]byte{"in/1": 1, "in/2": 1}, app.Subscriptions)
+	assert.Equal(t, "routes.yaml", filepath.Base(app.GetRoutes()[0].File))
+
+	// Only changed routes are recreated, and unused topics are removed
+	writeRouteFile(t, file, heredoc.Doc(`
+		routes:
+		- name: route1
+		  topics: [in/1]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/1'}"
+		- name: route2
+		  topics: [in/3]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/2'}"
+	`))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Equal(t, map[string]byte{"in/1": 1, "in/3": 1}, app.Subscriptions)
+	assert.Equal(t, 1, created["route1"])
+	assert.Equal(t, 2, created["route2"])
+
+	// Invalid templates keep the previous version of the file
+	writeRouteFile(t, file, heredoc.Doc(`
+		routes:
+		- name: route1
+		  topics: [in/4]
+		  template:
+		    type: jsonnet
+		    value: "{topic: "
+	`))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Len(t, app.GetRoutes(), 2)
+	assert.Equal(t, map[string]byte{"in/1": 1, "in/3": 1}, app.Subscriptions)
+
+	// Invalid yaml keeps the previous version of the file
+	writeRouteFile(t, file, "routes: [")
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Len(t, app.GetRoutes(), 2)
+
+	// Deleted files remove the routes
+	assert.NoError(t, os.Remove(file))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Len(t, app.GetRoutes(), 0)
+	assert.Empty(t, app.Subscriptions)
+}
+
+func Test_ReloadRoutesWithChangedImports(t *testing.T) {
+	dir := t.TempDir()
+	templateDir := filepath.Join(dir, "templates")
+	assert.NoError(t, os.Mkdir(templateDir, 0755))
+
+	created := 0
+	app := &Service{
+		Subscriptions: map[string]byte{},
+		NewHandler: func(route routes.Route) (MessageHandler, error) {
+			created++
+			return NewStreamFactory(nil, nil, route, nil, 2)
+		},
+	}
+
+	writeRouteFile(t, filepath.Join(dir, "routes.yaml"), heredoc.Doc(`
+		routes:
+		- name: route1
+		  topics: [in/1]
+		  template:
+		    type: jsonnet
+		    path: ./templates/route1.jsonnet
+	`))
+	writeRouteFile(t, filepath.Join(templateDir, "route1.jsonnet"), "local utils = import 'utils.libsonnet';\n{topic: utils.topic}")
+	writeRouteFile(t, filepath.Join(templateDir, "utils.libsonnet"), "{topic: 'out/1'}")
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Equal(t, 1, created)
+	assert.Contains(t, app.TemplateDirs(), templateDir)
+
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Equal(t, 1, created)
+
+	// Changing an imported file also reloads the route
+	writeRouteFile(t, filepath.Join(templateDir, "utils.libsonnet"), "{topic: 'out/2'}")
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+	assert.Equal(t, 2, created)
+}
+
+func Test_MatchingRoutesUsePriority(t *testing.T) {
+	dir := t.TempDir()
+	app := &Service{
+		Subscriptions: map[string]byte{},
+		NewHandler: func(route routes.Route) (MessageHandler, error) {
+			return NewStreamFactory(nil, nil, route, nil, 2)
+		},
+	}
+
+	writeRouteFile(t, filepath.Join(dir, "a.yaml"), heredoc.Doc(`
+		routes:
+		- name: first
+		  topics: [in/+]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/1'}"
+		- name: second
+		  topics: [in/value]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/2'}"
+	`))
+	writeRouteFile(t, filepath.Join(dir, "b.yaml"), heredoc.Doc(`
+		routes:
+		- name: high priority
+		  topics: [in/#]
+		  priority: 10
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/3'}"
+		- name: other topic
+		  topics: [other]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/4'}"
+	`))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+
+	names := []string{}
+	for _, rh := range app.MatchingRoutes("in/value") {
+		names = append(names, rh.Route.Name)
+	}
+	assert.Equal(t, []string{"high priority", "first", "second"}, names)
+	assert.Equal(t, map[string]byte{"in/+": 1, "in/value": 1, "in/#": 1, "other": 1}, app.Subscriptions)
+}
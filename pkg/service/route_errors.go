@@ -0,0 +1,142 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	tmplerrors "github.com/reubenmiller/tedge-mapper-template/pkg/errors"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/ratelimit"
+)
+
+// Stages of the message processing where an error can occur
+const (
+	StagePreprocessor = "preprocessor"
+	StageTemplate     = "template"
+	StageOutput       = "output"
+	StageAPI          = "api"
+	StageDepth        = "depth"
+)
+
+// Maximum number of bytes of the input payload which is included in a route error
+const MaxRouteErrorPayloadSize = 1024
+
+// Default number of route errors which are published per second
+const DefaultRouteErrorRate = 1.0
+
+// Number of route errors which can be published at once before the rate applies
+const DefaultRouteErrorBurst = 5
+
+// Default topic of the route errors. The topic is a thin-edge.io event, so the
+// errors are also visible in the cloud
+func DefaultRouteErrorTopic(clientID string) string {
+	return fmt.Sprintf("te/device/main/service/%s/e/route_error", clientID)
+}
+
+// RouteError is published when a route fails to process a message
+type RouteError struct {
+	// Text of the thin-edge.io event
+	Text  string `json:"text"`
+	Time  string `json:"time"`
+	Route string `json:"route"`
+	Stage string `json:"stage"`
+	Topic string `json:"topic"`
+	// Input payload (truncated to MaxRouteErrorPayloadSize)
+	Payload          string `json:"payload"`
+	PayloadTruncated bool   `json:"payload_truncated,omitempty"`
+	Error            string `json:"error"`
+}
+
+// Template errors are caused by either the template itself, or by an output which
+// does not match the expected format
+func templateStage(err error) string {
+	if errors.Is(err, tmplerrors.ErrInvalidOutput) {
+		return StageOutput
+	}
+	return StageTemplate
+}
+
+var ansiEscapeCodes = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+func NewRouteError(route, stage, topic, payload string, err error) RouteError {
+	message := ansiEscapeCodes.ReplaceAllString(err.Error(), "")
+	e := RouteError{
+		Text:  fmt.Sprintf("Route %q failed to process message (%s). %s", route, stage, firstLine(message)),
+		Time:  time.Now().Format(time.RFC3339Nano),
+		Route: route,
+		Stage: stage,
+		Topic: topic,
+		Error: message,
+	}
+	e.Payload, e.PayloadTruncated = truncate(payload, MaxRouteErrorPayloadSize)
+	return e
+}
+
+func firstLine(s string) string {
+	for i, c := range s {
+		if c == '\n' {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// Truncate a string to the maximum number of bytes without splitting a multi-byte character
+func truncate(s string, size int) (string, bool) {
+	if len(s) <= size {
+		return s, false
+	}
+	for size > 0 && !utf8.RuneStart(s[size]) {
+		size--
+	}
+	return s[:size], true
+}
+
+// ErrorReporter publishes route errors to a MQTT topic. The number of published errors is
+// limited, so a route failing on every message does not flood the broker
+type ErrorReporter struct {
+	topic      string
+	limiter    *ratelimit.Limiter
+	suppressed atomic.Int64
+	publish    func(topic string, payload []byte)
+}
+
+func NewErrorReporter(client mqtt.Client, topic string, rate float64, burst int) *ErrorReporter {
+	return &ErrorReporter{
+		topic:   topic,
+		limiter: ratelimit.NewLimiter(rate, max(burst, 1)),
+		publish: func(topic string, payload []byte) {
+			if client != nil {
+				client.Publish(topic, 1, false, payload)
+			}
+		},
+	}
+}
+
+// Report a route error. Errors exceeding the rate limit are only logged
+func (r *ErrorReporter) Report(e RouteError) {
+	if r == nil {
+		return
+	}
+	if !r.limiter.Allow() {
+		r.suppressed.Add(1)
+		slog.Debug("Route error rate limit exceeded. Error was not published.", "route", e.Route, "stage", e.Stage)
+		return
+	}
+	if suppressed := r.suppressed.Swap(0); suppressed > 0 {
+		slog.Warn("Some route errors were not published due to the rate limit.", "suppressed", suppressed)
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		slog.Warn("Could not create route error message.", "route", e.Route, "error", err)
+		return
+	}
+	r.publish(r.topic, payload)
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestErrorReporter(burst int) (*ErrorReporter, *[]RouteError) {
+	published := []RouteError{}
+	reporter := NewErrorReporter(nil, "te/device/main/service/test/e/route_error", 0.001, burst)
+	reporter.publish = func(topic string, payload []byte) {
+		e := RouteError{}
+		if err := json.Unmarshal(payload, &e); err == nil {
+			published = append(published, e)
+		}
+	}
+	return reporter, &published
+}
+
+func Test_RouteErrorsArePublished(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Template string
+		Message  string
+		Stage    string
+		Error    string
+	}{
+		{
+			Name:     "template error",
+			Template: `{topic: 'out', message: error 'custom failure'}`,
+			Stage:    StageTemplate,
+			Error:    "custom failure",
+		},
+		{
+			Name:     "invalid output",
+			Template: `{topic: ['out'], message: {}}`,
+			Stage:    StageOutput,
+			Error:    "invalid output message",
+		},
+		{
+			Name:     "invalid api request",
+			Template: `{api: {method: 'FETCH', path: 'inventory/managedObjects'}, message: {}}`,
+			Stage:    StageAPI,
+			Error:    "method not allowed",
+		},
+		{
+			Name:     "depth exceeded",
+			Template: `{topic: 'out', message: {value: 1}}`,
+			Message:  `{"_ctx": {"lvl": 5}}`,
+			Stage:    StageDepth,
+			Error:    "recursive message level exceeded",
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.Name, func(t *testing.T) {
+			reporter, published := newTestErrorReporter(10)
+			handler, err := NewStreamFactory(nil, nil, routes.Route{
+				Name:     "failing",
+				Topics:   []routes.Topic{{Topic: "in"}},
+				Template: routes.Template{Type: "jsonnet", Value: c.Template},
+			}, nil, 2, WithErrorReporter(reporter))
+			assert.NoError(t, err)
+
+			message := c.Message
+			if message == "" {
+				message = `{"value": 1}`
+			}
+			_, err = handler("in", message, template.Metadata{})
+			assert.Error(t, err)
+
+			if assert.Len(t, *published, 1) {
+				e := (*published)[0]
+				assert.Equal(t, "failing", e.Route)
+				assert.Equal(t, c.Stage, e.Stage)
+				assert.Equal(t, "in", e.Topic)
+				assert.Equal(t, message, e.Payload)
+				assert.Contains(t, e.Error, c.Error)
+				assert.NotEmpty(t, e.Text)
+				assert.NotEmpty(t, e.Time)
+			}
+		})
+	}
+}
+
+func Test_RouteErrorsAreRateLimited(t *testing.T) {
+	reporter, published := newTestErrorReporter(2)
+	handler, err := NewStreamFactory(nil, nil, routes.Route{
+		Name:     "failing",
+		Topics:   []routes.Topic{{Topic: "in"}},
+		Template: routes.Template{Type: "jsonnet", Value: `error 'failure'`},
+	}, nil, 2, WithErrorReporter(reporter))
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err := handler("in", `{}`, template.Metadata{})
+		assert.Error(t, err)
+	}
+	assert.Len(t, *published, 2)
+}
+
+func Test_RouteErrorPayloadIsTruncated(t *testing.T) {
+	payload := strings.Repeat("ä", MaxRouteErrorPayloadSize)
+	e := NewRouteError("route", StageTemplate, "in", payload, assert.AnError)
+	assert.True(t, e.PayloadTruncated)
+	assert.LessOrEqual(t, len(e.Payload), MaxRouteErrorPayloadSize)
+	assert.True(t, strings.HasPrefix(payload, e.Payload))
+	assert.Equal(t, strings.Repeat("ä", MaxRouteErrorPayloadSize/2), e.Payload)
+
+	e = NewRouteError("route", StageTemplate, "in", "short", assert.AnError)
+	assert.False(t, e.PayloadTruncated)
+	assert.Equal(t, "short", e.Payload)
+}
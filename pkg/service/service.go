@@ -6,21 +6,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/reubenmiller/go-c8y/pkg/c8y"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/pipeline"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/streamer"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"gopkg.in/yaml.v3"
 )
 
 type Entity struct {
@@ -135,11 +138,65 @@ func (s *EntityStore) Get(key string) (Entity, error) {
 }
 
 type Service struct {
-	Client        mqtt.Client
-	APIClient     *APIClient
-	Subscriptions map[string]byte
-	Routes        []routes.Route
-	EntityStore   *EntityStore
+	Client mqtt.Client
+	// Client used to listen to entity registration messages
+	RegistrationClient mqtt.Client
+	APIClient          *APIClient
+	Subscriptions      map[string]byte
+	Routes             []routes.Route
+	EntityStore        *EntityStore
+	// thin-edge.io topic of the service, e.g. te/device/main/service/<clientid>
+	ServiceTopic string
+
+	// Factory used to create the message handler of each route when (re)loading routes
+	NewHandler HandlerFactory
+	// Jsonnet library paths used to resolve the imports of the templates
+	LibraryPaths []string
+
+	// Pipeline used to process messages. If nil, messages are processed in the mqtt client's callback
+	Pipeline *pipeline.Pipeline
+	// Key used to preserve the message order when using a pipeline (defaults to the topic)
+	OrderingKey pipeline.KeyFunc
+
+	// Queue used to persist delayed messages. If nil, delayed messages are only kept in memory
+	DelayQueue *DelayQueue
+	// Outbox used to buffer api requests whilst the api is unreachable. If nil, requests are not buffered
+	Outbox *Outbox
+
+	// Named api clients which routes can send requests to (using api.endpoint)
+	Endpoints Endpoints
+
+	// Named broker connections which routes can receive messages from and publish messages to
+	Brokers map[string]mqtt.Client
+	// Topics of the named brokers which are subscribed to by the routes
+	BrokerSubscriptions map[string]map[string]byte
+
+	// Prometheus metrics. If nil, no metrics are recorded
+	Metrics *metrics.Metrics
+	// Conditions which degrade the health of the service
+	Health *Health
+	// Delayed messages and api retries which are kept in memory
+	Tasks *Tasks
+	// Rate limiters of the routes, used when sending delayed messages
+	RateLimiters *RateLimiters
+
+	mu       sync.RWMutex
+	reloadMu sync.Mutex
+	handlers []RouteHandler
+	loaded   map[string][]RouteHandler
+	// names of the routes of each file which failed to load
+	disabled map[string][]string
+	// directories of external template files (which are also watched for changes)
+	templateDirs []string
+	subscribed   bool
+
+	// topics with their own callback, which are subscribed to again after reconnecting
+	callbackSubscriptions map[string]byte
+
+	// messages are no longer accepted once the service is stopping
+	stopMu   sync.RWMutex
+	stopping bool
+	inflight sync.WaitGroup
 }
 
 func (s *Service) GetVariables() string {
@@ -148,6 +205,8 @@ func (s *Service) GetVariables() string {
 
 type APIClient struct {
 	*c8y.Client
+	// Authentication is added by the http transport (e.g. endpoints), so the client's credentials are not sent
+	TransportAuth bool
 }
 
 type SettingOption func() string
@@ -243,37 +302,62 @@ func (c *APIClient) SendRequest(ctx context.Context, options c8y.RequestOptions)
 
 var ErrNoMQTTClient = errors.New("no mqtt client")
 
-func NewService(broker string, clientID string, cleanSession bool, httpEndpoint string, dryRun bool) (*Service, error) {
-	parentTopic := "device/main//"
+func NewService(broker string, clientID string, cleanSession bool, httpEndpoint string, dryRun bool, mqttOptions MQTTOptions) (*Service, error) {
 	tedgeTarget := fmt.Sprintf("te/device/main/service/%s", clientID)
 	healthTopic := fmt.Sprintf("%s/status/health", tedgeTarget)
-	opts := mqtt.NewClientOptions().SetClientID(clientID).AddBroker(broker).SetCleanSession(cleanSession).SetWill(healthTopic, `{"status":"down"}`, 1, true)
-	client := mqtt.NewClient(opts)
+	service := &Service{
+		Subscriptions: map[string]byte{},
+		Routes:        []routes.Route{},
+		EntityStore:   NewEntityStore(),
+		ServiceTopic:  tedgeTarget,
+		Health:        NewHealth(DefaultHealthWindow),
+		Tasks:         NewTasks(),
+		RateLimiters:  NewRateLimiters(),
+		handlers:      []RouteHandler{},
+	}
+
+	// All messages are dispatched by the service, as multiple routes can share the same topic
+	client, err := mqttOptions.newClient(broker, clientID, cleanSession, clientHandlers{
+		OnConnect:        service.onConnect,
+		OnMessage:        service.onMessage,
+		OnConnectionLost: service.onConnectionLost,
+		WillTopic:        healthTopic,
+		WillPayload:      `{"status":"down"}`,
+	})
+	if err != nil {
+		return nil, err
+	}
+	service.Client = client
 
 	if !dryRun {
 		if token := client.Connect(); token.Wait() && token.Error() != nil {
 			return nil, token.Error()
 		}
 	}
+	service.APIClient = NewCumulocityClient(httpEndpoint)
+	if err := service.publishRegistration(); err != nil {
+		return nil, err
+	}
+	service.PublishHealth()
+	return service, nil
+}
 
-	service := &Service{
-		Client:        client,
-		Subscriptions: map[string]byte{},
-		Routes:        []routes.Route{},
-		EntityStore:   NewEntityStore(),
+// Register the service with thin-edge.io
+func (s *Service) publishRegistration() error {
+	if s.Client == nil || !s.Client.IsConnected() {
+		return nil
 	}
-	service.APIClient = NewCumulocityClient(httpEndpoint)
 	serviceRegistrationMessage := map[string]any{
 		"@type":   "service",
-		"@parent": parentTopic,
+		"@parent": "device/main//",
 	}
 	msg, err := json.Marshal(serviceRegistrationMessage)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	client.Publish(tedgeTarget, 1, true, msg).Wait()
-	client.Publish(healthTopic, 1, true, `{"status":"up"}`).Wait()
-	return service, nil
+	token := s.Client.Publish(s.ServiceTopic, 1, true, msg)
+	token.Wait()
+	return token.Error()
 }
 
 func isYaml(name string) bool {
@@ -281,22 +365,21 @@ func isYaml(name string) bool {
 }
 
 func (s *Service) GetRoutes() []routes.Route {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.Routes
 }
 
 func (s *Service) ClearRoutes() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Routes = nil
 }
 
-// Scan for routes from a directory. It will automatically add routes to the existing list.
-// Use an explicit call to ClearRoutes if you want to clear existing routes before calling this function.
-// Note: Currently routes are not unregistered from the MQTT client. For this to occur the MQTT client needs
-// to be stopped and destroyed.
-func (s *Service) ScanMappingFiles(dirs []string) []routes.Route {
-	if s.Routes == nil {
-		s.Routes = make([]routes.Route, 0)
-	}
-
+// Find all route files in the given directories
+func findRouteFiles(dirs []string) ([]string, error) {
+	files := make([]string, 0)
+	errList := make([]error, 0)
 	for _, dir := range dirs {
 		slog.Info("Scanning for routes.", "path", dir)
 		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
@@ -307,73 +390,234 @@ func (s *Service) ScanMappingFiles(dirs []string) []routes.Route {
 				return nil
 			}
 			if isYaml(d.Name()) {
-				file, err := os.Open(path)
-				if err != nil {
-					return err
-				}
-				b, err := io.ReadAll(file)
-				if err != nil {
-					return err
-				}
-
-				spec := &routes.Specification{}
-				if err := yaml.Unmarshal(b, spec); err != nil {
-					return err
-				}
-				if !spec.Disable {
-					for _, r := range spec.Routes {
-						if !r.Disable {
-							s.Routes = append(s.Routes, r)
-						} else {
-							slog.Info("Ignoring disabled route", "file", path, "route", r.Name)
-						}
-					}
-				} else {
-					slog.Info("Skipping routes as file is marked as disabled.", "file", path)
-				}
+				files = append(files, path)
 			}
 			return nil
 		})
 		if err != nil {
-			slog.Default().Warn("Error whilst looking for files.", "err", err)
+			errList = append(errList, err)
 		}
 	}
-	return s.Routes
+	return files, errors.Join(errList...)
 }
 
-type MessageHandler func(topic string, message_in string) (message_out *streamer.OutputMessage, err error)
+// Scan for routes from a directory. It will automatically add routes to the existing list.
+// Use an explicit call to ClearRoutes if you want to clear existing routes before calling this function.
+// Note: Scanning does not register the routes. Use ReloadRoutes to register the routes with the MQTT client.
+func (s *Service) ScanMappingFiles(dirs []string) []routes.Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Routes == nil {
+		s.Routes = make([]routes.Route, 0)
+	}
 
-func (s *Service) Register(topics []string, qos byte, handler MessageHandler) error {
-	handlerWrapper := func(c mqtt.Client, m mqtt.Message) {
-		payloadLen := len(m.Payload())
-		slog.Info("Received message.", "topic", m.Topic(), "payload_len", payloadLen)
+	files, err := findRouteFiles(dirs)
+	if err != nil {
+		slog.Default().Warn("Error whilst looking for files.", "err", err)
+	}
+	for _, path := range files {
+		spec, err := routes.ParseFile(path)
+		if err != nil {
+			slog.Default().Warn("Error whilst looking for files.", "err", err)
+			continue
+		}
+		s.Routes = append(s.Routes, enabledRoutes(path, spec)...)
+	}
+	routes.SortByPriority(s.Routes)
+	return s.Routes
+}
 
-		if payloadLen == 0 {
-			slog.Info("Ignoring empty message", "topic", m.Topic())
-			return
+func enabledRoutes(path string, spec *routes.Specification) []routes.Route {
+	enabled := make([]routes.Route, 0, len(spec.Routes))
+	if spec.Disable {
+		slog.Info("Skipping routes as file is marked as disabled.", "file", path)
+		return enabled
+	}
+	for _, r := range spec.Routes {
+		if !r.Disable {
+			enabled = append(enabled, r)
+		} else {
+			slog.Info("Ignoring disabled route", "file", path, "route", r.Name)
 		}
-		handler(m.Topic(), string(m.Payload()))
 	}
+	return enabled
+}
+
+type MessageHandler func(topic string, message_in string, metadata template.Metadata) (message_out *streamer.OutputMessage, err error)
 
+// HandlerFactory creates the message handler for a route
+type HandlerFactory func(route routes.Route) (MessageHandler, error)
+
+// Register a handler for the given topics. If the subscriptions have already been started,
+// then the topics are subscribed to immediately.
+// Note: Handlers registered manually will be replaced the next time the routes are reloaded.
+func (s *Service) Register(topics []string, qos byte, handler MessageHandler) error {
+	s.mu.Lock()
+	added := map[string]byte{}
+	routeTopics := make([]routes.Topic, 0, len(topics))
 	for _, topic := range topics {
-		if _, exists := s.Subscriptions[topic]; exists {
-			slog.Warn("Duplicate topic detected. The new handler will replace the previous one.", "topic", topic)
+		if _, exists := s.Subscriptions[topic]; !exists {
+			added[topic] = qos
 		}
 		s.Subscriptions[topic] = qos
+		routeTopics = append(routeTopics, routes.Topic{Topic: topic})
 		slog.Info("Adding mqtt route.", "topic", topic)
-		s.Client.AddRoute(topic, handlerWrapper)
+	}
+	s.handlers = append(s.handlers, RouteHandler{
+		Route: routes.Route{
+			Topics: routeTopics,
+		},
+		Handler: handler,
+	})
+	subscribed := s.subscribed
+	s.mu.Unlock()
+
+	if subscribed {
+		return s.subscribe(added)
+	}
+	return nil
+}
+
+// MatchingRoutes returns the routes (and their handlers) which match the given topic,
+// in the order that they should be processed
+func (s *Service) MatchingRoutes(topic string) []RouteHandler {
+	return s.MatchingBrokerRoutes(DefaultBroker, topic)
+}
+
+// MatchingBrokerRoutes returns the routes (and their handlers) which match the topic of
+// a message received from the named broker, in the order that they should be processed
+func (s *Service) MatchingBrokerRoutes(broker string, topic string) []RouteHandler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matches := make([]RouteHandler, 0)
+	for _, rh := range s.handlers {
+		if rh.Route.MatchBroker(broker, topic) {
+			matches = append(matches, rh)
+		}
+	}
+	return matches
+}
+
+// Dispatch a received message to all of the matching routes
+func (s *Service) onMessage(c mqtt.Client, m mqtt.Message) {
+	s.dispatch(DefaultBroker, m)
+}
+
+// Dispatch a message received from the named broker to all of the matching routes
+func (s *Service) dispatch(broker string, m mqtt.Message) {
+	payloadLen := len(m.Payload())
+	slog.Info("Received message.", "broker", broker, "topic", m.Topic(), "payload_len", payloadLen)
+
+	if payloadLen == 0 {
+		slog.Info("Ignoring empty message", "topic", m.Topic())
+		return
+	}
+
+	topic := m.Topic()
+	payload := string(m.Payload())
+	metadata := messageMetadata(m)
+	metadata.Envelope.Broker = broker
+	matches := s.MatchingBrokerRoutes(broker, topic)
+	if m.Retained() {
+		matches = slices.DeleteFunc(matches, func(rh RouteHandler) bool {
+			if rh.Route.IgnoreRetained {
+				slog.Debug("Route is ignoring retained message.", "route", rh.Route.Name, "topic", topic)
+			}
+			return rh.Route.IgnoreRetained
+		})
+	}
+	if len(matches) == 0 {
+		return
+	}
+
+	s.stopMu.RLock()
+	if s.stopping {
+		s.stopMu.RUnlock()
+		slog.Info("Ignoring message as the service is stopping.", "topic", topic)
+		return
+	}
+	// Messages processed by the pipeline are waited for when closing the pipeline
+	if s.Pipeline == nil {
+		s.inflight.Add(1)
+	}
+	s.stopMu.RUnlock()
+
+	process := func() {
+		for _, rh := range matches {
+			if _, err := rh.Handler(topic, payload, metadata); err != nil {
+				slog.Debug("Route returned an error.", "route", rh.Route.Name, "error", err)
+			}
+		}
+	}
+
+	if s.Pipeline == nil {
+		defer s.inflight.Done()
+		process()
+		return
+	}
+
+	key := topic
+	if s.OrderingKey != nil {
+		key = s.OrderingKey(topic)
+	}
+	if err := s.Pipeline.Submit(key, process); err != nil {
+		slog.Warn("Message was not processed.", "topic", topic, "error", err)
+	}
+}
+
+func (s *Service) subscribe(topics map[string]byte) error {
+	return subscribeTopics(s.Client, topics)
+}
+
+func (s *Service) unsubscribe(topics ...string) error {
+	return unsubscribeTopics(s.Client, topics...)
+}
+
+func subscribeTopics(client mqtt.Client, topics map[string]byte) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	slog.Info("Subscribing to MQTT topics.", "topics", topics)
+	if token := client.SubscribeMultiple(topics, nil); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("error subscribing to topic '%v': %v", topics, token.Error())
+	}
+	return nil
+}
+
+func unsubscribeTopics(client mqtt.Client, topics ...string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	slog.Info("Unsubscribing from MQTT topics.", "topics", topics)
+	if token := client.Unsubscribe(topics...); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("error unsubscribing from topic '%v': %v", topics, token.Error())
 	}
 	return nil
 }
 
 func (s *Service) StartSubscriptions() error {
-	if len(s.Subscriptions) == 0 {
+	s.mu.Lock()
+	s.subscribed = true
+	subscriptions := make(map[string]byte, len(s.Subscriptions))
+	for topic, qos := range s.Subscriptions {
+		subscriptions[topic] = qos
+	}
+	brokerSubscriptions := make(map[string]map[string]byte, len(s.BrokerSubscriptions))
+	for name, topics := range s.BrokerSubscriptions {
+		brokerSubscriptions[name] = maps.Clone(topics)
+	}
+	s.mu.Unlock()
+
+	if len(subscriptions) == 0 && len(brokerSubscriptions) == 0 {
 		slog.Warn("No routes were detected, so nothing to subscribe to")
 		return nil
 	}
-	slog.Info("Subscribing to MQTT topics.", "topics", s.Subscriptions)
-	if token := s.Client.SubscribeMultiple(s.Subscriptions, nil); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("error subscribing to topic '%v': %v", s.Subscriptions, token.Error())
+	errList := []error{s.subscribe(subscriptions)}
+	for name, topics := range brokerSubscriptions {
+		// Brokers which are not connected yet are subscribed to once connected
+		if client, ok := s.Brokers[name]; ok && client.IsConnectionOpen() {
+			errList = append(errList, subscribeTopics(client, topics))
+		}
 	}
-	return nil
+	return errors.Join(errList...)
 }
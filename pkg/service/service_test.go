@@ -0,0 +1,42 @@
+package service
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/streamer"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IgnoreRetainedMessages(t *testing.T) {
+	mu := sync.Mutex{}
+	received := map[string][]template.Metadata{}
+	handler := func(name string) MessageHandler {
+		return func(topic, message string, metadata template.Metadata) (*streamer.OutputMessage, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name] = append(received[name], metadata)
+			return nil, nil
+		}
+	}
+
+	app := &Service{
+		handlers: []RouteHandler{
+			{Route: routes.Route{Name: "all", Topics: []routes.Topic{{Topic: "in"}}}, Handler: handler("all")},
+			{Route: routes.Route{Name: "live", Topics: []routes.Topic{{Topic: "in"}}, IgnoreRetained: true}, Handler: handler("live")},
+		},
+	}
+
+	app.onMessage(nil, &testMessage{topic: "in", payload: []byte("{}"), retained: true})
+	app.onMessage(nil, &testMessage{topic: "in", payload: []byte("{}")})
+
+	assert.Len(t, received["all"], 2)
+	assert.True(t, received["all"][0].Envelope.Retain)
+	assert.Equal(t, byte(1), received["all"][0].Envelope.QoS)
+	assert.False(t, received["all"][0].Envelope.ReceivedTime.IsZero())
+
+	assert.Len(t, received["live"], 1)
+	assert.False(t, received["live"][0].Envelope.Retain)
+}
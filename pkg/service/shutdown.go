@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Default time given to in-flight messages to be processed when shutting down
+const DefaultShutdownGracePeriod = 10 * time.Second
+
+// Time given to the mqtt clients to send any outstanding messages when disconnecting (in milliseconds)
+const disconnectQuiesce = 250
+
+// Maximum time to wait for the down status to be published. The status is still published
+// if the grace period was exceeded
+const publishDownTimeout = 2 * time.Second
+
+// Stopping returns true once the service has started shutting down
+func (s *Service) Stopping() bool {
+	s.stopMu.RLock()
+	defer s.stopMu.RUnlock()
+	return s.stopping
+}
+
+// Wait for the messages which are being processed without a pipeline
+func (s *Service) waitInflight(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting new messages, waits for in-flight messages to be processed
+// (until the context is done), flushes the delayed messages kept in memory, publishes
+// the down status and disconnects from the broker. Delayed messages in the delay queue
+// and buffered api requests are kept on disk, and are sent after the next start.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.stopMu.Lock()
+	if s.stopping {
+		s.stopMu.Unlock()
+		return nil
+	}
+	s.stopping = true
+	s.stopMu.Unlock()
+
+	started := time.Now()
+	slog.Info("Stopping service.")
+	errList := make([]error, 0)
+
+	s.mu.RLock()
+	subscribed := s.subscribed
+	topics := make([]string, 0, len(s.Subscriptions))
+	for topic := range s.Subscriptions {
+		topics = append(topics, topic)
+	}
+	brokerTopics := make(map[string][]string, len(s.BrokerSubscriptions))
+	for name, subscriptions := range s.BrokerSubscriptions {
+		for topic := range subscriptions {
+			brokerTopics[name] = append(brokerTopics[name], topic)
+		}
+	}
+	s.mu.RUnlock()
+	if subscribed && s.Client != nil && s.Client.IsConnected() {
+		if err := s.unsubscribe(topics...); err != nil {
+			slog.Warn("Could not unsubscribe from route topics.", "error", err)
+		}
+	}
+	for name, client := range s.Brokers {
+		if subscribed && client.IsConnected() {
+			if err := unsubscribeTopics(client, brokerTopics[name]...); err != nil {
+				slog.Warn("Could not unsubscribe from route topics.", "broker", name, "error", err)
+			}
+		}
+	}
+
+	slog.Info("Waiting for in-flight messages to be processed.")
+	if s.Pipeline != nil {
+		if err := s.Pipeline.Close(ctx); err != nil {
+			errList = append(errList, fmt.Errorf("messages were still being processed. %w", err))
+		}
+	}
+	if err := s.waitInflight(ctx); err != nil {
+		errList = append(errList, fmt.Errorf("messages were still being processed. %w", err))
+	}
+
+	if pending := s.Tasks.Pending(); pending > 0 {
+		slog.Info("Sending delayed and rate limited messages now.", "pending", pending)
+	}
+	if err := s.Tasks.Flush(ctx); err != nil {
+		errList = append(errList, fmt.Errorf("delayed messages were still being sent. %w", err))
+	}
+
+	if s.DelayQueue != nil {
+		if pending := s.DelayQueue.Pending(); pending > 0 {
+			slog.Info("Delayed messages will be sent after the next start.", "pending", pending)
+		}
+		s.DelayQueue.Stop()
+	}
+	if s.Outbox != nil {
+		s.Outbox.Stop()
+		if pending := s.Outbox.Pending(); pending > 0 {
+			slog.Info("Buffered api requests will be sent after the next start.", "pending", pending)
+		}
+	}
+
+	if err := s.publishDown(); err != nil {
+		errList = append(errList, fmt.Errorf("could not publish down status. %w", err))
+	}
+
+	clients := []mqtt.Client{s.RegistrationClient, s.Client}
+	for _, client := range s.Brokers {
+		clients = append(clients, client)
+	}
+	for _, client := range clients {
+		if client != nil && client.IsConnected() {
+			client.Disconnect(disconnectQuiesce)
+		}
+	}
+
+	err := errors.Join(errList...)
+	slog.Info("Stopped service.", "duration", time.Since(started), "error", err)
+	return err
+}
+
+func (s *Service) publishDown() error {
+	if s.Client == nil || s.ServiceTopic == "" || !s.Client.IsConnected() {
+		return nil
+	}
+	payload, err := json.Marshal(HealthStatus{
+		Status: HealthDown,
+		PID:    os.Getpid(),
+		Time:   time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	token := s.Client.Publish(s.HealthTopic(), 1, true, payload)
+	if !token.WaitTimeout(publishDownTimeout) {
+		return errors.New("timeout")
+	}
+	return token.Error()
+}
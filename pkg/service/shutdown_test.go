@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/pipeline"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/streamer"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+type testMessage struct {
+	mqtt.Message
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *testMessage) Topic() string   { return m.topic }
+func (m *testMessage) Payload() []byte { return m.payload }
+func (m *testMessage) Retained() bool  { return m.retained }
+func (m *testMessage) Qos() byte       { return 1 }
+func (m *testMessage) Duplicate() bool { return false }
+
+func Test_ShutdownWaitsForInflightMessages(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		processed := atomic.Int32{}
+		app := &Service{
+			Subscriptions: map[string]byte{},
+			Tasks:         NewTasks(),
+		}
+		if workers > 0 {
+			app.Pipeline = pipeline.New(workers, 10, pipeline.PolicyBlock)
+		}
+		handler := func(topic, message string, metadata template.Metadata) (*streamer.OutputMessage, error) {
+			time.Sleep(20 * time.Millisecond)
+			app.Tasks.AfterFunc(time.Hour, func() { processed.Add(1) })
+			return nil, nil
+		}
+		app.handlers = []RouteHandler{{Route: routes.Route{Name: "route1", Topics: []routes.Topic{{Topic: "in"}}}, Handler: handler}}
+
+		go app.onMessage(nil, &testMessage{topic: "in", payload: []byte("{}")})
+		time.Sleep(5 * time.Millisecond)
+
+		assert.NoError(t, app.Shutdown(context.Background()))
+		assert.Equal(t, int32(1), processed.Load(), "workers=%d", workers)
+
+		// New messages are not accepted
+		app.onMessage(nil, &testMessage{topic: "in", payload: []byte("{}")})
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, int32(1), processed.Load(), "workers=%d", workers)
+		assert.True(t, app.Stopping())
+	}
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Tasks tracks functions which are scheduled to run later in memory (e.g. delayed
+// messages without a delay queue, or api retries), so they can be flushed on shutdown.
+// All methods can be called on a nil Tasks, in which case the functions are only scheduled
+type Tasks struct {
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]*scheduledTask
+	running sync.WaitGroup
+	flushed bool
+}
+
+type scheduledTask struct {
+	timer *time.Timer
+	f     func()
+}
+
+func NewTasks() *Tasks {
+	return &Tasks{
+		pending: make(map[uint64]*scheduledTask),
+	}
+}
+
+// AfterFunc runs the function after the delay. Once flushed, functions are run immediately
+func (t *Tasks) AfterFunc(d time.Duration, f func()) {
+	if t == nil {
+		time.AfterFunc(d, f)
+		return
+	}
+
+	t.mu.Lock()
+	if t.flushed {
+		t.mu.Unlock()
+		f()
+		return
+	}
+	t.seq++
+	id := t.seq
+	task := &scheduledTask{f: f}
+	t.pending[id] = task
+	t.running.Add(1)
+	task.timer = time.AfterFunc(d, func() {
+		t.mu.Lock()
+		_, ok := t.pending[id]
+		delete(t.pending, id)
+		t.mu.Unlock()
+		if ok {
+			defer t.running.Done()
+			f()
+		}
+	})
+	t.mu.Unlock()
+}
+
+// Pending returns the number of functions waiting to be run
+func (t *Tasks) Pending() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// Flush runs all pending functions now, and waits for them to complete or until the context is done
+func (t *Tasks) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	t.flushed = true
+	ids := make([]uint64, 0, len(t.pending))
+	for id, task := range t.pending {
+		if task.timer.Stop() {
+			ids = append(ids, id)
+		}
+	}
+	// Keep the order in which the functions were scheduled
+	slices.Sort(ids)
+	tasks := make([]*scheduledTask, 0, len(ids))
+	for _, id := range ids {
+		tasks = append(tasks, t.pending[id])
+		delete(t.pending, id)
+	}
+	t.mu.Unlock()
+
+	go func() {
+		for _, task := range tasks {
+			task.f()
+			t.running.Done()
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		t.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TasksAreFlushedInOrder(t *testing.T) {
+	tasks := NewTasks()
+
+	var mu sync.Mutex
+	called := []int{}
+	for i := 1; i <= 3; i++ {
+		i := i
+		tasks.AfterFunc(time.Hour, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			called = append(called, i)
+		})
+	}
+	assert.Equal(t, 3, tasks.Pending())
+
+	assert.NoError(t, tasks.Flush(context.Background()))
+	assert.Equal(t, 0, tasks.Pending())
+	assert.Equal(t, []int{1, 2, 3}, called)
+
+	// Functions scheduled after flushing are run immediately
+	tasks.AfterFunc(time.Hour, func() { called = append(called, 4) })
+	assert.Equal(t, []int{1, 2, 3, 4}, called)
+}
+
+func Test_TasksFlushTimeout(t *testing.T) {
+	tasks := NewTasks()
+	release := make(chan struct{})
+	defer close(release)
+	tasks.AfterFunc(time.Hour, func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, tasks.Flush(ctx), context.DeadlineExceeded)
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Load the CA certificates (PEM) from a file and/or all files of a directory, in addition
+// to the system's certificates
+func loadCertPool(caFile, caDir string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca file. %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca file does not contain any certificates. file=%s", caFile)
+		}
+	}
+
+	if caDir != "" {
+		entries, err := os.ReadDir(caDir)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca directory. %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			pem, err := os.ReadFile(filepath.Join(caDir, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("could not read ca file. %w", err)
+			}
+			// Ignore files which are not certificates
+			pool.AppendCertsFromPEM(pem)
+		}
+	}
+	return pool, nil
+}
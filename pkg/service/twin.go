@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+)
+
+// Default interval used to publish the route statistics
+const DefaultStatsInterval = 60 * time.Second
+
+// Twin fragments published by the service
+const (
+	TwinFragmentRoutes = "routes"
+	TwinFragmentStats  = "stats"
+)
+
+// TwinRoute describes a loaded route
+type TwinRoute struct {
+	Name     string   `json:"name"`
+	Topics   []string `json:"topics"`
+	File     string   `json:"file,omitempty"`
+	Priority int      `json:"priority"`
+	Skip     bool     `json:"skip,omitempty"`
+}
+
+// TwinStats are the runtime statistics of the service
+type TwinStats struct {
+	Time   string                        `json:"time"`
+	Routes map[string]metrics.RouteStats `json:"routes"`
+}
+
+// Topic used to publish a twin fragment of the service
+func (s *Service) TwinTopic(name string) string {
+	return s.ServiceTopic + "/twin/" + name
+}
+
+// Publish a twin fragment. Twin data is retained so the latest value is always available
+func (s *Service) publishTwin(name string, value any) {
+	if s.Client == nil || s.ServiceTopic == "" || !s.Client.IsConnected() {
+		return
+	}
+	payload, err := json.Marshal(value)
+	if err != nil {
+		slog.Warn("Could not create twin message.", "name", name, "error", err)
+		return
+	}
+	s.Client.Publish(s.TwinTopic(name), 1, true, payload)
+}
+
+// TwinRoutes returns the loaded routes, including skipped routes
+func (s *Service) TwinRoutes() []TwinRoute {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make([]TwinRoute, 0, len(s.Routes))
+	for _, route := range s.Routes {
+		topics := make([]string, 0, len(route.Topics))
+		for _, topic := range route.Topics {
+			topics = append(topics, topic.String())
+		}
+		items = append(items, TwinRoute{
+			Name:     route.Name,
+			Topics:   topics,
+			File:     route.File,
+			Priority: route.Priority,
+			Skip:     route.Skip,
+		})
+	}
+	return items
+}
+
+// PublishRoutes publishes the list of loaded routes
+func (s *Service) PublishRoutes() {
+	s.publishTwin(TwinFragmentRoutes, s.TwinRoutes())
+}
+
+// Stats returns the counters of each registered route
+func (s *Service) Stats() (TwinStats, error) {
+	stats, err := s.Metrics.RouteStats()
+	if err != nil {
+		return TwinStats{}, err
+	}
+
+	// Include routes which have not processed any messages yet
+	s.mu.RLock()
+	for _, h := range s.handlers {
+		if _, ok := stats[h.Route.Name]; !ok {
+			stats[h.Route.Name] = metrics.RouteStats{}
+		}
+	}
+	s.mu.RUnlock()
+
+	return TwinStats{
+		Time:   time.Now().Format(time.RFC3339),
+		Routes: stats,
+	}, nil
+}
+
+// PublishStats publishes the route statistics
+func (s *Service) PublishStats() {
+	stats, err := s.Stats()
+	if err != nil {
+		slog.Warn("Could not collect route statistics.", "error", err)
+		return
+	}
+	s.publishTwin(TwinFragmentStats, stats)
+}
+
+// ReportStats publishes the route statistics periodically until the context is cancelled
+func (s *Service) ReportStats(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.PublishStats()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.PublishStats()
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/metrics"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TwinData(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "routes.yaml")
+
+	app := &Service{
+		Subscriptions: map[string]byte{},
+		Metrics:       metrics.New(),
+	}
+	app.NewHandler = func(route routes.Route) (MessageHandler, error) {
+		return NewStreamFactory(nil, nil, route, nil, 2, WithMetrics(app.Metrics))
+	}
+
+	writeRouteFile(t, file, heredoc.Doc(`
+		routes:
+		- name: route1
+		  topics: [in/1]
+		  priority: 1
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/1', message: {}}"
+		- name: route2
+		  topics: [in/2]
+		  template:
+		    type: jsonnet
+		    value: "error 'failure'"
+		- name: route3
+		  topics: [in/3]
+		  skip: true
+		  template:
+		    type: jsonnet
+		    value: "{}"
+	`))
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+
+	twinRoutes := app.TwinRoutes()
+	if assert.Len(t, twinRoutes, 3) {
+		assert.Equal(t, TwinRoute{Name: "route1", Topics: []string{"in/1"}, File: file, Priority: 1}, twinRoutes[0])
+		assert.True(t, twinRoutes[2].Skip)
+	}
+
+	app.handlers[0].Handler("in/1", `{}`, template.Metadata{})
+	app.handlers[0].Handler("in/1", `{}`, template.Metadata{})
+	app.handlers[1].Handler("in/2", `{}`, template.Metadata{})
+
+	stats, err := app.Stats()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, stats.Time)
+	assert.Len(t, stats.Routes, 2)
+	assert.Equal(t, metrics.RouteStats{Matched: 2}, stats.Routes["route1"])
+
+	route2 := stats.Routes["route2"]
+	assert.Equal(t, uint64(1), route2.Matched)
+	assert.Equal(t, uint64(1), route2.Errors)
+	assert.NotNil(t, route2.LastErrorTime)
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Add a directory and all of its sub directories to the watcher
+func watchDirs(watcher *fsnotify.Watcher, dir string) {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			slog.Debug("Watching directory for changes.", "path", path)
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Warn("Could not watch directory.", "path", dir, "error", err)
+	}
+}
+
+func isJsonnet(name string) bool {
+	return strings.HasSuffix(name, ".jsonnet") || strings.HasSuffix(name, ".libsonnet")
+}
+
+func isReloadEvent(event fsnotify.Event) bool {
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		// The removed item could be a directory, so it is not possible to check the type
+		return true
+	}
+	if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+		return isYaml(event.Name) || isJsonnet(event.Name)
+	}
+	return false
+}
+
+// Watch the directories of any external template files (which might be outside of the route directories)
+func (s *Service) watchTemplateDirs(watcher *fsnotify.Watcher) {
+	for _, dir := range s.TemplateDirs() {
+		if err := watcher.Add(dir); err != nil {
+			slog.Warn("Could not watch template directory.", "path", dir, "error", err)
+		}
+	}
+}
+
+// WatchRoutes watches the route directories and reloads the routes when a file is changed.
+// Changes are debounced so that multiple events in quick succession only trigger a single reload.
+// The function blocks until the context is cancelled.
+func (s *Service) WatchRoutes(ctx context.Context, dirs []string, debounce time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, dir := range dirs {
+		watchDirs(watcher, dir)
+	}
+	s.watchTemplateDirs(watcher)
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watchDirs(watcher, event.Name)
+					reload = time.After(debounce)
+					continue
+				}
+			}
+			if isReloadEvent(event) {
+				slog.Debug("Detected route file change.", "path", event.Name, "op", event.Op.String())
+				reload = time.After(debounce)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("Route watcher error.", "error", err)
+
+		case <-reload:
+			reload = nil
+			slog.Info("Reloading routes.")
+			if err := s.ReloadRoutes(dirs); err != nil {
+				slog.Warn("Failed to reload routes.", "error", err)
+			}
+			s.watchTemplateDirs(watcher)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/fsnotify/fsnotify"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_IsReloadEvent(t *testing.T) {
+	testcases := []struct {
+		Event    fsnotify.Event
+		Expected bool
+	}{
+		{Event: fsnotify.Event{Name: "routes.yaml", Op: fsnotify.Write}, Expected: true},
+		{Event: fsnotify.Event{Name: "routes.yml", Op: fsnotify.Create}, Expected: true},
+		{Event: fsnotify.Event{Name: "template.jsonnet", Op: fsnotify.Write}, Expected: true},
+		{Event: fsnotify.Event{Name: "utils.libsonnet", Op: fsnotify.Write}, Expected: true},
+		{Event: fsnotify.Event{Name: "routes", Op: fsnotify.Remove}, Expected: true},
+		{Event: fsnotify.Event{Name: "routes.yaml", Op: fsnotify.Rename}, Expected: true},
+		{Event: fsnotify.Event{Name: "notes.txt", Op: fsnotify.Write}, Expected: false},
+		{Event: fsnotify.Event{Name: "routes.yaml", Op: fsnotify.Chmod}, Expected: false},
+	}
+	for _, c := range testcases {
+		assert.Equal(t, c.Expected, isReloadEvent(c.Event), c.Event.String())
+	}
+}
+
+func Test_WatchRoutes(t *testing.T) {
+	dir := t.TempDir()
+	app := &Service{
+		Subscriptions: map[string]byte{},
+		NewHandler: func(route routes.Route) (MessageHandler, error) {
+			return NewStreamFactory(nil, nil, route, nil, 2)
+		},
+	}
+	assert.NoError(t, app.ReloadRoutes([]string{dir}))
+
+	handlerNames := func() []string {
+		app.mu.RLock()
+		defer app.mu.RUnlock()
+		names := make([]string, 0, len(app.handlers))
+		for _, h := range app.handlers {
+			names = append(names, h.Route.Name)
+		}
+		return names
+	}
+	assert.Empty(t, handlerNames())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- app.WatchRoutes(ctx, []string{dir}, 200*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}()
+	// Give the watcher time to start watching the directory
+	time.Sleep(100 * time.Millisecond)
+
+	writeRouteFile(t, filepath.Join(dir, "routes.yaml"), heredoc.Doc(`
+		routes:
+		- name: route1
+		  topics: [in/1]
+		  template:
+		    type: jsonnet
+		    value: "{topic: 'out/1'}"
+	`))
+
+	// The routes are only reloaded after the debounce
+	assert.Empty(t, handlerNames())
+	assert.Eventually(t, func() bool {
+		names := handlerNames()
+		return len(names) == 1 && names[0] == "route1"
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string]byte{"in/1": 1}, app.Subscriptions)
+}
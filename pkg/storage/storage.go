@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+const recordExtension = ".json"
+
+// Store persists json records in a directory, using one file per record.
+// Records are written atomically, so a partially written record is never read
+// (e.g. if the process is stopped whilst writing). A store can be shared by
+// multiple processes, e.g. to inspect or remove records of a running service.
+type Store struct {
+	dir string
+}
+
+// Open a store. The directory is created if it does not already exist
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create storage directory. %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid record id. id=%s", id)
+	}
+	return filepath.Join(s.dir, id+recordExtension), nil
+}
+
+// Put writes a record, replacing any existing record with the same id
+func (s *Store) Put(id string, v any) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Get reads a record
+func (s *Store) Get(id string, v any) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Delete removes a record. ErrNotFound is returned if the record does not exist,
+// so only one caller can successfully delete a record
+func (s *Store) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// IDs returns the ids of all records (sorted)
+func (s *Store) IDs() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, recordExtension) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, recordExtension))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
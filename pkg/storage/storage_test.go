@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type record struct {
+	Value string `json:"value"`
+}
+
+func Test_Store(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "records"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Put("b", record{Value: "2"}))
+	assert.NoError(t, store.Put("a", record{Value: "1"}))
+	assert.NoError(t, store.Put("a", record{Value: "updated"}))
+
+	// Temporary and unrelated files are ignored
+	assert.NoError(t, os.WriteFile(filepath.Join(store.Dir(), ".tmp-123"), []byte("{"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(store.Dir(), "README.md"), []byte(""), 0644))
+
+	ids, err := store.IDs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+
+	value := record{}
+	assert.NoError(t, store.Get("a", &value))
+	assert.Equal(t, "updated", value.Value)
+
+	// Records can only be deleted once
+	assert.NoError(t, store.Delete("a"))
+	assert.ErrorIs(t, store.Delete("a"), ErrNotFound)
+	assert.ErrorIs(t, store.Get("a", &value), ErrNotFound)
+}
+
+func Test_StoreInvalidID(t *testing.T) {
+	store, err := Open(t.TempDir())
+	assert.NoError(t, err)
+	for _, id := range []string{"", "../a", "a/b", `a\b`, ".hidden"} {
+		assert.Error(t, store.Put(id, record{}), id)
+	}
+}
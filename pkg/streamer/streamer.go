@@ -1,10 +1,13 @@
 package streamer
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"strings"
 
+	"github.com/reubenmiller/tedge-mapper-template/pkg/errors"
 	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
 )
 
@@ -19,6 +22,10 @@ type SimpleOutputMessage struct {
 	Delay   float32 `json:"delay"`
 	Retain  bool    `json:"retain"`
 	QoS     float32 `json:"qos"`
+	// MQTT v5 properties of the message
+	Properties *template.Properties `json:"properties,omitempty"`
+	// Name of the broker the message is published to. Empty for the main broker
+	Broker string `json:"broker,omitempty"`
 }
 
 func (m *SimpleOutputMessage) MessageString() string {
@@ -46,13 +53,33 @@ func (m *SimpleOutputMessage) GetQoS() byte {
 }
 
 type RestRequest struct {
-	Host   string `json:"host,omitempty"`
-	Method string `json:"method,omitempty"`
-	Path   string `json:"path,omitempty"`
-	Body   any    `json:"body,omitempty"`
-	Skip   bool   `json:"skip,omitempty"`
+	Host string `json:"host,omitempty"`
+	// Name of a configured endpoint which the request is sent to (instead of the default api host)
+	Endpoint string `json:"endpoint,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Path     string `json:"path,omitempty"`
+	// Query parameters. Array values add the parameter multiple times
+	Query   map[string]any    `json:"query,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Content type of the body. Defaults to application/json
+	ContentType string `json:"content_type,omitempty"`
+	// Accepted content type of the response. Defaults to application/json
+	Accept string `json:"accept,omitempty"`
+	// Body which is sent as json
+	Body any `json:"body,omitempty"`
+	// Body which is sent as is, e.g. text or csv
+	RawBody *string `json:"raw_body,omitempty"`
+	// Binary body encoded as base64
+	BodyBase64 string `json:"body_base64,omitempty"`
+	// Request timeout in seconds
+	Timeout float32 `json:"timeout,omitempty"`
+	Skip    bool    `json:"skip,omitempty"`
+	// Topic which the response is published to (optional)
+	ResponseTopic string `json:"response_topic,omitempty"`
 }
 
+var allowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
 func (r *RestRequest) Validate() error {
 	if r.Path == "" {
 		return fmt.Errorf("path is empty")
@@ -60,9 +87,29 @@ func (r *RestRequest) Validate() error {
 	if r.Method == "" {
 		return fmt.Errorf("method is empty")
 	}
-	method := strings.ToUpper(r.Method)
-	if method != "PUT" && method != "POST" && method != "GET" {
-		return fmt.Errorf("method not allowed. only POST, PUT and GET methods are supported. got=%s", r.Method)
+	if r.Host != "" && r.Endpoint != "" {
+		return fmt.Errorf("only one of host or endpoint can be set")
+	}
+	if !slices.Contains(allowedMethods, strings.ToUpper(r.Method)) {
+		return fmt.Errorf("method not allowed. expected one of %v. got=%s", allowedMethods, r.Method)
+	}
+
+	bodies := 0
+	for _, set := range []bool{r.Body != nil, r.RawBody != nil, r.BodyBase64 != ""} {
+		if set {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		return fmt.Errorf("only one of body, raw_body or body_base64 can be set")
+	}
+	if r.BodyBase64 != "" {
+		if _, err := base64.StdEncoding.DecodeString(r.BodyBase64); err != nil {
+			return fmt.Errorf("body_base64 is not valid base64. %w", err)
+		}
+	}
+	if r.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative. got=%v", r.Timeout)
 	}
 	return nil
 }
@@ -80,6 +127,10 @@ type OutputMessage struct {
 	Context    *bool                 `json:"context,omitempty"`
 	Retain     bool                  `json:"retain,omitempty"`
 	QoS        float32               `json:"qos,omitempty"`
+	// MQTT v5 properties of the message
+	Properties *template.Properties `json:"properties,omitempty"`
+	// Name of the broker the message is published to. Empty for the main broker
+	Broker string `json:"broker,omitempty"`
 }
 
 func NewStreamer(engine template.Templater) *Streamer {
@@ -136,15 +187,15 @@ func (m *OutputMessage) MessageString() string {
 	}
 }
 
-func (s *Streamer) Process(topic, message string, variables string) (*OutputMessage, error) {
-	out, err := s.Engine.Execute(topic, message, variables)
+func (s *Streamer) Process(topic, message string, variables string, metadata template.Metadata) (*OutputMessage, error) {
+	out, err := s.Engine.Execute(topic, message, variables, metadata)
 	if err != nil {
 		return nil, err
 	}
 
 	sm := &OutputMessage{}
 	if err := json.Unmarshal([]byte(out), sm); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w. %w", errors.ErrInvalidOutput, err)
 	}
 
 	return sm, nil
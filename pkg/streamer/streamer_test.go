@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/reubenmiller/tedge-mapper-template/pkg/jsonnet"
+	"github.com/reubenmiller/tedge-mapper-template/pkg/template"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -145,7 +146,7 @@ func Test_StreamerProcessJsonnet(t *testing.T) {
 	for _, c := range testcases {
 		engine := jsonnet.NewEngine(c.Template)
 		stream := NewStreamer(engine)
-		out, err := stream.Process(c.Topic, c.Message, "")
+		out, err := stream.Process(c.Topic, c.Message, "", template.Metadata{})
 
 		if c.ExpectedErr != nil {
 			assert.Error(t, err)
@@ -228,7 +229,7 @@ func Test_StreamerProcessJsonnetWithUpdateMessages(t *testing.T) {
 	for _, c := range testcases {
 		engine := jsonnet.NewEngine(c.Template)
 		stream := NewStreamer(engine)
-		out, err := stream.Process(c.Topic, c.Message, "")
+		out, err := stream.Process(c.Topic, c.Message, "", template.Metadata{})
 
 		if c.ExpectedErr != nil {
 			assert.Error(t, err)
@@ -257,3 +258,53 @@ func Test_StreamerProcessJsonnetWithUpdateMessages(t *testing.T) {
 		assert.Equal(t, c.ExpectedSkip, out.Skip)
 	}
 }
+
+func Test_RestRequestValidate(t *testing.T) {
+	raw := "text"
+	testcases := []struct {
+		Name    string
+		Request RestRequest
+		Valid   bool
+	}{
+		{Name: "post", Request: RestRequest{Method: "POST", Path: "/event/events", Body: map[string]any{}}, Valid: true},
+		{Name: "lowercase method", Request: RestRequest{Method: "delete", Path: "/event/events/1"}, Valid: true},
+		{Name: "patch", Request: RestRequest{Method: "PATCH", Path: "/service/app"}, Valid: true},
+		{Name: "binary body", Request: RestRequest{Method: "POST", Path: "/inventory/binaries", BodyBase64: "aGVsbG8="}, Valid: true},
+		{Name: "missing path", Request: RestRequest{Method: "GET"}},
+		{Name: "unknown method", Request: RestRequest{Method: "FETCH", Path: "/"}},
+		{Name: "invalid base64", Request: RestRequest{Method: "POST", Path: "/", BodyBase64: "not base64!"}},
+		{Name: "multiple bodies", Request: RestRequest{Method: "POST", Path: "/", Body: map[string]any{}, RawBody: &raw}},
+		{Name: "host and endpoint", Request: RestRequest{Method: "GET", Path: "/", Host: "example.com", Endpoint: "local"}},
+		{Name: "negative timeout", Request: RestRequest{Method: "GET", Path: "/", Timeout: -1}},
+	}
+	for _, c := range testcases {
+		t.Run(c.Name, func(t *testing.T) {
+			err := c.Request.Validate()
+			if c.Valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func Test_ProcessWithProperties(t *testing.T) {
+	engine := jsonnet.NewEngine(`{
+		topic: 'out',
+		message: {},
+		properties: {content_type: 'application/json', user_properties: {source: props.user_properties.source}},
+		updates: [{topic: 'other', message: {}, properties: {response_topic: 'reply'}}],
+	}`)
+	stream := NewStreamer(engine)
+	out, err := stream.Process("in", `{}`, "", template.Metadata{
+		Properties: &template.Properties{UserProperties: map[string]string{"source": "child01"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &template.Properties{
+		ContentType:    "application/json",
+		UserProperties: map[string]string{"source": "child01"},
+	}, out.Properties)
+	assert.Len(t, out.Updates, 1)
+	assert.Equal(t, &template.Properties{ResponseTopic: "reply"}, out.Updates[0].Properties)
+}
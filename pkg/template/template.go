@@ -1,7 +1,49 @@
 package template
 
+import "time"
+
 type Templater interface {
-	Execute(string, string, string) (string, error)
+	Execute(topic string, input string, variables string, metadata Metadata) (string, error)
 	Debug() bool
 	DryRun() bool
 }
+
+// Metadata of the input message which is passed to the template in addition to the message itself
+type Metadata struct {
+	// MQTT v5 properties of the message (available as props)
+	Properties *Properties
+	// How the message was delivered (available as mqtt)
+	Envelope *Envelope
+	// Routing context of the message if it is not part of the payload (available as ctx)
+	Context *Context
+}
+
+// Context is the routing context of a message, which protects against infinite loops between routes
+type Context struct {
+	// Number of routes the message (or the messages it was created from) has passed through
+	Level int `json:"lvl"`
+	// Names of the routes the message has passed through
+	Trace []string `json:"trace,omitempty"`
+}
+
+// Envelope describes how a message was delivered by the broker
+type Envelope struct {
+	// Message was retained by the broker, e.g. it was published before subscribing
+	Retain    bool `json:"retain"`
+	QoS       byte `json:"qos"`
+	Duplicate bool `json:"duplicate"`
+	// Time the message was received by the service
+	ReceivedTime time.Time `json:"received_time"`
+	// Name of the broker the message was received from. Empty for the main broker
+	Broker string `json:"broker"`
+}
+
+// Properties are the MQTT v5 properties of a message
+type Properties struct {
+	ContentType     string `json:"content_type,omitempty"`
+	ResponseTopic   string `json:"response_topic,omitempty"`
+	CorrelationData string `json:"correlation_data,omitempty"`
+	// Message expiry interval in seconds
+	MessageExpiry  *uint32           `json:"message_expiry,omitempty"`
+	UserProperties map[string]string `json:"user_properties,omitempty"`
+}